@@ -0,0 +1,44 @@
+package main
+
+import (
+	"crypto/subtle"
+	"log"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+type RevokeSessionsResponse struct {
+	// number of sessions that were revoked
+	Revoked int `json:"revoked"`
+}
+
+// Only let requests with the admin token through to the admin api
+func adminMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		expected := []byte("Bearer " + config.AdminToken)
+		if config.AdminToken == "" || subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+			writeAPIError(w, http.StatusUnauthorized, "unauthenticated", "send the admin token as a bearer token", false)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// DELETE /admin/teams/{teamId}/sessions
+// Log out every session for a team
+func revokeTeamSessionsRequest(w http.ResponseWriter, r *http.Request) {
+	teamId := mux.Vars(r)["teamId"]
+
+	n, err := store.Backend.DeleteTeam(teamId)
+	if err != nil {
+		log.Printf("couldn't revoke sessions for team %s: %v", teamId, err)
+		writeAPIError(w, http.StatusInternalServerError, "internal_error", "couldn't revoke the sessions", true)
+		return
+	}
+
+	log.Printf("revoked %d session(s) for team %s", n, teamId)
+
+	writeJSON(w, http.StatusOK, RevokeSessionsResponse{Revoked: n})
+}
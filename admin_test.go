@@ -0,0 +1,32 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdminListener(t *testing.T) {
+	store = newSessionStore([]byte("aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"), newMemorySessionBackend(), time.Hour)
+	defer func() { config, store = nil, nil }()
+
+	revoke := func(router http.Handler) int {
+		r := httptest.NewRequest("DELETE", "/admin/teams/team/sessions", nil)
+		r.Header.Set("Authorization", "Bearer admin")
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, r)
+		return rec.Code
+	}
+
+	// the admin api is on the web app without an admin listener
+	config = &Config{AdminToken: "admin"}
+	assert.Equal(t, 200, revoke(newRouter()))
+
+	// otherwise it's only on the admin listener
+	config.AdminListenAddr = "127.0.0.1:5051"
+	assert.NotEqual(t, 200, revoke(newRouter()))
+	assert.Equal(t, 200, revoke(newAdminRouter()))
+}
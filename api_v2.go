@@ -0,0 +1,330 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/sessions"
+)
+
+// APIError describes why a v2 request failed
+type APIError struct {
+	// machine readable error code, e.g. "no_instance"
+	Code string `json:"code"`
+
+	// human readable description of the error
+	Message string `json:"message"`
+
+	// if the same request may succeed later
+	Retryable bool `json:"retryable"`
+}
+
+// Body of every v2 error response
+type APIErrorResponse struct {
+	Error APIError `json:"error"`
+}
+
+type V2AuthRequest struct {
+	// rCTF auth url or login token
+	Token string `json:"token"`
+}
+
+type V2AuthResponse struct {
+	TeamName string `json:"teamName"`
+	TeamId   string `json:"teamId"`
+}
+
+// Info about a team's instance, returned by every v2 instance endpoint
+type InstanceResponse struct {
+	State string `json:"state"` // "running" || "destroying" || "destroyed" || "failed"
+	Host  string `json:"host,omitempty"`
+
+	// RFC 3339
+	ExpTime *time.Time `json:"expTime,omitempty"`
+
+	Health string `json:"health,omitempty"` // "ready" || "starting" || "crashing" || "unknown"
+
+	// token to send when connecting to the instance, only set if access control is enabled
+	AccessToken string `json:"accessToken,omitempty"`
+
+	// CIDRs allowed to connect to the instance, only set if the source allowlist is enabled
+	AllowedIPs []string `json:"allowedIps,omitempty"`
+
+	// times the instance was extended, and how many times it can be (0 for no limit)
+	Extensions    int `json:"extensions"`
+	MaxExtensions int `json:"maxExtensions"`
+}
+
+type V2AllowIPRequest struct {
+	// IP to allow, the IP sending the request is allowed if it's empty
+	Ip string `json:"ip"`
+}
+
+// Write a v2 response as JSON
+func writeJSON(w http.ResponseWriter, code int, resp interface{}) {
+	respBytes, err := json.Marshal(resp)
+	if err != nil {
+		log.Printf("couldn't marshal v2 response data: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Add("Content-type", "application/json")
+	w.WriteHeader(code)
+	w.Write(respBytes)
+}
+
+// Write a v2 error response
+func writeAPIError(w http.ResponseWriter, status int, code, message string, retryable bool) {
+	writeJSON(w, status, APIErrorResponse{Error: APIError{Code: code, Message: message, Retryable: retryable}})
+}
+
+// Write the v2 error response for an error from the InstanceManager.
+// The error itself is only logged, it may have cluster details that teams shouldn't see
+func writeInstanceError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errNoInstance):
+		writeAPIError(w, http.StatusNotFound, "no_instance", "your team doesn't have a running instance", false)
+	case errors.Is(err, errInstanceExpired):
+		writeAPIError(w, http.StatusConflict, "instance_expired", "the instance already expired", false)
+	case errors.Is(err, errExtensionLimit):
+		writeAPIError(w, http.StatusForbidden, "extension_limit", "the instance can't be extended any more", false)
+	case errors.Is(err, errRecreateCooldown):
+		writeAPIError(w, http.StatusTooManyRequests, "recreate_cooldown", "the instance was destroyed recently, try again in a bit", true)
+	case errors.Is(err, errRestartCooldown):
+		writeAPIError(w, http.StatusTooManyRequests, "restart_cooldown", "the instance was restarted recently, try again in a few minutes", true)
+	case errors.Is(err, errTooManyAllowedIPs):
+		writeAPIError(w, http.StatusConflict, "too_many_ips", "your team already allowed the max number of IPs", false)
+	case errors.Is(err, errFeatureDisabled):
+		writeAPIError(w, http.StatusNotFound, "feature_disabled", "this feature isn't available", false)
+	default:
+		writeAPIError(w, http.StatusInternalServerError, "internal_error", "something went wrong, try again or contact an admin", true)
+	}
+}
+
+// Decode a JSON request body. An empty body leaves v unchanged
+func decodeJSONBody(r *http.Request, v interface{}) error {
+	err := json.NewDecoder(io.LimitReader(r.Body, 4096)).Decode(v)
+	if errors.Is(err, io.EOF) {
+		return nil
+	}
+
+	return err
+}
+
+// Build the response for a team's instance
+func instanceResponse(r *http.Request, di *DeploymentInstance) InstanceResponse {
+	snap := di.Snapshot()
+	resp := InstanceResponse{
+		State:         snap.State.String(),
+		Extensions:    snap.Extensions,
+		MaxExtensions: config.MaxExtensions,
+	}
+
+	if snap.State == Running {
+		resp.Host = snap.GetCxn()
+		resp.ExpTime = snap.ExpTime
+		resp.Health = di.GetHealth(r.Context())
+		resp.AccessToken = snap.AccessToken
+		resp.AllowedIPs = snap.AllowedIPs
+	}
+
+	return resp
+}
+
+// Team that a v2 request was authenticated as
+type Team struct {
+	Id   string
+	Name string
+}
+
+// custom http.Handler for v2 routes that need an authenticated team.
+// The team comes from an rCTF auth token in the Authorization header if it's set, otherwise the session
+type teamHandler func(w http.ResponseWriter, r *http.Request, team Team)
+
+func (h teamHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if authz := r.Header.Get("Authorization"); authz != "" {
+		if !strings.HasPrefix(authz, "Bearer ") {
+			writeAPIError(w, http.StatusUnauthorized, "bad_auth_token", "the Authorization header must be a Bearer token", false)
+			return
+		}
+
+		userInfo, err := getCachedUserInfo(strings.TrimPrefix(authz, "Bearer "), time.Now().UTC())
+		if errors.Is(err, errBadAuthToken) {
+			writeAPIError(w, http.StatusUnauthorized, "bad_auth_token", "rCTF didn't accept the auth token", false)
+			return
+		} else if err != nil {
+			log.Printf("error handling v2 bearer auth: %v", err)
+			writeAPIError(w, http.StatusBadGateway, "rctf_unavailable", "couldn't check the auth token with rCTF, try again in a bit", true)
+			return
+		}
+
+		h(w, r, Team{Id: userInfo.Id, Name: userInfo.TeamName})
+		return
+	}
+
+	sessionHandler(func(w http.ResponseWriter, r *http.Request, s *sessions.Session) {
+		teamId, ok := s.Values["id"].(string)
+		if s.IsNew || !ok {
+			writeAPIError(w, http.StatusUnauthorized, "unauthenticated", "log in with your rCTF token first", false)
+			return
+		}
+
+		teamName, _ := s.Values["teamName"].(string)
+		h(w, r, Team{Id: teamId, Name: teamName})
+	}).ServeHTTP(w, r)
+}
+
+// POST /api/v2/auth
+// Log in with an rCTF auth url or login token
+func authRequestV2(w http.ResponseWriter, r *http.Request, s *sessions.Session) {
+	req := V2AuthRequest{}
+	if err := decodeJSONBody(r, &req); err != nil || req.Token == "" {
+		writeAPIError(w, http.StatusBadRequest, "invalid_request", "the body must be JSON with a token", false)
+		return
+	}
+
+	userInfo, err := loginTeam(w, r, s, req.Token)
+	if errors.Is(err, errBadLoginToken) {
+		writeAPIError(w, http.StatusUnauthorized, "bad_login_token", "rCTF didn't accept the token", false)
+		return
+	} else if err != nil {
+		log.Printf("error handling v2 client auth: %v", err)
+		writeAPIError(w, http.StatusBadGateway, "rctf_unavailable", "couldn't log in with rCTF, try again in a bit", true)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, V2AuthResponse{TeamName: userInfo.TeamName, TeamId: userInfo.Id})
+}
+
+// GET /api/v2/instance
+// Get the team's instance, 404 if there isn't one
+func getInstanceRequestV2(w http.ResponseWriter, r *http.Request, team Team) {
+	di := im.GetDeploymentInstance(team.Id)
+	if di == nil || di.Snapshot().State == Destroyed {
+		writeAPIError(w, http.StatusNotFound, "no_instance", "your team doesn't have an instance", false)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, instanceResponse(r, di))
+}
+
+// POST /api/v2/instance
+// Create an instance for the team, blocks until it's running
+func createInstanceRequestV2(w http.ResponseWriter, r *http.Request, team Team) {
+	if di := im.GetDeploymentInstance(team.Id); di != nil {
+		switch di.Snapshot().State {
+		case Running:
+			writeAPIError(w, http.StatusConflict, "already_running", "your team already has a running instance", false)
+			return
+		case Destroying:
+			writeAPIError(w, http.StatusConflict, "instance_busy", "your team's instance is being destroyed, try again in a bit", true)
+			return
+		}
+	}
+
+	log.Printf("Deploying instance for %s (ID: %s)", team.Name, team.Id)
+
+	if _, err := im.CreateDeployment(opCtx, team.Id, requestIP(r)); err != nil {
+		log.Printf("couldn't create a deployment for %s: %v", team.Name, err)
+
+		if errors.Is(err, errRecreateCooldown) {
+			setCooldownRetryAfter(w, err, team.Id)
+			writeInstanceError(w, err)
+			return
+		}
+
+		writeAPIError(w, http.StatusInternalServerError, "deploy_failed", "the instance couldn't be deployed, try again or contact an admin", true)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, instanceResponse(r, im.GetDeploymentInstance(team.Id)))
+}
+
+// DELETE /api/v2/instance
+// Destroy the team's instance
+func destroyInstanceRequestV2(w http.ResponseWriter, r *http.Request, team Team) {
+	di := im.GetDeploymentInstance(team.Id)
+	if di == nil || di.Snapshot().State != Running {
+		writeInstanceError(w, errNoInstance)
+		return
+	}
+
+	log.Printf("Destroying instance for %s (ID: %s)", team.Name, team.Id)
+
+	if err := im.DestroyDeployment(opCtx, team.Id); err != nil {
+		log.Printf("couldn't destroy deployment for %s: %v", team.Name, err)
+		writeInstanceError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, instanceResponse(r, di))
+}
+
+// POST /api/v2/instance/extend
+// Push back the expiration time of the team's instance
+func extendInstanceRequestV2(w http.ResponseWriter, r *http.Request, team Team) {
+	log.Printf("Extending instance for %s (ID: %s)", team.Name, team.Id)
+
+	if _, err := im.ExtendDeployment(opCtx, team.Id); err != nil {
+		log.Printf("couldn't extend deployment for %s: %v", team.Name, err)
+		writeInstanceError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, instanceResponse(r, im.GetDeploymentInstance(team.Id)))
+}
+
+// POST /api/v2/instance/restart
+// Restart the pods of the team's instance, keeping the endpoint and expiration time
+func restartInstanceRequestV2(w http.ResponseWriter, r *http.Request, team Team) {
+	log.Printf("Restarting instance for %s (ID: %s)", team.Name, team.Id)
+
+	if err := im.RestartDeployment(opCtx, team.Id); err != nil {
+		log.Printf("couldn't restart deployment for %s: %v", team.Name, err)
+		setCooldownRetryAfter(w, err, team.Id)
+		writeInstanceError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusAccepted, instanceResponse(r, im.GetDeploymentInstance(team.Id)))
+}
+
+// POST /api/v2/instance/allowed-ips
+// Allow another IP to connect to the team's instance
+func allowIPRequestV2(w http.ResponseWriter, r *http.Request, team Team) {
+	if !config.SourceAllowlist {
+		writeInstanceError(w, errFeatureDisabled)
+		return
+	}
+
+	req := V2AllowIPRequest{}
+	if err := decodeJSONBody(r, &req); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_request", "the body must be JSON", false)
+		return
+	}
+
+	ip := strings.TrimSpace(req.Ip)
+	if ip == "" {
+		ip = requestIP(r)
+	} else if net.ParseIP(ip) == nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_ip", "that isn't a valid IP", false)
+		return
+	}
+
+	log.Printf("Allowing %s to connect to instance for %s (ID: %s)", ip, team.Name, team.Id)
+
+	if _, err := im.AllowSourceIP(opCtx, team.Id, ip); err != nil {
+		log.Printf("couldn't allow IP for %s: %v", team.Name, err)
+		writeInstanceError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, instanceResponse(r, im.GetDeploymentInstance(team.Id)))
+}
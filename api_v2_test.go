@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/captainGeech42/chaldeploy/internal/generic_map"
+	"github.com/stretchr/testify/assert"
+)
+
+// Send a v2 request, with a session for the team if teamId is set
+func doV2Request(t *testing.T, h http.Handler, method, teamId string) (int, APIErrorResponse, InstanceResponse) {
+	return doV2RequestWithHeader(t, h, method, teamId, "")
+}
+
+// Make a v2 request, with a session for the team if teamId is set and an Authorization header if authz is set
+func newV2Request(t *testing.T, method, teamId, authz string) *http.Request {
+	req := httptest.NewRequest(method, "/api/v2/instance", nil)
+	if authz != "" {
+		req.Header.Set("Authorization", authz)
+	}
+
+	if teamId != "" {
+		// sessions are cached on the request, so make the cookie with a different one
+		loginReq := httptest.NewRequest("POST", "/api/v2/auth", nil)
+		rec := httptest.NewRecorder()
+		s, _ := store.Get(loginReq, "session")
+		s.Values["id"] = teamId
+		assert.Nil(t, s.Save(loginReq, rec))
+		for _, c := range rec.Result().Cookies() {
+			req.AddCookie(c)
+		}
+	}
+
+	return req
+}
+
+// Send a v2 request with an Authorization header, if it's set
+func doV2RequestWithHeader(t *testing.T, h http.Handler, method, teamId, authz string) (int, APIErrorResponse, InstanceResponse) {
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, newV2Request(t, method, teamId, authz))
+	assert.Equal(t, "application/json", rec.Header().Get("Content-type"))
+
+	errResp := APIErrorResponse{}
+	instResp := InstanceResponse{}
+	json.Unmarshal(rec.Body.Bytes(), &errResp)
+	json.Unmarshal(rec.Body.Bytes(), &instResp)
+
+	return rec.Code, errResp, instResp
+}
+
+func TestAPIv2(t *testing.T) {
+	config = &Config{MaxExtensions: 2}
+	store = newSessionStore([]byte("aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"), newMemorySessionBackend(), time.Hour)
+	im = &InstanceManager{
+		Instances:        new(generic_map.MapOf[string, *DeploymentInstance]),
+		DisabledFeatures: map[string]bool{FeatureCrashDetection: true},
+	}
+	defer func() { config, store, im = nil, nil, nil }()
+
+	expTime := time.Now().UTC().Add(time.Hour)
+	im.Instances.Store("running", &DeploymentInstance{State: Running, Hostname: "10.0.0.1", Port: 1337, ExpTime: &expTime, Extensions: 2, mu: &sync.Mutex{}})
+
+	// needs a session
+	code, errResp, _ := doV2Request(t, teamHandler(getInstanceRequestV2), "GET", "")
+	assert.Equal(t, http.StatusUnauthorized, code)
+	assert.Equal(t, "unauthenticated", errResp.Error.Code)
+
+	// no instance
+	code, errResp, _ = doV2Request(t, teamHandler(getInstanceRequestV2), "GET", "nothing")
+	assert.Equal(t, http.StatusNotFound, code)
+	assert.Equal(t, APIError{Code: "no_instance", Message: "your team doesn't have an instance", Retryable: false}, errResp.Error)
+	code, errResp, _ = doV2Request(t, teamHandler(extendInstanceRequestV2), "POST", "nothing")
+	assert.Equal(t, http.StatusNotFound, code)
+	assert.Equal(t, "no_instance", errResp.Error.Code)
+
+	// running instance
+	code, _, instResp := doV2Request(t, teamHandler(getInstanceRequestV2), "GET", "running")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "running", instResp.State)
+	assert.Equal(t, "10.0.0.1:1337", instResp.Host)
+	assert.Equal(t, "unknown", instResp.Health)
+	assert.Equal(t, 2, instResp.MaxExtensions)
+
+	code, errResp, _ = doV2Request(t, teamHandler(createInstanceRequestV2), "POST", "running")
+	assert.Equal(t, http.StatusConflict, code)
+	assert.Equal(t, "already_running", errResp.Error.Code)
+
+	code, errResp, _ = doV2Request(t, teamHandler(extendInstanceRequestV2), "POST", "running")
+	assert.Equal(t, http.StatusForbidden, code)
+	assert.Equal(t, "extension_limit", errResp.Error.Code)
+
+	// disabled features
+	code, errResp, _ = doV2Request(t, teamHandler(allowIPRequestV2), "POST", "running")
+	assert.Equal(t, http.StatusNotFound, code)
+	assert.Equal(t, "feature_disabled", errResp.Error.Code)
+}
+
+func TestAPIv2BearerAuth(t *testing.T) {
+	// fake rCTF that knows one auth token
+	userInfoCalls := 0
+	rctf := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userInfoCalls++
+		if r.Header.Get("Authorization") != "Bearer goodtoken" {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"kind":"badToken","message":"The token provided is invalid."}`)
+			return
+		}
+		fmt.Fprint(w, `{"kind":"goodUserData","message":"ok","data":{"name":"g33chpwn","id":"bearer"}}`)
+	}))
+	defer rctf.Close()
+
+	config = &Config{RctfServer: rctf.URL, TokenCacheTTL: 60}
+	store = newSessionStore([]byte("aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"), newMemorySessionBackend(), time.Hour)
+	im = &InstanceManager{
+		Instances:        new(generic_map.MapOf[string, *DeploymentInstance]),
+		DisabledFeatures: map[string]bool{FeatureCrashDetection: true},
+	}
+	defer func() { config, store, im = nil, nil, nil }()
+
+	expTime := time.Now().UTC().Add(time.Hour)
+	im.Instances.Store("bearer", &DeploymentInstance{State: Running, Hostname: "10.0.0.2", Port: 1337, ExpTime: &expTime, mu: &sync.Mutex{}})
+
+	// the token is used instead of the session, and cached
+	for i := 0; i < 3; i++ {
+		code, _, instResp := doV2RequestWithHeader(t, teamHandler(getInstanceRequestV2), "GET", "nothing", "Bearer goodtoken")
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, "10.0.0.2:1337", instResp.Host)
+	}
+	assert.Equal(t, 1, userInfoCalls)
+
+	code, errResp, _ := doV2RequestWithHeader(t, teamHandler(getInstanceRequestV2), "GET", "", "Bearer badtoken")
+	assert.Equal(t, http.StatusUnauthorized, code)
+	assert.Equal(t, "bad_auth_token", errResp.Error.Code)
+
+	code, errResp, _ = doV2RequestWithHeader(t, teamHandler(getInstanceRequestV2), "GET", "", "Basic Z2VlY2g6cHdu")
+	assert.Equal(t, http.StatusUnauthorized, code)
+	assert.Equal(t, "bad_auth_token", errResp.Error.Code)
+
+	// rCTF being down isn't cached
+	rctf.Close()
+	code, errResp, _ = doV2RequestWithHeader(t, teamHandler(getInstanceRequestV2), "GET", "", "Bearer othertoken")
+	assert.Equal(t, http.StatusBadGateway, code)
+	assert.True(t, errResp.Error.Retryable)
+	_, ok := userInfoCache.Load("othertoken")
+	assert.False(t, ok)
+}
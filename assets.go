@@ -0,0 +1,44 @@
+package main
+
+import (
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+)
+
+// web app files built into the binary, so chaldeploy doesn't have to run from the repo root
+//
+//go:embed templates static
+var embeddedAssets embed.FS
+
+// overlayFS serves files from one FS, falling back to another for files that aren't in it
+type overlayFS struct {
+	upper fs.FS
+	lower fs.FS
+}
+
+func (o overlayFS) Open(name string) (fs.File, error) {
+	f, err := o.upper.Open(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return o.lower.Open(name)
+	}
+
+	return f, err
+}
+
+// Get the web app files for $CHALDEPLOY_ASSETS_DIR. Files in the directory replace the built-in ones
+func newAssets(c *Config) (fs.FS, error) {
+	if c.AssetsDir == "" {
+		return embeddedAssets, nil
+	}
+
+	if info, err := os.Stat(c.AssetsDir); err != nil {
+		return nil, fmt.Errorf("couldn't read the assets directory: %v", err)
+	} else if !info.IsDir() {
+		return nil, fmt.Errorf("the assets directory isn't a directory: %s", c.AssetsDir)
+	}
+
+	return overlayFS{upper: os.DirFS(c.AssetsDir), lower: embeddedAssets}, nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"io"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOverrideAssets(t *testing.T) {
+	dir := t.TempDir()
+	assert.Nil(t, os.MkdirAll(filepath.Join(dir, "static"), 0755))
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "static", "style.css"), []byte("body { color: hotpink; }"), 0644))
+
+	a, err := newAssets(&Config{AssetsDir: dir})
+	assert.Nil(t, err)
+
+	// overridden files come from the directory, everything else is built in
+	f, err := a.Open("static/style.css")
+	assert.Nil(t, err)
+	data, _ := io.ReadAll(f)
+	assert.Equal(t, "body { color: hotpink; }", string(data))
+
+	_, err = a.Open("static/main.js")
+	assert.Nil(t, err)
+	_, err = a.Open("templates/index.html")
+	assert.Nil(t, err)
+	_, err = a.Open("static/nope.js")
+	assert.NotNil(t, err)
+
+	_, err = newAssets(&Config{AssetsDir: filepath.Join(dir, "missing")})
+	assert.NotNil(t, err)
+}
+
+func TestIndexPage(t *testing.T) {
+	config = &Config{ChallengeName: "<b>pwn</b>"}
+	defer func() { config, cachedIndex = nil, "" }()
+
+	rec := httptest.NewRecorder()
+	indexPage(rec, httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, 200, rec.Code)
+
+	// the challenge name is escaped, the comment is left alone
+	assert.Contains(t, rec.Body.String(), "Challenge Deployment - &lt;b&gt;pwn&lt;/b&gt;")
+	assert.Contains(t, rec.Body.String(), INDEX_HACKER_COMMENT)
+
+	// static files are served from the binary
+	rec = httptest.NewRecorder()
+	newRouter().ServeHTTP(rec, httptest.NewRequest("GET", "/main.js", nil))
+	assert.Equal(t, 200, rec.Code)
+}
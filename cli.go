@@ -0,0 +1,487 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// InstanceInfo is what `chaldeploy instances` reports about an instance
+type InstanceInfo struct {
+	Namespace  string     `json:"namespace"`
+	Challenge  string     `json:"challenge"`
+	TeamId     string     `json:"teamId"`
+	State      string     `json:"state"` // "running" || "destroying"
+	ExpTime    *time.Time `json:"expTime,omitempty"`
+	Host       string     `json:"host,omitempty"`
+	AllowedIPs []string   `json:"allowedIps,omitempty"`
+
+	// only filled in by inspect
+	Deployments []DeploymentInfo `json:"deployments,omitempty"`
+	Pods        []PodInfo        `json:"pods,omitempty"`
+
+	// only filled in by purge, if the instance couldn't be destroyed
+	Error string `json:"error,omitempty"`
+}
+
+// InstanceChange is what `chaldeploy instances` reports after extending or destroying an instance
+type InstanceChange struct {
+	Namespace string     `json:"namespace"`
+	State     string     `json:"state"` // "running" || "destroying"
+	ExpTime   *time.Time `json:"expTime,omitempty"`
+}
+
+type DeploymentInfo struct {
+	Name     string `json:"name"`
+	Ready    int32  `json:"ready"`
+	Replicas int32  `json:"replicas"`
+}
+
+type PodInfo struct {
+	Name     string `json:"name"`
+	Phase    string `json:"phase"`
+	Restarts int32  `json:"restarts"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+// InstancesCli manages instances directly on the cluster, for organizers
+type InstancesCli struct {
+	clientset kubernetes.Interface
+
+	// output format: "table" || "json"
+	output string
+
+	out io.Writer
+}
+
+// Get the label selector for chaldeploy instances, optionally narrowed down to a challenge and/or team
+func instanceSelector(challenge, teamId string) string {
+	selector := "chaldeploy.captaingee.ch/managed-by=yes"
+	if challenge != "" {
+		selector += ",chaldeploy.captaingee.ch/chal=" + HashString(challenge)
+	}
+	if teamId != "" {
+		selector += ",chaldeploy.captaingee.ch/team-id=" + teamId
+	}
+
+	return selector
+}
+
+// Get the basic info for an instance from its namespace and service
+func (cli *InstancesCli) instanceInfo(ctx context.Context, ns *corev1.Namespace) InstanceInfo {
+	info := InstanceInfo{
+		Namespace: ns.Name,
+		Challenge: ns.Annotations["chaldeploy.captaingee.ch/chal-name"],
+		TeamId:    ns.Labels["chaldeploy.captaingee.ch/team-id"],
+		State:     Running.String(),
+	}
+
+	// older instances only have the hash
+	if info.Challenge == "" {
+		info.Challenge = ns.Labels["chaldeploy.captaingee.ch/chal"]
+	}
+
+	if ns.Status.Phase == corev1.NamespaceTerminating {
+		info.State = Destroying.String()
+	}
+
+	if expTimeInt, err := strconv.Atoi(ns.Labels["chaldeploy.captaingee.ch/expiration-time"]); err == nil {
+		expTime := time.Unix(int64(expTimeInt), 0).UTC()
+		info.ExpTime = &expTime
+	}
+
+	// the LB service is named after the namespace
+	if service, err := cli.clientset.CoreV1().Services(ns.Name).Get(ctx, ns.Name, metav1.GetOptions{}); err == nil {
+		if len(service.Status.LoadBalancer.Ingress) > 0 && len(service.Spec.Ports) > 0 {
+			info.Host = fmt.Sprintf("%s:%d", service.Status.LoadBalancer.Ingress[0].IP, service.Spec.Ports[0].Port)
+		}
+		info.AllowedIPs = service.Spec.LoadBalancerSourceRanges
+	}
+
+	return info
+}
+
+// List the instances, optionally for a challenge and/or team
+func (cli *InstancesCli) List(ctx context.Context, challenge, teamId string) ([]InstanceInfo, error) {
+	namespaces, err := cli.clientset.CoreV1().Namespaces().List(ctx, metav1.ListOptions{LabelSelector: instanceSelector(challenge, teamId)})
+	if err != nil {
+		return nil, fmt.Errorf("couldn't list instance namespaces: %v", err)
+	}
+
+	infos := []InstanceInfo{}
+	for i := range namespaces.Items {
+		infos = append(infos, cli.instanceInfo(ctx, &namespaces.Items[i]))
+	}
+
+	return infos, nil
+}
+
+// Find the namespace for a single instance, either by name or by team (and challenge, if the team has more than one instance)
+func (cli *InstancesCli) find(ctx context.Context, namespace, challenge, teamId string) (*corev1.Namespace, error) {
+	namespacesClient := cli.clientset.CoreV1().Namespaces()
+
+	if namespace != "" {
+		ns, err := namespacesClient.Get(ctx, namespace, metav1.GetOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("couldn't get namespace %s: %v", namespace, err)
+		}
+
+		// don't let a typo delete something chaldeploy doesn't own
+		if ns.Labels["chaldeploy.captaingee.ch/managed-by"] != "yes" {
+			return nil, fmt.Errorf("namespace %s isn't a chaldeploy instance", namespace)
+		}
+
+		return ns, nil
+	}
+
+	if teamId == "" {
+		return nil, errors.New("an instance namespace or -team is needed")
+	}
+
+	namespaces, err := namespacesClient.List(ctx, metav1.ListOptions{LabelSelector: instanceSelector(challenge, teamId)})
+	if err != nil {
+		return nil, fmt.Errorf("couldn't list instance namespaces: %v", err)
+	}
+
+	switch len(namespaces.Items) {
+	case 0:
+		return nil, fmt.Errorf("team %s doesn't have an instance", teamId)
+	case 1:
+		return &namespaces.Items[0], nil
+	default:
+		return nil, fmt.Errorf("team %s has %d instances, use -challenge or the namespace to pick one", teamId, len(namespaces.Items))
+	}
+}
+
+// Get the detailed info for an instance, including its deployments and pods
+func (cli *InstancesCli) Inspect(ctx context.Context, namespace, challenge, teamId string) (*InstanceInfo, error) {
+	ns, err := cli.find(ctx, namespace, challenge, teamId)
+	if err != nil {
+		return nil, err
+	}
+
+	info := cli.instanceInfo(ctx, ns)
+
+	deployments, err := cli.clientset.AppsV1().Deployments(ns.Name).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("couldn't list deployments in %s: %v", ns.Name, err)
+	}
+	for _, d := range deployments.Items {
+		replicas := int32(1)
+		if d.Spec.Replicas != nil {
+			replicas = *d.Spec.Replicas
+		}
+		info.Deployments = append(info.Deployments, DeploymentInfo{Name: d.Name, Ready: d.Status.ReadyReplicas, Replicas: replicas})
+	}
+
+	pods, err := cli.clientset.CoreV1().Pods(ns.Name).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("couldn't list pods in %s: %v", ns.Name, err)
+	}
+	for _, p := range pods.Items {
+		pod := PodInfo{Name: p.Name, Phase: string(p.Status.Phase)}
+		for _, cs := range p.Status.ContainerStatuses {
+			pod.Restarts += cs.RestartCount
+			if cs.State.Waiting != nil && pod.Reason == "" {
+				pod.Reason = cs.State.Waiting.Reason
+			}
+		}
+		info.Pods = append(info.Pods, pod)
+	}
+
+	return &info, nil
+}
+
+// Push back the expiration time of an instance. A running chaldeploy picks up the change the next time the reaper runs
+// Returns the instance's namespace and new expiration time
+func (cli *InstancesCli) Extend(ctx context.Context, namespace, challenge, teamId string, by time.Duration) (string, *time.Time, error) {
+	ns, err := cli.find(ctx, namespace, challenge, teamId)
+	if err != nil {
+		return "", nil, err
+	}
+
+	// extend from now if the instance already expired (or never had an expiration time)
+	expTime := time.Now().UTC()
+	if expTimeInt, err := strconv.Atoi(ns.Labels["chaldeploy.captaingee.ch/expiration-time"]); err == nil {
+		if labelTime := time.Unix(int64(expTimeInt), 0).UTC(); labelTime.After(expTime) {
+			expTime = labelTime
+		}
+	}
+	expTime = expTime.Add(by)
+
+	ns.Labels["chaldeploy.captaingee.ch/expiration-time"] = strconv.Itoa(int(expTime.Unix()))
+	if _, err := cli.clientset.CoreV1().Namespaces().Update(ctx, ns, metav1.UpdateOptions{}); err != nil {
+		return "", nil, fmt.Errorf("couldn't update namespace %s: %v", ns.Name, err)
+	}
+
+	return ns.Name, &expTime, nil
+}
+
+// Delete the namespace for an instance
+func (cli *InstancesCli) destroyNamespace(ctx context.Context, name string) error {
+	deletePolicy := metav1.DeletePropagationForeground
+	err := cli.clientset.CoreV1().Namespaces().Delete(ctx, name, metav1.DeleteOptions{PropagationPolicy: &deletePolicy})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("couldn't delete namespace %s: %v", name, err)
+	}
+
+	return nil
+}
+
+// Destroy an instance. A running chaldeploy picks up the change the next time the reaper runs
+func (cli *InstancesCli) Destroy(ctx context.Context, namespace, challenge, teamId string) (string, error) {
+	ns, err := cli.find(ctx, namespace, challenge, teamId)
+	if err != nil {
+		return "", err
+	}
+
+	return ns.Name, cli.destroyNamespace(ctx, ns.Name)
+}
+
+// Destroy every instance for a challenge, e.g. after an event is over.
+// Returns the instances that were (or would be, if dryRun is set) destroyed. Every instance is tried, if some of them
+// couldn't be destroyed they're still returned with the reason, along with an error for all of them
+func (cli *InstancesCli) Purge(ctx context.Context, challenge string, dryRun bool) ([]InstanceInfo, error) {
+	if challenge == "" {
+		return nil, errors.New("-challenge is needed to purge instances")
+	}
+
+	infos, err := cli.List(ctx, challenge, "")
+	if err != nil {
+		return nil, err
+	}
+
+	if dryRun {
+		return infos, nil
+	}
+
+	failed := []string{}
+	for i := range infos {
+		if err := cli.destroyNamespace(ctx, infos[i].Namespace); err != nil {
+			infos[i].Error = err.Error()
+			failed = append(failed, err.Error())
+		} else {
+			infos[i].State = Destroying.String()
+		}
+	}
+
+	if len(failed) > 0 {
+		return infos, fmt.Errorf("couldn't destroy %d of %d instance(s): %s", len(failed), len(infos), strings.Join(failed, "; "))
+	}
+
+	return infos, nil
+}
+
+// Print instances in the selected output format
+func (cli *InstancesCli) printInstances(infos []InstanceInfo) error {
+	if cli.output == "json" {
+		return json.NewEncoder(cli.out).Encode(infos)
+	}
+
+	tw := tabwriter.NewWriter(cli.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAMESPACE\tCHALLENGE\tTEAM\tSTATE\tEXPIRES\tHOST")
+	for _, info := range infos {
+		expires := "<unknown>"
+		if info.ExpTime != nil {
+			expires = info.ExpTime.Format(time.RFC3339)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", info.Namespace, info.Challenge, info.TeamId, info.State, expires, info.Host)
+	}
+
+	return tw.Flush()
+}
+
+// Print the result of extending or destroying an instance in the selected output format
+func (cli *InstancesCli) printChange(change InstanceChange) error {
+	if cli.output == "json" {
+		return json.NewEncoder(cli.out).Encode(change)
+	}
+
+	if change.ExpTime != nil {
+		_, err := fmt.Fprintf(cli.out, "%s now expires at %s\n", change.Namespace, change.ExpTime.Format(time.RFC3339))
+		return err
+	}
+
+	_, err := fmt.Fprintf(cli.out, "destroying %s\n", change.Namespace)
+	return err
+}
+
+// Print the details of an instance in the selected output format
+func (cli *InstancesCli) printInstance(info *InstanceInfo) error {
+	if cli.output == "json" {
+		return json.NewEncoder(cli.out).Encode(info)
+	}
+
+	if err := cli.printInstances([]InstanceInfo{*info}); err != nil {
+		return err
+	}
+
+	if len(info.AllowedIPs) > 0 {
+		fmt.Fprintf(cli.out, "\nAllowed IPs: %s\n", strings.Join(info.AllowedIPs, ", "))
+	}
+
+	tw := tabwriter.NewWriter(cli.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "\nDEPLOYMENT\tREADY")
+	for _, d := range info.Deployments {
+		fmt.Fprintf(tw, "%s\t%d/%d\n", d.Name, d.Ready, d.Replicas)
+	}
+	fmt.Fprintln(tw, "\nPOD\tPHASE\tRESTARTS\tREASON")
+	for _, p := range info.Pods {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\n", p.Name, p.Phase, p.Restarts, p.Reason)
+	}
+
+	return tw.Flush()
+}
+
+const INSTANCES_USAGE = `usage: chaldeploy instances <command> [flags] [namespace]
+
+commands:
+  list                     list instances, optionally filtered with -challenge and/or -team
+  inspect [namespace]      show an instance's deployments and pods
+  extend [namespace]       push back an instance's expiration time by -by
+  destroy [namespace]      destroy an instance
+  purge -challenge NAME    destroy every instance for a challenge (dry run unless -yes is set)
+
+single instance commands take the instance's namespace, or -team (and -challenge if the team has more than one instance).
+flags can go before or after the namespace.
+the k8s config is loaded the same way as the server, $CHALDEPLOY_K8SCONFIG can be set to use a specific one.
+`
+
+// Parse flags that can come before or after the positional arguments (e.g., `destroy <namespace> -yes`),
+// since the flag package stops at the first positional one. Returns the positional arguments
+func parseInterspersed(fs *flag.FlagSet, args []string) ([]string, error) {
+	positional := []string{}
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+
+		// everything after a "--" is positional
+		rest := fs.Args()
+		if consumed := len(args) - len(rest); consumed > 0 && args[consumed-1] == "--" {
+			return append(positional, rest...), nil
+		}
+
+		if len(rest) == 0 {
+			return positional, nil
+		}
+		positional = append(positional, rest[0])
+		args = rest[1:]
+	}
+}
+
+// `chaldeploy instances <command>`
+// Manage instances directly on the cluster, for organizers
+func runInstancesCli(args []string) {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, INSTANCES_USAGE)
+		os.Exit(2)
+	}
+
+	cmd := args[0]
+	fs := flag.NewFlagSet("instances "+cmd, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprint(os.Stderr, INSTANCES_USAGE+"\nflags:\n")
+		fs.PrintDefaults()
+	}
+	challenge := fs.String("challenge", os.Getenv("CHALDEPLOY_NAME"), "challenge name, defaults to $CHALDEPLOY_NAME")
+	teamId := fs.String("team", "", "rCTF team id")
+	output := fs.String("o", "table", "output format: table or json")
+	by := fs.Duration("by", INSTANCE_RUNTIME, "how much time to add when extending")
+	yes := fs.Bool("yes", false, "actually destroy the instances when purging")
+	positional, _ := parseInterspersed(fs, args[1:])
+
+	if len(positional) > 1 {
+		log.Fatalf("too many arguments, expected at most one namespace: %s", strings.Join(positional, " "))
+	}
+
+	if *output != "table" && *output != "json" {
+		log.Fatalf("invalid output format: %s", *output)
+	}
+
+	// only the k8s config is needed, not the rest of the server config
+	config = &Config{K8sConfigPath: os.Getenv("CHALDEPLOY_K8SCONFIG")}
+	k8sConfig, err := getConfigForCluster()
+	if err != nil {
+		log.Fatalf("couldn't load the k8s config: %v", err)
+	}
+	clientset, err := kubernetes.NewForConfig(k8sConfig)
+	if err != nil {
+		log.Fatalf("couldn't create the k8s client: %v", err)
+	}
+
+	cli := &InstancesCli{clientset: clientset, output: *output, out: os.Stdout}
+	ctx := context.Background()
+	namespace := ""
+	if len(positional) > 0 {
+		namespace = positional[0]
+	}
+
+	switch cmd {
+	case "list":
+		infos, err := cli.List(ctx, *challenge, *teamId)
+		if err == nil {
+			err = cli.printInstances(infos)
+		}
+		if err != nil {
+			log.Fatalln(err)
+		}
+	case "inspect":
+		info, err := cli.Inspect(ctx, namespace, *challenge, *teamId)
+		if err == nil {
+			err = cli.printInstance(info)
+		}
+		if err != nil {
+			log.Fatalln(err)
+		}
+	case "extend":
+		name, expTime, err := cli.Extend(ctx, namespace, *challenge, *teamId, *by)
+		if err == nil {
+			err = cli.printChange(InstanceChange{Namespace: name, State: Running.String(), ExpTime: expTime})
+		}
+		if err != nil {
+			log.Fatalln(err)
+		}
+	case "destroy":
+		name, err := cli.Destroy(ctx, namespace, *challenge, *teamId)
+		if err == nil {
+			err = cli.printChange(InstanceChange{Namespace: name, State: Destroying.String()})
+		}
+		if err != nil {
+			log.Fatalln(err)
+		}
+	case "purge":
+		// print what happened to every instance, even if some of them couldn't be destroyed
+		infos, err := cli.Purge(ctx, *challenge, !*yes)
+		if infos != nil {
+			if err := cli.printInstances(infos); err != nil {
+				log.Fatalln(err)
+			}
+		}
+		if err != nil {
+			log.Fatalln(err)
+		}
+		if !*yes {
+			log.Printf("dry run, rerun with -yes to destroy these %d instance(s)", len(infos))
+		} else {
+			log.Printf("destroying %d instance(s)", len(infos))
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command: %s\n\n%s", cmd, INSTANCES_USAGE)
+		os.Exit(2)
+	}
+}
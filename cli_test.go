@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"io"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func testInstanceNamespace(name, challenge, teamId string, expTime time.Time) *corev1.Namespace {
+	return &corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: name,
+			Labels: map[string]string{
+				"chaldeploy.captaingee.ch/managed-by":      "yes",
+				"chaldeploy.captaingee.ch/chal":            HashString(challenge),
+				"chaldeploy.captaingee.ch/team-id":         teamId,
+				"chaldeploy.captaingee.ch/expiration-time": strconv.Itoa(int(expTime.Unix())),
+			},
+			Annotations: map[string]string{"chaldeploy.captaingee.ch/chal-name": challenge},
+		},
+	}
+}
+
+func TestInstancesCli(t *testing.T) {
+	expTime := time.Now().UTC().Add(time.Hour).Truncate(time.Second)
+	clientset := fake.NewSimpleClientset(
+		testInstanceNamespace("chaldeploy-a-team1", "pwn1", "team1", expTime),
+		testInstanceNamespace("chaldeploy-a-team2", "pwn1", "team2", expTime),
+		testInstanceNamespace("chaldeploy-b-team1", "web1", "team1", expTime),
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "kube-system"}},
+		&corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "chaldeploy-a-team1", Namespace: "chaldeploy-a-team1"},
+			Spec:       corev1.ServiceSpec{Ports: []corev1.ServicePort{{Port: 1337}}, LoadBalancerSourceRanges: []string{"1.2.3.4/32"}},
+			Status:     corev1.ServiceStatus{LoadBalancer: corev1.LoadBalancerStatus{Ingress: []corev1.LoadBalancerIngress{{IP: "10.0.0.1"}}}},
+		},
+	)
+	out := &bytes.Buffer{}
+	cli := &InstancesCli{clientset: clientset, output: "json", out: out}
+	ctx := context.Background()
+
+	// list filters by challenge and team
+	infos, err := cli.List(ctx, "", "")
+	assert.Nil(t, err)
+	assert.Len(t, infos, 3)
+	infos, err = cli.List(ctx, "pwn1", "")
+	assert.Nil(t, err)
+	assert.Len(t, infos, 2)
+	infos, err = cli.List(ctx, "", "team1")
+	assert.Nil(t, err)
+	assert.Len(t, infos, 2)
+
+	// single instance commands need to resolve to exactly one instance
+	_, err = cli.Inspect(ctx, "", "", "team1")
+	assert.ErrorContains(t, err, "has 2 instances")
+	_, err = cli.Inspect(ctx, "kube-system", "", "")
+	assert.ErrorContains(t, err, "isn't a chaldeploy instance")
+
+	info, err := cli.Inspect(ctx, "", "pwn1", "team1")
+	assert.Nil(t, err)
+	assert.Equal(t, "chaldeploy-a-team1", info.Namespace)
+	assert.Equal(t, "pwn1", info.Challenge)
+	assert.Equal(t, "10.0.0.1:1337", info.Host)
+	assert.Equal(t, []string{"1.2.3.4/32"}, info.AllowedIPs)
+	assert.Equal(t, expTime, *info.ExpTime)
+
+	assert.Nil(t, cli.printInstance(info))
+	decoded := InstanceInfo{}
+	assert.Nil(t, json.Unmarshal(out.Bytes(), &decoded))
+	assert.Equal(t, "team1", decoded.TeamId)
+
+	// extend updates the label
+	name, newExp, err := cli.Extend(ctx, "chaldeploy-a-team2", "", "", time.Hour)
+	assert.Nil(t, err)
+	assert.Equal(t, "chaldeploy-a-team2", name)
+	assert.Equal(t, expTime.Add(time.Hour), *newExp)
+	ns, _ := clientset.CoreV1().Namespaces().Get(ctx, "chaldeploy-a-team2", metav1.GetOptions{})
+	assert.Equal(t, strconv.Itoa(int(newExp.Unix())), ns.Labels["chaldeploy.captaingee.ch/expiration-time"])
+
+	out.Reset()
+	assert.Nil(t, cli.printChange(InstanceChange{Namespace: name, State: Running.String(), ExpTime: newExp}))
+	change := InstanceChange{}
+	assert.Nil(t, json.Unmarshal(out.Bytes(), &change))
+	assert.Equal(t, "chaldeploy-a-team2", change.Namespace)
+
+	// purge is a dry run unless told otherwise
+	_, err = cli.Purge(ctx, "", false)
+	assert.Error(t, err)
+	infos, err = cli.Purge(ctx, "pwn1", true)
+	assert.Nil(t, err)
+	assert.Len(t, infos, 2)
+	infos, _ = cli.List(ctx, "", "")
+	assert.Len(t, infos, 3)
+
+	// a namespace that can't be deleted doesn't stop the rest
+	clientset.PrependReactor("delete", "namespaces", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.(k8stesting.DeleteAction).GetName() == "chaldeploy-a-team1" {
+			return true, nil, errors.New("forbidden")
+		}
+		return false, nil, nil
+	})
+	infos, err = cli.Purge(ctx, "pwn1", false)
+	assert.ErrorContains(t, err, "couldn't destroy 1 of 2 instance(s)")
+	assert.Len(t, infos, 2)
+	for _, info := range infos {
+		if info.Namespace == "chaldeploy-a-team1" {
+			assert.Contains(t, info.Error, "forbidden")
+		} else {
+			assert.Equal(t, "destroying", info.State)
+		}
+	}
+	infos, _ = cli.List(ctx, "", "")
+	assert.Len(t, infos, 2)
+}
+
+func TestParseInterspersed(t *testing.T) {
+	parse := func(args ...string) ([]string, bool, string) {
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		fs.SetOutput(io.Discard)
+		yes := fs.Bool("yes", false, "")
+		team := fs.String("team", "", "")
+
+		positional, err := parseInterspersed(fs, args)
+		assert.Nil(t, err)
+		return positional, *yes, *team
+	}
+
+	// flags work on either side of the namespace
+	positional, yes, team := parse("chaldeploy-a-team1", "-yes", "-team", "team1")
+	assert.Equal(t, []string{"chaldeploy-a-team1"}, positional)
+	assert.True(t, yes)
+	assert.Equal(t, "team1", team)
+
+	positional, yes, _ = parse("-yes", "ns1", "ns2")
+	assert.Equal(t, []string{"ns1", "ns2"}, positional)
+	assert.True(t, yes)
+
+	positional, yes, _ = parse("--", "-yes")
+	assert.Equal(t, []string{"-yes"}, positional)
+	assert.False(t, yes)
+
+	positional, _, _ = parse()
+	assert.Empty(t, positional)
+}
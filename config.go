@@ -1,34 +1,193 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"net"
 	"os"
 	"reflect"
 	"strconv"
 	"strings"
+
+	"k8s.io/apimachinery/pkg/api/resource"
 )
 
+// Config is loaded from env vars, each field's `env` tag has the var name followed by modifiers:
+//   - optional: the var doesn't have to be set
+//   - default=<value>: value to use if the var isn't set
+//   - secret: the value is sensitive, it's put in a Secret when generating the install manifests
 type Config struct {
-	// $CHALDEPLOY_NAME: Name of the challenge to deploy
-	ChallengeName string `env:"CHALDEPLOY_NAME"`
+	// $CHALDEPLOY_NAME: Name of the challenge to deploy. Can be omitted if set by $CHALDEPLOY_RCDS_CHALLENGE
+	ChallengeName string `env:"CHALDEPLOY_NAME,optional"`
 
-	// $CHALDEPLOY_PORT: Port exposed by the challenge, must be 1-65535
-	ChallengePort int `env:"CHALDEPLOY_PORT"`
+	// $CHALDEPLOY_PORT: Port exposed by the challenge, must be 1-65535. Can be omitted if set by $CHALDEPLOY_RCDS_CHALLENGE
+	ChallengePort int `env:"CHALDEPLOY_PORT,optional"`
 
-	// $CHALDEPLOY_IMAGE: Image path for the challenge
-	ChallengeImage string `env:"CHALDEPLOY_IMAGE"`
+	// $CHALDEPLOY_IMAGE: Image path for the challenge. Can be omitted if using $CHALDEPLOY_MANIFEST_DIR or $CHALDEPLOY_RCDS_CHALLENGE
+	ChallengeImage string `env:"CHALDEPLOY_IMAGE,optional"`
 
 	// $CHALDEPLOY_SESSION_KEY: Secret key used to authenticate session data. Must be 32 or 64 chars long
-	SessionKey string `env:"CHALDEPLOY_SESSION_KEY"`
+	SessionKey string `env:"CHALDEPLOY_SESSION_KEY,secret"`
+
+	// $CHALDEPLOY_SESSION_STORE (optional): Where session data is kept on the server: memory, or file:<dir>. Defaults to memory
+	SessionStore string `env:"CHALDEPLOY_SESSION_STORE,optional,default=memory"`
+
+	// $CHALDEPLOY_SESSION_TTL (optional): Seconds a session lasts after logging in. Using the session doesn't extend it. Defaults to 86400
+	SessionTTL int `env:"CHALDEPLOY_SESSION_TTL,optional,default=86400"`
+
+	// $CHALDEPLOY_COOKIE_SECURE (optional): Only send the session cookie over HTTPS. Should be set when chaldeploy is served over TLS
+	CookieSecure bool `env:"CHALDEPLOY_COOKIE_SECURE,optional"`
+
+	// $CHALDEPLOY_COOKIE_HTTPONLY (optional): Don't let scripts read the session cookie. Defaults to true
+	CookieHttpOnly bool `env:"CHALDEPLOY_COOKIE_HTTPONLY,optional,default=true"`
+
+	// $CHALDEPLOY_ADMIN_TOKEN (optional): Bearer token for the admin API under /admin. The admin API is disabled if it isn't set
+	AdminToken string `env:"CHALDEPLOY_ADMIN_TOKEN,optional,secret"`
+
+	// $CHALDEPLOY_LISTEN_ADDR (optional): Address the web app listens on. Defaults to :5050
+	ListenAddr string `env:"CHALDEPLOY_LISTEN_ADDR,optional,default=:5050"`
+
+	// $CHALDEPLOY_ADMIN_LISTEN_ADDR (optional): Address for a separate listener with the admin API and health checks. If set, the admin API isn't served on $CHALDEPLOY_LISTEN_ADDR
+	AdminListenAddr string `env:"CHALDEPLOY_ADMIN_LISTEN_ADDR,optional"`
+
+	// $CHALDEPLOY_TLS_CERT (optional): Path to a PEM TLS cert to serve HTTPS with, reloaded when it changes. Requires $CHALDEPLOY_TLS_KEY
+	TLSCert string `env:"CHALDEPLOY_TLS_CERT,optional"`
+
+	// $CHALDEPLOY_TLS_KEY (optional): Path to the PEM private key for $CHALDEPLOY_TLS_CERT
+	TLSKey string `env:"CHALDEPLOY_TLS_KEY,optional"`
+
+	// $CHALDEPLOY_TLS_SELF_SIGNED (optional): Serve HTTPS with a self-signed cert for localhost generated on startup, for development
+	TLSSelfSigned bool `env:"CHALDEPLOY_TLS_SELF_SIGNED,optional"`
+
+	// $CHALDEPLOY_ASSETS_DIR (optional): Directory of templates/ and static/ files that replace the built-in ones (e.g., for event branding)
+	AssetsDir string `env:"CHALDEPLOY_ASSETS_DIR,optional"`
 
 	// $CHALDEPLOY_RCTF_SERVER: rCTF server to auth against
 	RctfServer string `env:"CHALDEPLOY_RCTF_SERVER"`
 
 	// $CHALDEPLOY_K8SCONFIG (optional): Path to the k8s config. If not set, k8s config will be loaded from /var/run/secrets or ~/.kube
 	K8sConfigPath string `env:"CHALDEPLOY_K8SCONFIG,optional"`
+
+	// $CHALDEPLOY_MANIFEST_DIR (optional): Directory of YAML manifest templates to deploy for each team instead of the default Deployment/Service
+	ManifestDir string `env:"CHALDEPLOY_MANIFEST_DIR,optional"`
+
+	// $CHALDEPLOY_FLAG (optional): Flag for the challenge, available to manifest templates as {{ .Flag }}
+	Flag string `env:"CHALDEPLOY_FLAG,optional,secret"`
+
+	// $CHALDEPLOY_RCDS_CHALLENGE (optional): Path to an rCDS challenge.yaml to deploy for each team. Fills in any challenge settings that aren't set
+	RcdsChallengePath string `env:"CHALDEPLOY_RCDS_CHALLENGE,optional"`
+
+	// $CHALDEPLOY_EGRESS (optional): Outbound traffic allowed from a team's instance: none, dns, or internet. Defaults to none
+	Egress string `env:"CHALDEPLOY_EGRESS,optional,default=none"`
+
+	// $CHALDEPLOY_QUOTA_PODS (optional): Max number of pods in a team's namespace. Defaults to 10
+	QuotaPods int `env:"CHALDEPLOY_QUOTA_PODS,optional,default=10"`
+
+	// $CHALDEPLOY_QUOTA_CPU (optional): Max total CPU limit for a team's namespace. Defaults to 2
+	QuotaCpu string `env:"CHALDEPLOY_QUOTA_CPU,optional,default=2"`
+
+	// $CHALDEPLOY_QUOTA_MEMORY (optional): Max total memory limit for a team's namespace. Defaults to 2Gi
+	QuotaMemory string `env:"CHALDEPLOY_QUOTA_MEMORY,optional,default=2Gi"`
+
+	// $CHALDEPLOY_QUOTA_SERVICES (optional): Max number of services in a team's namespace. Defaults to 5
+	QuotaServices int `env:"CHALDEPLOY_QUOTA_SERVICES,optional,default=5"`
+
+	// $CHALDEPLOY_QUOTA_PVCS (optional): Max number of persistent volume claims in a team's namespace. Defaults to 0
+	QuotaPvcs int `env:"CHALDEPLOY_QUOTA_PVCS,optional,default=0"`
+
+	// $CHALDEPLOY_CONTAINER_CPU (optional): CPU limit for containers that don't set one. Defaults to 500m
+	ContainerCpu string `env:"CHALDEPLOY_CONTAINER_CPU,optional,default=500m"`
+
+	// $CHALDEPLOY_CONTAINER_MEMORY (optional): Memory limit for containers that don't set one. Defaults to 256Mi
+	ContainerMemory string `env:"CHALDEPLOY_CONTAINER_MEMORY,optional,default=256Mi"`
+
+	// $CHALDEPLOY_ALLOW_ROOT (optional): Allow challenge containers to run as root
+	AllowRoot bool `env:"CHALDEPLOY_ALLOW_ROOT,optional"`
+
+	// $CHALDEPLOY_RUN_AS_USER (optional): UID to run challenge containers as. If not set, the image's user is used
+	RunAsUser int `env:"CHALDEPLOY_RUN_AS_USER,optional"`
+
+	// $CHALDEPLOY_WRITABLE_ROOTFS (optional): Allow challenge containers to write to their root filesystem
+	WritableRootfs bool `env:"CHALDEPLOY_WRITABLE_ROOTFS,optional"`
+
+	// $CHALDEPLOY_ALLOW_PRIVILEGE_ESCALATION (optional): Allow processes in challenge containers to gain privileges (e.g., setuid binaries)
+	AllowPrivilegeEscalation bool `env:"CHALDEPLOY_ALLOW_PRIVILEGE_ESCALATION,optional"`
+
+	// $CHALDEPLOY_CAPABILITIES (optional): Comma separated list of capabilities to add back to challenge containers after dropping ALL
+	Capabilities string `env:"CHALDEPLOY_CAPABILITIES,optional"`
+
+	// $CHALDEPLOY_SECCOMP_PROFILE (optional): Seccomp profile for challenge pods: RuntimeDefault, Unconfined, or Localhost/<path>. Defaults to RuntimeDefault
+	SeccompProfile string `env:"CHALDEPLOY_SECCOMP_PROFILE,optional,default=RuntimeDefault"`
+
+	// $CHALDEPLOY_RUNTIME_CLASS (optional): RuntimeClass for challenge pods (e.g., gvisor)
+	RuntimeClass string `env:"CHALDEPLOY_RUNTIME_CLASS,optional"`
+
+	// $CHALDEPLOY_POD_SECURITY (optional): Pod Security Admission level enforced on team namespaces: privileged, baseline, or restricted. Defaults to restricted
+	PodSecurity string `env:"CHALDEPLOY_POD_SECURITY,optional,default=restricted"`
+
+	// $CHALDEPLOY_PROBE (optional): Readiness/liveness probe for the challenge container: tcp, http:<path>, exec:<command>, or none. Defaults to tcp
+	Probe string `env:"CHALDEPLOY_PROBE,optional,default=tcp"`
+
+	// $CHALDEPLOY_MAX_EXTENSIONS (optional): Max number of times a team can extend their instance, 0 for no limit. Defaults to 0
+	MaxExtensions int `env:"CHALDEPLOY_MAX_EXTENSIONS,optional"`
+
+	// $CHALDEPLOY_RESTART_COOLDOWN (optional): Seconds a team has to wait between restarts of their instance. Defaults to 300
+	RestartCooldown int `env:"CHALDEPLOY_RESTART_COOLDOWN,optional,default=300"`
+
+	// $CHALDEPLOY_ACCESS_CONTROL (optional): How connections to an instance are restricted: none, or token. Defaults to none
+	AccessControl string `env:"CHALDEPLOY_ACCESS_CONTROL,optional,default=none"`
+
+	// $CHALDEPLOY_GATEWAY_IMAGE (optional): Image path for chaldeploy, used to run the access token gateway. Required if $CHALDEPLOY_ACCESS_CONTROL=token
+	GatewayImage string `env:"CHALDEPLOY_GATEWAY_IMAGE,optional"`
+
+	// $CHALDEPLOY_GATEWAY_PORT (optional): Port the access token gateway listens on in the pod. Defaults to 31336
+	GatewayPort int `env:"CHALDEPLOY_GATEWAY_PORT,optional,default=31336"`
+
+	// $CHALDEPLOY_SOURCE_ALLOWLIST (optional): Only allow connections to an instance from the IPs the team allowed, starting with the IP that created it
+	SourceAllowlist bool `env:"CHALDEPLOY_SOURCE_ALLOWLIST,optional"`
+
+	// $CHALDEPLOY_MAX_ALLOWED_IPS (optional): Max number of IPs a team can allow to connect to their instance. Defaults to 16
+	MaxAllowedIps int `env:"CHALDEPLOY_MAX_ALLOWED_IPS,optional,default=16"`
+
+	// $CHALDEPLOY_TRUSTED_PROXIES (optional): Comma separated list of CIDRs for reverse proxies whose X-Forwarded-For header is trusted
+	TrustedProxies string `env:"CHALDEPLOY_TRUSTED_PROXIES,optional"`
+
+	// $CHALDEPLOY_TOKEN_CACHE_TTL (optional): Seconds to cache the team for an rCTF auth token sent as a bearer token. Defaults to 60
+	TokenCacheTTL int `env:"CHALDEPLOY_TOKEN_CACHE_TTL,optional,default=60"`
+
+	// $CHALDEPLOY_REVALIDATE_INTERVAL (optional): Seconds between checks that rCTF still accepts a logged in team, 0 to never check. Defaults to 300
+	RevalidateInterval int `env:"CHALDEPLOY_REVALIDATE_INTERVAL,optional,default=300"`
+
+	// $CHALDEPLOY_DESTROY_INVALID_TEAMS (optional): Destroy the instance of a team when rCTF no longer accepts it (e.g., it was banned)
+	DestroyInvalidTeams bool `env:"CHALDEPLOY_DESTROY_INVALID_TEAMS,optional"`
+
+	// $CHALDEPLOY_RATE_LIMIT_IP (optional): Max requests to /api per IP, as <count>/<period> or none. Defaults to 120/1m
+	RateLimitIP string `env:"CHALDEPLOY_RATE_LIMIT_IP,optional,default=120/1m"`
+
+	// $CHALDEPLOY_RATE_LIMIT_AUTH (optional): Max logins per IP, as <count>/<period> or none. Defaults to 10/1m
+	RateLimitAuth string `env:"CHALDEPLOY_RATE_LIMIT_AUTH,optional,default=10/1m"`
+
+	// $CHALDEPLOY_RATE_LIMIT_CREATE (optional): Max instance creations per team, as <count>/<period> or none. Defaults to 5/1h
+	RateLimitCreate string `env:"CHALDEPLOY_RATE_LIMIT_CREATE,optional,default=5/1h"`
+
+	// $CHALDEPLOY_RATE_LIMIT_MANAGE (optional): Max extends, restarts, allowed IPs, and destroys per team, as <count>/<period> or none. Defaults to 20/1m
+	RateLimitManage string `env:"CHALDEPLOY_RATE_LIMIT_MANAGE,optional,default=20/1m"`
+
+	// $CHALDEPLOY_RECREATE_COOLDOWN (optional): Seconds a team has to wait after destroying their instance before creating another. Defaults to 60
+	RecreateCooldown int `env:"CHALDEPLOY_RECREATE_COOLDOWN,optional,default=60"`
+
+	// $CHALDEPLOY_DRAIN_TIMEOUT (optional): Seconds to wait for in-flight operations to finish on shutdown. Defaults to 60
+	DrainTimeout int `env:"CHALDEPLOY_DRAIN_TIMEOUT,optional,default=60"`
+
+	// $CHALDEPLOY_REAPER_INTERVAL (optional): Seconds between checks for expired instances. Defaults to 60
+	ReaperInterval int `env:"CHALDEPLOY_REAPER_INTERVAL,optional,default=60"`
+
+	// $CHALDEPLOY_REAPER_WORKERS (optional): Max number of expired instances to destroy at once. Defaults to 4
+	ReaperWorkers int `env:"CHALDEPLOY_REAPER_WORKERS,optional,default=4"`
 }
 
-// Load the config from env vars. Supports int and string types, along with an 'optional' modifier
+// Load the config from env vars. Supports int, bool, and string types, along with 'optional' and 'default=<value>' modifiers.
+// Optional values that aren't set are left as the zero value, unless a default is specified
 // ref:
 //   - https://linuxhint.com/golang-struct-tags/
 //   - https://stackoverflow.com/a/6396678
@@ -51,17 +210,34 @@ func loadConfig() (*Config, error) {
 
 		// get the env data
 		data := os.Getenv(tagParts[0])
+		if data == "" {
+			for _, p := range tagParts[1:] {
+				if strings.HasPrefix(p, "default=") {
+					data = strings.TrimPrefix(p, "default=")
+				}
+			}
+		}
 
 		// make sure it's set if not optional
 		if data != "" || Contains(tagParts[1:], "optional") {
 			// set the value
-			if f.Type.Kind() == reflect.Int {
+			if data == "" {
+				// optional and not set, leave the zero value
+				continue
+			} else if f.Type.Kind() == reflect.Int {
 				// need to save as an int
 				if intVal, err := strconv.Atoi(data); err != nil {
 					return nil, fmt.Errorf("couldn't convert value to integer: %s", data)
 				} else {
 					reflect.ValueOf(&config).Elem().Field(i).Set(reflect.ValueOf(intVal))
 				}
+			} else if f.Type.Kind() == reflect.Bool {
+				// need to save as a bool
+				if boolVal, err := strconv.ParseBool(data); err != nil {
+					return nil, fmt.Errorf("couldn't convert value to bool: %s", data)
+				} else {
+					reflect.ValueOf(&config).Elem().Field(i).Set(reflect.ValueOf(boolVal))
+				}
 			} else {
 				// can save as a string
 				reflect.ValueOf(&config).Elem().Field(i).Set(reflect.ValueOf(data))
@@ -72,5 +248,179 @@ func loadConfig() (*Config, error) {
 		}
 	}
 
+	// fill in the challenge settings from rCDS
+	if config.RcdsChallengePath != "" {
+		rc, err := loadRcdsChallenge(config.RcdsChallengePath)
+		if err != nil {
+			return nil, err
+		}
+
+		rc.applyToConfig(&config)
+	}
+
+	// make sure the challenge is fully defined
+	if config.ChallengeName == "" {
+		return nil, errors.New("the challenge name must be set with $CHALDEPLOY_NAME or $CHALDEPLOY_RCDS_CHALLENGE")
+	}
+	if config.ChallengePort < 1 || config.ChallengePort > 65535 {
+		return nil, fmt.Errorf("the challenge port must be set to 1-65535 with $CHALDEPLOY_PORT or $CHALDEPLOY_RCDS_CHALLENGE (got %d)", config.ChallengePort)
+	}
+	if config.ChallengeImage == "" && config.ManifestDir == "" && config.RcdsChallengePath == "" {
+		return nil, errors.New("the challenge image must be set with $CHALDEPLOY_IMAGE, or the challenge defined with $CHALDEPLOY_MANIFEST_DIR or $CHALDEPLOY_RCDS_CHALLENGE")
+	}
+	if config.ManifestDir != "" && config.RcdsChallengePath != "" {
+		return nil, errors.New("only one of $CHALDEPLOY_MANIFEST_DIR and $CHALDEPLOY_RCDS_CHALLENGE can be set")
+	}
+
+	if !Contains([]string{"none", "dns", "internet"}, config.Egress) {
+		return nil, fmt.Errorf("invalid egress policy, must be none, dns, or internet: %s", config.Egress)
+	}
+
+	for _, q := range []string{config.QuotaCpu, config.QuotaMemory, config.ContainerCpu, config.ContainerMemory} {
+		if _, err := resource.ParseQuantity(q); err != nil {
+			return nil, fmt.Errorf("invalid resource quantity %s: %v", q, err)
+		}
+	}
+
+	if err := config.validatePodSecurity(); err != nil {
+		return nil, err
+	}
+
+	if config.Probe != "tcp" && config.Probe != "none" && !strings.HasPrefix(config.Probe, "http:/") && !strings.HasPrefix(config.Probe, "exec:") {
+		return nil, fmt.Errorf("invalid probe, must be tcp, http:<path>, exec:<command>, or none: %s", config.Probe)
+	}
+
+	if !Contains([]string{"none", "token"}, config.AccessControl) {
+		return nil, fmt.Errorf("invalid access control, must be none or token: %s", config.AccessControl)
+	}
+	if config.AccessControl == "token" && config.ManifestDir == "" && config.GatewayImage == "" {
+		return nil, errors.New("$CHALDEPLOY_GATEWAY_IMAGE must be set to use token access control")
+	}
+
+	if config.SessionTTL < 1 {
+		return nil, fmt.Errorf("the session TTL must be at least 1 second (got %d)", config.SessionTTL)
+	}
+
+	if err := config.validateListeners(); err != nil {
+		return nil, err
+	}
+
+	if _, err := newRateLimits(&config); err != nil {
+		return nil, err
+	}
+
+	if _, err := config.getTrustedProxies(); err != nil {
+		return nil, err
+	}
+
 	return &config, nil
 }
+
+// Make sure the listen addresses and TLS settings make sense
+func (c *Config) validateListeners() error {
+	for _, addr := range []string{c.ListenAddr, c.AdminListenAddr} {
+		if addr == "" {
+			continue
+		}
+
+		if _, err := listenPort(addr); err != nil {
+			return err
+		}
+	}
+
+	if c.AdminListenAddr == c.ListenAddr {
+		return errors.New("$CHALDEPLOY_ADMIN_LISTEN_ADDR must be different from $CHALDEPLOY_LISTEN_ADDR")
+	}
+
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		return errors.New("$CHALDEPLOY_TLS_CERT and $CHALDEPLOY_TLS_KEY must be set together")
+	}
+
+	if c.TLSCert != "" && c.TLSSelfSigned {
+		return errors.New("only one of $CHALDEPLOY_TLS_CERT and $CHALDEPLOY_TLS_SELF_SIGNED can be set")
+	}
+
+	return nil
+}
+
+// Check if chaldeploy serves HTTPS
+func (c *Config) tlsEnabled() bool {
+	return c.TLSCert != "" || c.TLSSelfSigned
+}
+
+// capabilities that can be added under the baseline Pod Security Standard
+// ref: https://kubernetes.io/docs/concepts/security/pod-security-standards/#baseline
+var baselineCapabilities = []string{"AUDIT_WRITE", "CHOWN", "DAC_OVERRIDE", "FOWNER", "FSETID", "KILL", "MKNOD", "NET_BIND_SERVICE", "SETFCAP", "SETGID", "SETPCAP", "SETUID", "SYS_CHROOT"}
+
+// Get the capabilities to add back to challenge containers
+func (c *Config) getCapabilities() []string {
+	caps := []string{}
+	for _, cap := range strings.Split(c.Capabilities, ",") {
+		if cap = strings.ToUpper(strings.TrimSpace(cap)); cap != "" {
+			caps = append(caps, strings.TrimPrefix(cap, "CAP_"))
+		}
+	}
+
+	return caps
+}
+
+// Make sure the pod security opt-outs are allowed by the Pod Security Admission level,
+// otherwise every pod would get rejected when the team tries to deploy
+func (c *Config) validatePodSecurity() error {
+	if !Contains([]string{"privileged", "baseline", "restricted"}, c.PodSecurity) {
+		return fmt.Errorf("invalid pod security level, must be privileged, baseline, or restricted: %s", c.PodSecurity)
+	}
+
+	if c.SeccompProfile != "RuntimeDefault" && c.SeccompProfile != "Unconfined" && !strings.HasPrefix(c.SeccompProfile, "Localhost/") {
+		return fmt.Errorf("invalid seccomp profile, must be RuntimeDefault, Unconfined, or Localhost/<path>: %s", c.SeccompProfile)
+	}
+
+	if c.PodSecurity == "privileged" {
+		return nil
+	}
+
+	if c.SeccompProfile == "Unconfined" {
+		return fmt.Errorf("an Unconfined seccomp profile isn't allowed by the %s pod security level, set $CHALDEPLOY_POD_SECURITY=privileged", c.PodSecurity)
+	}
+
+	for _, cap := range c.getCapabilities() {
+		if !Contains(baselineCapabilities, cap) {
+			return fmt.Errorf("capability %s isn't allowed by the %s pod security level, set $CHALDEPLOY_POD_SECURITY=privileged", cap, c.PodSecurity)
+		}
+
+		if c.PodSecurity == "restricted" && cap != "NET_BIND_SERVICE" {
+			return fmt.Errorf("capability %s isn't allowed by the restricted pod security level, set $CHALDEPLOY_POD_SECURITY=baseline", cap)
+		}
+	}
+
+	if c.PodSecurity == "restricted" {
+		if c.AllowRoot {
+			return errors.New("running as root isn't allowed by the restricted pod security level, set $CHALDEPLOY_POD_SECURITY=baseline")
+		}
+
+		if c.AllowPrivilegeEscalation {
+			return errors.New("privilege escalation isn't allowed by the restricted pod security level, set $CHALDEPLOY_POD_SECURITY=baseline")
+		}
+	}
+
+	return nil
+}
+
+// Get the CIDRs of the reverse proxies whose X-Forwarded-For header is trusted
+func (c *Config) getTrustedProxies() ([]*net.IPNet, error) {
+	proxies := []*net.IPNet{}
+	for _, cidr := range strings.Split(c.TrustedProxies, ",") {
+		if cidr = strings.TrimSpace(cidr); cidr == "" {
+			continue
+		}
+
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy CIDR %s: %v", cidr, err)
+		}
+
+		proxies = append(proxies, ipNet)
+	}
+
+	return proxies, nil
+}
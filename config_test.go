@@ -43,6 +43,23 @@ func TestPartialConfig(t *testing.T) {
 	assert.Equal(t, "https://2021.redpwn.net", config.RctfServer)
 	assert.Equal(t, "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa", config.SessionKey)
 	assert.Equal(t, "", config.K8sConfigPath)
+	assert.Equal(t, "none", config.Egress)
+	assert.Equal(t, 10, config.QuotaPods)
+	assert.Equal(t, "2Gi", config.QuotaMemory)
+	assert.Equal(t, 0, config.QuotaPvcs)
+}
+
+func TestInvalidQuotaConfig(t *testing.T) {
+	t.Setenv("CHALDEPLOY_NAME", "test chal name")
+	t.Setenv("CHALDEPLOY_PORT", "12345")
+	t.Setenv("CHALDEPLOY_IMAGE", "testimg:latest")
+	t.Setenv("CHALDEPLOY_RCTF_SERVER", "https://2021.redpwn.net")
+	t.Setenv("CHALDEPLOY_SESSION_KEY", "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa")
+	t.Setenv("CHALDEPLOY_QUOTA_MEMORY", "lots")
+
+	config, err := loadConfig()
+	assert.NotNil(t, err)
+	assert.Nil(t, config)
 }
 
 func TestInvalidConfig(t *testing.T) {
@@ -66,3 +83,50 @@ func TestInvalidPortConfig(t *testing.T) {
 	assert.NotNil(t, err)
 	assert.Nil(t, config)
 }
+
+func TestPodSecurityConfig(t *testing.T) {
+	c := &Config{SeccompProfile: "RuntimeDefault", PodSecurity: "restricted"}
+	assert.Nil(t, c.validatePodSecurity())
+
+	c.AllowRoot = true
+	assert.NotNil(t, c.validatePodSecurity())
+
+	c.PodSecurity = "baseline"
+	assert.Nil(t, c.validatePodSecurity())
+
+	c.Capabilities = "SYS_PTRACE"
+	assert.NotNil(t, c.validatePodSecurity())
+
+	c.PodSecurity = "privileged"
+	c.SeccompProfile = "Unconfined"
+	assert.Nil(t, c.validatePodSecurity())
+
+	c.PodSecurity = "yolo"
+	assert.NotNil(t, c.validatePodSecurity())
+}
+
+func TestListenerConfig(t *testing.T) {
+	c := &Config{ListenAddr: ":5050"}
+	assert.Nil(t, c.validateListeners())
+	assert.False(t, c.tlsEnabled())
+
+	c.AdminListenAddr = "127.0.0.1:5051"
+	assert.Nil(t, c.validateListeners())
+
+	c.AdminListenAddr = ":5050"
+	assert.NotNil(t, c.validateListeners())
+
+	c.AdminListenAddr = "5051"
+	assert.NotNil(t, c.validateListeners())
+
+	c.AdminListenAddr = ""
+	c.TLSCert = "cert.pem"
+	assert.NotNil(t, c.validateListeners())
+
+	c.TLSKey = "key.pem"
+	assert.Nil(t, c.validateListeners())
+	assert.True(t, c.tlsEnabled())
+
+	c.TLSSelfSigned = true
+	assert.NotNil(t, c.validateListeners())
+}
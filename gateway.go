@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// how long a client has to send the access token before getting disconnected
+const GATEWAY_HANDSHAKE_TIMEOUT = time.Duration(30) * time.Second
+
+// Generate a random access token for an instance
+func generateAccessToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+// Parse a list of gateway port mappings in the form of "listen:target,listen:target"
+func parseGatewayPorts(s string) ([][2]int, error) {
+	ports := [][2]int{}
+
+	for _, mapping := range strings.Split(s, ",") {
+		parts := strings.Split(strings.TrimSpace(mapping), ":")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid gateway port mapping: %s", mapping)
+		}
+
+		listen, err := strconv.Atoi(parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid gateway listen port: %s", parts[0])
+		}
+
+		target, err := strconv.Atoi(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid gateway target port: %s", parts[1])
+		}
+
+		ports = append(ports, [2]int{listen, target})
+	}
+
+	return ports, nil
+}
+
+// `chaldeploy gateway`
+// Runs as a sidecar in an instance's pod. Clients have to send the instance's access token before
+// their connection gets proxied to the challenge. Configured with env vars set by chaldeploy:
+//   - $CHALDEPLOY_GATEWAY_TOKEN: access token for the instance
+//   - $CHALDEPLOY_GATEWAY_PORTS: ports to proxy, in the form of "listen:target,listen:target"
+func runGateway() {
+	token := os.Getenv("CHALDEPLOY_GATEWAY_TOKEN")
+	if token == "" {
+		log.Fatalln("a necessary environment variable was not set: $CHALDEPLOY_GATEWAY_TOKEN")
+	}
+
+	ports, err := parseGatewayPorts(os.Getenv("CHALDEPLOY_GATEWAY_PORTS"))
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	errs := make(chan error)
+	for _, p := range ports {
+		go func(listen, target int) {
+			errs <- serveGateway(fmt.Sprintf(":%d", listen), fmt.Sprintf("127.0.0.1:%d", target), token)
+		}(p[0], p[1])
+	}
+
+	log.Fatalln(<-errs)
+}
+
+// Accept connections on a port and proxy the authenticated ones to the target
+func serveGateway(listenAddr, targetAddr, token string) error {
+	l, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+
+	log.Printf("gateway listening on %s, proxying to %s", listenAddr, targetAddr)
+
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return err
+		}
+
+		go handleGatewayConn(c, targetAddr, token)
+	}
+}
+
+// Do the access token handshake with a client, then proxy the connection
+func handleGatewayConn(c net.Conn, targetAddr, token string) {
+	defer c.Close()
+
+	reader, err := gatewayHandshake(c, token)
+	if err != nil {
+		log.Printf("rejected connection from %s: %v", c.RemoteAddr(), err)
+		return
+	}
+
+	target, err := net.Dial("tcp", targetAddr)
+	if err != nil {
+		log.Printf("couldn't connect to the challenge at %s: %v", targetAddr, err)
+		c.Write([]byte("challenge is unavailable, try again in a bit\n"))
+		return
+	}
+	defer target.Close()
+
+	// proxy both directions, bail out when either side closes
+	done := make(chan struct{}, 2)
+	go func() {
+		// the reader may have buffered data sent after the token, so read from it instead of the raw conn
+		io.Copy(target, reader)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(c, target)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+// Prompt for the access token and validate it.
+// Returns a reader for the rest of the client's data on success
+func gatewayHandshake(c net.Conn, token string) (*bufio.Reader, error) {
+	c.SetDeadline(time.Now().Add(GATEWAY_HANDSHAKE_TIMEOUT))
+
+	if _, err := c.Write([]byte("access token: ")); err != nil {
+		return nil, err
+	}
+
+	// cap the line length so a client can't make us buffer forever
+	reader := bufio.NewReaderSize(c, 256)
+	line, err := reader.ReadSlice('\n')
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read access token: %v", err)
+	}
+
+	if subtle.ConstantTimeCompare([]byte(strings.TrimSpace(string(line))), []byte(token)) != 1 {
+		c.Write([]byte("invalid access token\n"))
+		return nil, errors.New("invalid access token")
+	}
+
+	// clear the deadline for the proxied connection
+	c.SetDeadline(time.Time{})
+
+	return reader, nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGatewayPorts(t *testing.T) {
+	ports, err := parseGatewayPorts("31336:31337, 31337:8080")
+	assert.Nil(t, err)
+	assert.Equal(t, [][2]int{{31336, 31337}, {31337, 8080}}, ports)
+
+	_, err = parseGatewayPorts("31336")
+	assert.NotNil(t, err)
+
+	_, err = parseGatewayPorts("a:b")
+	assert.NotNil(t, err)
+}
+
+func TestAccessToken(t *testing.T) {
+	a, err := generateAccessToken()
+	assert.Nil(t, err)
+	assert.Len(t, a, 32)
+
+	b, _ := generateAccessToken()
+	assert.NotEqual(t, a, b)
+}
+
+// run the handshake over an in-memory connection, returning the server's result and everything the client got back
+func runHandshake(t *testing.T, clientData string) (string, error, string) {
+	server, client := net.Pipe()
+	defer client.Close()
+
+	type result struct {
+		reader *bufio.Reader
+		err    error
+	}
+	results := make(chan result)
+	go func() {
+		reader, err := gatewayHandshake(server, "supersecret")
+		results <- result{reader, err}
+		server.Close()
+	}()
+
+	// read the prompt, then send the token
+	prompt := make([]byte, len("access token: "))
+	io.ReadFull(client, prompt)
+	assert.Equal(t, "access token: ", string(prompt))
+
+	// net.Pipe is unbuffered, so the client has to keep reading while the server responds
+	clientGot := make(chan []byte)
+	go func() {
+		b, _ := io.ReadAll(client)
+		clientGot <- b
+	}()
+	client.Write([]byte(clientData))
+
+	res := <-results
+
+	leftover := ""
+	if res.reader != nil {
+		b, _ := res.reader.Peek(res.reader.Buffered())
+		leftover = string(b)
+	}
+
+	return leftover, res.err, string(<-clientGot)
+}
+
+func TestGatewayHandshake(t *testing.T) {
+	leftover, err, _ := runHandshake(t, "supersecret\n")
+	assert.Nil(t, err)
+	assert.Equal(t, "", leftover)
+
+	_, err, got := runHandshake(t, "wrong\n")
+	assert.NotNil(t, err)
+	assert.Equal(t, "invalid access token\n", got)
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// how long each readiness check has to finish
+const READINESS_CHECK_TIMEOUT = time.Duration(5) * time.Second
+
+// how long the result of the permission check is reused, it's a burst of API calls every time
+const PERMISSION_CHECK_CACHE_TTL = time.Duration(1) * time.Minute
+
+// checks that only degrade chaldeploy when they fail. taking every replica out of the service won't bring them back
+var degradedChecks = []string{"rctf"}
+
+// last result of the k8s check that reached the API
+var cachedKubernetesCheck CheckResult
+var cachedKubernetesCheckTime time.Time
+var cachedKubernetesCheckLock sync.Mutex
+
+// CheckResult is the outcome of a single readiness check
+type CheckResult struct {
+	Ok      bool   `json:"ok"`
+	Message string `json:"message,omitempty"`
+}
+
+type ReadinessResponse struct {
+	Status string                 `json:"status"` // "ready" || "degraded" || "not ready"
+	Checks map[string]CheckResult `json:"checks"`
+}
+
+// Check that the k8s API is reachable and chaldeploy has the permissions it needs.
+// The result is reused for PERMISSION_CHECK_CACHE_TTL, unless the API couldn't be reached
+func checkKubernetes(ctx context.Context, now time.Time) CheckResult {
+	if im == nil || im.Clientset == nil {
+		return CheckResult{Ok: false, Message: "instance manager isn't initialized"}
+	}
+
+	cachedKubernetesCheckLock.Lock()
+	defer cachedKubernetesCheckLock.Unlock()
+
+	if !cachedKubernetesCheckTime.IsZero() && now.Sub(cachedKubernetesCheckTime) < PERMISSION_CHECK_CACHE_TTL {
+		return cachedKubernetesCheck
+	}
+
+	missing, err := checkPermissions(ctx, im.Clientset, im.Permissions)
+	if err != nil {
+		return CheckResult{Ok: false, Message: err.Error()}
+	}
+
+	cachedKubernetesCheck = missingPermissionsResult(missing)
+	cachedKubernetesCheckTime = now
+
+	return cachedKubernetesCheck
+}
+
+// Get the k8s check result for the permissions chaldeploy is missing
+func missingPermissionsResult(missing []Permission) CheckResult {
+	if len(missing) > 0 {
+		// optional features were already turned off at startup, only missing required permissions make us unready
+		ok := true
+		strs := []string{}
+		for _, p := range missing {
+			if p.Feature == "" {
+				ok = false
+				strs = append(strs, p.String())
+			} else {
+				strs = append(strs, fmt.Sprintf("%s (%s disabled)", p, p.Feature))
+			}
+		}
+		return CheckResult{Ok: ok, Message: "missing permissions: " + strings.Join(strs, ", ")}
+	}
+
+	return CheckResult{Ok: true}
+}
+
+// Check that the rCTF server is responding, teams can't auth without it
+func checkRctf(ctx context.Context) CheckResult {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, config.RctfServer, nil)
+	if err != nil {
+		return CheckResult{Ok: false, Message: err.Error()}
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return CheckResult{Ok: false, Message: err.Error()}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 500 {
+		return CheckResult{Ok: false, Message: fmt.Sprintf("rCTF server responded with %d", resp.StatusCode)}
+	}
+
+	return CheckResult{Ok: true}
+}
+
+// Check that expired instances are being cleaned up
+func checkReaper(now time.Time) CheckResult {
+	if reaper == nil {
+		return CheckResult{Ok: false, Message: "reaper isn't running"}
+	}
+
+	status := reaper.Status()
+	if !reaper.Healthy(now) {
+		return CheckResult{Ok: false, Message: fmt.Sprintf("reaper hasn't finished a run since %s", status.LastRun.Format(time.RFC3339))}
+	}
+
+	if status.Retrying > 0 {
+		// still ready, stuck namespaces don't stop new instances from being deployed
+		return CheckResult{Ok: true, Message: fmt.Sprintf("%d instance(s) waiting to be destroyed again: %s", status.Retrying, status.LastError)}
+	}
+
+	return CheckResult{Ok: true}
+}
+
+// Write a health response as JSON
+func writeHealthResponse(w http.ResponseWriter, code int, resp interface{}) {
+	respBytes, err := json.Marshal(resp)
+	if err != nil {
+		log.Printf("error handling health check, couldn't marshal response data: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Add("Content-type", "application/json")
+	w.WriteHeader(code)
+	w.Write(respBytes)
+}
+
+// GET /readyz
+// 200 if chaldeploy can deploy instances, otherwise 503. Includes the result of each check
+func readinessCheck(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), READINESS_CHECK_TIMEOUT)
+	defer cancel()
+
+	now := time.Now().UTC()
+	resp := ReadinessResponse{
+		Status: "ready",
+		Checks: map[string]CheckResult{
+			"kubernetes": checkKubernetes(ctx, now),
+			"rctf":       checkRctf(ctx),
+			"reaper":     checkReaper(now),
+		},
+	}
+
+	code := http.StatusOK
+	for name, c := range resp.Checks {
+		if c.Ok {
+			continue
+		}
+
+		log.Printf("readiness check %s failed: %s", name, c.Message)
+		if Contains(degradedChecks, name) {
+			if code == http.StatusOK {
+				resp.Status = "degraded"
+			}
+		} else {
+			resp.Status = "not ready"
+			code = http.StatusServiceUnavailable
+		}
+	}
+
+	writeHealthResponse(w, code, resp)
+}
+
+// GET /livez
+// 200 as long as the app is up. Doesn't check any dependencies, restarting chaldeploy won't fix them
+func livenessCheck(w http.ResponseWriter, r *http.Request) {
+	writeHealthResponse(w, http.StatusOK, map[string]string{"status": "alive"})
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/client-go/kubernetes"
+)
+
+func TestMissingPermissionsResult(t *testing.T) {
+	assert.True(t, missingPermissionsResult(nil).Ok)
+
+	// missing permissions for optional features don't make chaldeploy unready
+	assert.True(t, missingPermissionsResult([]Permission{{"apps", "deployments", "patch", FeatureRestart}}).Ok)
+	assert.False(t, missingPermissionsResult([]Permission{{"", "namespaces", "create", ""}}).Ok)
+}
+
+func TestReadinessCheck(t *testing.T) {
+	rctfUp := true
+	rctf := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !rctfUp {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer rctf.Close()
+
+	// the permission check is served from the cache, so it doesn't need a cluster
+	config = &Config{RctfServer: rctf.URL}
+	im = &InstanceManager{Clientset: &kubernetes.Clientset{}}
+	reaper = newReaper(im, 1, time.Minute)
+	reaper.status.LastRun = time.Now().UTC()
+	cachedKubernetesCheck, cachedKubernetesCheckTime = CheckResult{Ok: true}, time.Now().UTC()
+	defer func() {
+		config, im, reaper = nil, nil, nil
+		cachedKubernetesCheck, cachedKubernetesCheckTime = CheckResult{}, time.Time{}
+	}()
+
+	ready := func() (int, ReadinessResponse) {
+		rec := httptest.NewRecorder()
+		readinessCheck(rec, httptest.NewRequest("GET", "/readyz", nil))
+
+		resp := ReadinessResponse{}
+		assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+		return rec.Code, resp
+	}
+
+	code, resp := ready()
+	assert.Equal(t, 200, code)
+	assert.Equal(t, "ready", resp.Status)
+
+	// rCTF being down degrades chaldeploy, but it stays in the service
+	rctfUp = false
+	code, resp = ready()
+	assert.Equal(t, 200, code)
+	assert.Equal(t, "degraded", resp.Status)
+	assert.False(t, resp.Checks["rctf"].Ok)
+
+	// a stuck reaper takes it out
+	reaper.status.LastRun = time.Now().UTC().Add(-time.Hour)
+	code, resp = ready()
+	assert.Equal(t, 503, code)
+	assert.Equal(t, "not ready", resp.Status)
+}
@@ -0,0 +1,579 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"sigs.k8s.io/yaml"
+)
+
+// where the manifest templates and rCDS challenge are mounted in the chaldeploy pod
+const INSTALL_MANIFEST_DIR = "/etc/chaldeploy/manifests"
+const INSTALL_RCDS_DIR = "/etc/chaldeploy/rcds"
+
+// where the TLS cert and key are mounted in the chaldeploy pod
+const INSTALL_TLS_DIR = "/etc/chaldeploy/tls"
+
+// UID of the lowpriv user in the chaldeploy image
+const INSTALL_RUN_AS_USER = 1000
+
+// InstallFiles is a set of files that chaldeploy needs at runtime, shipped in a ConfigMap
+type InstallFiles struct {
+	// name of the ConfigMap, appended to the install name
+	Name string `json:"name"`
+
+	// where the files are mounted in the chaldeploy pod
+	MountPath string `json:"mountPath"`
+
+	// ship the files in a Secret instead of a ConfigMap
+	Secret bool `json:"secret,omitempty"`
+
+	// map of filename -> contents
+	Data map[string]string `json:"data"`
+}
+
+// InstallSpec is everything needed to run chaldeploy for a challenge on a cluster
+type InstallSpec struct {
+	// name for the chaldeploy objects
+	Name string `json:"-"`
+
+	// namespace chaldeploy runs in
+	Namespace string `json:"-"`
+
+	// chaldeploy image
+	Image string `json:"image"`
+
+	// config env vars
+	Env map[string]string `json:"env"`
+
+	// config env vars with sensitive values, put in a Secret
+	SecretEnv map[string]string `json:"secretEnv"`
+
+	// files mounted into the pod
+	Files []InstallFiles `json:"files"`
+
+	// seconds k8s waits for chaldeploy to drain on shutdown
+	TerminationGracePeriod int64 `json:"terminationGracePeriodSeconds"`
+
+	// port chaldeploy listens on
+	Port int `json:"port"`
+
+	// HTTP or HTTPS, for the probes
+	ProbeScheme corev1.URIScheme `json:"probeScheme"`
+
+	// ClusterRole rules, derived from the permissions chaldeploy checks for. Part of the Helm template rather than the values
+	Rules []rbacv1.PolicyRule `json:"-"`
+}
+
+// Build the install spec for the current config.
+// The config comes from the env vars, only the ones that are set are passed along to the install
+func newInstallSpec(c *Config, name, namespace, image string) (*InstallSpec, error) {
+	spec := &InstallSpec{
+		Name:                   name,
+		Namespace:              namespace,
+		Image:                  image,
+		Env:                    map[string]string{},
+		SecretEnv:              map[string]string{},
+		Files:                  []InstallFiles{},
+		TerminationGracePeriod: int64(c.DrainTimeout) + 60,
+		ProbeScheme:            corev1.URISchemeHTTP,
+	}
+
+	// the assets can be nested and binary, which doesn't fit in a ConfigMap, so they have to be mounted separately
+	if c.AssetsDir != "" {
+		return nil, errors.New("$CHALDEPLOY_ASSETS_DIR can't be included in the install, unset it and mount the directory into the pod yourself")
+	}
+
+	port, err := listenPort(c.ListenAddr)
+	if err != nil {
+		return nil, err
+	}
+	spec.Port = port
+	if c.tlsEnabled() {
+		spec.ProbeScheme = corev1.URISchemeHTTPS
+	}
+
+	// copy over the env vars, sorting out the secret ones
+	t := reflect.TypeOf(*c)
+	for i := 0; i < t.NumField(); i++ {
+		tagParts := strings.Split(t.Field(i).Tag.Get("env"), ",")
+
+		val := os.Getenv(tagParts[0])
+		if val == "" || tagParts[0] == "CHALDEPLOY_K8SCONFIG" {
+			// the pod uses its service account, not a k8s config
+			continue
+		}
+
+		if Contains(tagParts[1:], "secret") {
+			spec.SecretEnv[tagParts[0]] = val
+		} else {
+			spec.Env[tagParts[0]] = val
+		}
+	}
+
+	// the TLS cert and key are shipped in a Secret. Renewing them means regenerating the install
+	if c.TLSCert != "" {
+		files := map[string]string{}
+		for name, path := range map[string]string{"tls.crt": c.TLSCert, "tls.key": c.TLSKey} {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return nil, fmt.Errorf("couldn't read TLS file %s: %v", path, err)
+			}
+			files[name] = string(data)
+		}
+
+		spec.Files = append(spec.Files, InstallFiles{Name: "tls", MountPath: INSTALL_TLS_DIR, Secret: true, Data: files})
+		spec.Env["CHALDEPLOY_TLS_CERT"] = filepath.Join(INSTALL_TLS_DIR, "tls.crt")
+		spec.Env["CHALDEPLOY_TLS_KEY"] = filepath.Join(INSTALL_TLS_DIR, "tls.key")
+	}
+
+	// ship the challenge definition with the install, the paths on this machine won't exist in the pod
+	if c.ManifestDir != "" {
+		files, err := readInstallFiles(c.ManifestDir, func(n string) bool {
+			ext := filepath.Ext(n)
+			return ext == ".yaml" || ext == ".yml"
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		spec.Files = append(spec.Files, InstallFiles{Name: "manifests", MountPath: INSTALL_MANIFEST_DIR, Data: files})
+		spec.Env["CHALDEPLOY_MANIFEST_DIR"] = INSTALL_MANIFEST_DIR
+	} else if c.RcdsChallengePath != "" {
+		data, err := os.ReadFile(c.RcdsChallengePath)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't read rCDS challenge %s: %v", c.RcdsChallengePath, err)
+		}
+
+		fileName := filepath.Base(c.RcdsChallengePath)
+		spec.Files = append(spec.Files, InstallFiles{Name: "rcds", MountPath: INSTALL_RCDS_DIR, Data: map[string]string{fileName: string(data)}})
+		spec.Env["CHALDEPLOY_RCDS_CHALLENGE"] = filepath.Join(INSTALL_RCDS_DIR, fileName)
+	}
+
+	// get the permissions the same way chaldeploy checks for them on startup
+	objSource, err := loadObjectSource(c)
+	if err != nil {
+		return nil, err
+	}
+	perms, err := (&InstanceManager{Manifests: objSource}).neededPermissions()
+	if err != nil {
+		return nil, err
+	}
+	spec.Rules = permissionRules(perms)
+
+	return spec, nil
+}
+
+// Read the files in a directory that match a filter
+func readInstallFiles(dir string, filter func(string) bool) (map[string]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read directory %s: %v", dir, err)
+	}
+
+	files := map[string]string{}
+	for _, e := range entries {
+		if e.IsDir() || !filter(e.Name()) {
+			continue
+		}
+
+		data, err := os.ReadFile(filepath.Join(dir, e.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("couldn't read %s: %v", e.Name(), err)
+		}
+		files[e.Name()] = string(data)
+	}
+
+	return files, nil
+}
+
+// Group permissions into RBAC rules, one per resource
+func permissionRules(perms []Permission) []rbacv1.PolicyRule {
+	type groupResource struct{ group, resource string }
+
+	verbs := map[groupResource][]string{}
+	order := []groupResource{}
+	for _, p := range perms {
+		gr := groupResource{p.Group, p.Resource}
+		if _, ok := verbs[gr]; !ok {
+			order = append(order, gr)
+		}
+		if !Contains(verbs[gr], p.Verb) {
+			verbs[gr] = append(verbs[gr], p.Verb)
+		}
+	}
+
+	rules := []rbacv1.PolicyRule{}
+	for _, gr := range order {
+		sort.Strings(verbs[gr])
+		rules = append(rules, rbacv1.PolicyRule{
+			APIGroups: []string{gr.group},
+			Resources: []string{gr.resource},
+			Verbs:     verbs[gr],
+		})
+	}
+
+	return rules
+}
+
+// Get the k8s objects for the install
+func (s *InstallSpec) Objects() []runtime.Object {
+	labels := map[string]string{"app": s.Name}
+	meta := metav1.ObjectMeta{Name: s.Name, Namespace: s.Namespace, Labels: labels}
+	clusterMeta := metav1.ObjectMeta{Name: fmt.Sprintf("%s-%s", s.Namespace, s.Name), Labels: labels}
+
+	objs := []runtime.Object{
+		&corev1.Namespace{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "Namespace"},
+			ObjectMeta: metav1.ObjectMeta{Name: s.Namespace},
+		},
+		&corev1.ServiceAccount{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "ServiceAccount"},
+			ObjectMeta: meta,
+		},
+		&rbacv1.ClusterRole{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "rbac.authorization.k8s.io/v1", Kind: "ClusterRole"},
+			ObjectMeta: clusterMeta,
+			Rules:      s.Rules,
+		},
+		&rbacv1.ClusterRoleBinding{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "rbac.authorization.k8s.io/v1", Kind: "ClusterRoleBinding"},
+			ObjectMeta: clusterMeta,
+			RoleRef:    rbacv1.RoleRef{APIGroup: "rbac.authorization.k8s.io", Kind: "ClusterRole", Name: clusterMeta.Name},
+			Subjects:   []rbacv1.Subject{{Kind: "ServiceAccount", Name: s.Name, Namespace: s.Namespace}},
+		},
+		&corev1.Secret{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "Secret"},
+			ObjectMeta: meta,
+			StringData: s.SecretEnv,
+		},
+	}
+
+	container := corev1.Container{
+		Name:  "chaldeploy",
+		Image: s.Image,
+		Ports: []corev1.ContainerPort{{ContainerPort: int32(s.Port)}},
+		Resources: corev1.ResourceRequirements{
+			Limits: corev1.ResourceList{
+				corev1.ResourceCPU:    resource.MustParse("500m"),
+				corev1.ResourceMemory: resource.MustParse("256Mi"),
+			},
+		},
+		ReadinessProbe: &corev1.Probe{
+			ProbeHandler:   corev1.ProbeHandler{HTTPGet: &corev1.HTTPGetAction{Path: "/readyz", Port: intstr.FromInt(s.Port), Scheme: s.ProbeScheme}},
+			PeriodSeconds:  15,
+			TimeoutSeconds: 10,
+		},
+		LivenessProbe: &corev1.Probe{
+			ProbeHandler: corev1.ProbeHandler{HTTPGet: &corev1.HTTPGetAction{Path: "/livez", Port: intstr.FromInt(s.Port), Scheme: s.ProbeScheme}},
+		},
+	}
+	// config env vars, in a stable order
+	for _, k := range sortedKeys(s.Env) {
+		container.Env = append(container.Env, corev1.EnvVar{Name: k, Value: s.Env[k]})
+	}
+	for _, k := range sortedKeys(s.SecretEnv) {
+		container.Env = append(container.Env, corev1.EnvVar{
+			Name: k,
+			ValueFrom: &corev1.EnvVarSource{
+				SecretKeyRef: &corev1.SecretKeySelector{LocalObjectReference: corev1.LocalObjectReference{Name: s.Name}, Key: k},
+			},
+		})
+	}
+
+	// chaldeploy doesn't need any privileges in the pod, lock it down like the restricted Pod Security level requires
+	runAsNonRoot := true
+	runAsUser := int64(INSTALL_RUN_AS_USER)
+	allowPrivilegeEscalation := false
+	container.SecurityContext = &corev1.SecurityContext{
+		AllowPrivilegeEscalation: &allowPrivilegeEscalation,
+		Capabilities:             &corev1.Capabilities{Drop: []corev1.Capability{"ALL"}},
+	}
+
+	podSpec := corev1.PodSpec{
+		ServiceAccountName:            s.Name,
+		TerminationGracePeriodSeconds: &s.TerminationGracePeriod,
+		SecurityContext: &corev1.PodSecurityContext{
+			RunAsNonRoot:   &runAsNonRoot,
+			RunAsUser:      &runAsUser,
+			SeccompProfile: &corev1.SeccompProfile{Type: corev1.SeccompProfileTypeRuntimeDefault},
+		},
+	}
+	for _, f := range s.Files {
+		cmName := fmt.Sprintf("%s-%s", s.Name, f.Name)
+		cmMeta := metav1.ObjectMeta{Name: cmName, Namespace: s.Namespace, Labels: labels}
+
+		if f.Secret {
+			objs = append(objs, &corev1.Secret{
+				TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "Secret"},
+				ObjectMeta: cmMeta,
+				StringData: f.Data,
+			})
+			podSpec.Volumes = append(podSpec.Volumes, corev1.Volume{
+				Name:         f.Name,
+				VolumeSource: corev1.VolumeSource{Secret: &corev1.SecretVolumeSource{SecretName: cmName}},
+			})
+		} else {
+			objs = append(objs, &corev1.ConfigMap{
+				TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "ConfigMap"},
+				ObjectMeta: cmMeta,
+				Data:       f.Data,
+			})
+			podSpec.Volumes = append(podSpec.Volumes, corev1.Volume{
+				Name:         f.Name,
+				VolumeSource: corev1.VolumeSource{ConfigMap: &corev1.ConfigMapVolumeSource{LocalObjectReference: corev1.LocalObjectReference{Name: cmName}}},
+			})
+		}
+		container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{Name: f.Name, MountPath: f.MountPath, ReadOnly: true})
+	}
+	podSpec.Containers = []corev1.Container{container}
+
+	replicas := int32(1)
+	objs = append(objs,
+		&appsv1.Deployment{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "apps/v1", Kind: "Deployment"},
+			ObjectMeta: meta,
+			Spec: appsv1.DeploymentSpec{
+				Replicas: &replicas,
+				Selector: &metav1.LabelSelector{MatchLabels: labels},
+				Template: corev1.PodTemplateSpec{
+					ObjectMeta: metav1.ObjectMeta{Labels: labels},
+					Spec:       podSpec,
+				},
+			},
+		},
+		&corev1.Service{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "Service"},
+			ObjectMeta: meta,
+			Spec: corev1.ServiceSpec{
+				Selector: labels,
+				Ports:    []corev1.ServicePort{{Port: int32(s.Port), TargetPort: intstr.FromInt(s.Port), Protocol: corev1.ProtocolTCP}},
+				Type:     corev1.ServiceTypeNodePort,
+			},
+		},
+	)
+
+	return objs
+}
+
+// Write the install objects as a multi-document YAML stream
+func (s *InstallSpec) WriteManifests(w io.Writer) error {
+	for _, o := range s.Objects() {
+		data, err := yaml.Marshal(o)
+		if err != nil {
+			return err
+		}
+
+		if _, err := fmt.Fprintf(w, "---\n%s", data); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Write a Helm chart that renders the same objects as WriteManifests, minus the Namespace (Helm creates it).
+// The values come from the install spec, so the chart is specific to the challenge it was generated for
+func (s *InstallSpec) WriteHelmChart(dir string) error {
+	values, err := yaml.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	tmpl, err := s.helmTemplate()
+	if err != nil {
+		return err
+	}
+
+	files := map[string]string{
+		"Chart.yaml":  fmt.Sprintf(HELM_CHART_YAML, s.Name),
+		"values.yaml": "# generated by `chaldeploy manifests -helm`\n" + string(values),
+		filepath.Join("templates", "chaldeploy.yaml"): tmpl,
+	}
+
+	if err := os.MkdirAll(filepath.Join(dir, "templates"), 0755); err != nil {
+		return err
+	}
+	for _, name := range sortedKeys(files) {
+		// secret values end up in values.yaml, don't make it world readable
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(files[name]), 0600); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// stand-ins for values in the Helm template, so it can be rendered with Objects() and the values swapped in after.
+// strings are replaced with tokens, numbers with ones that don't show up in the objects otherwise
+var helmTokenRegex = regexp.MustCompile(`__helm_value_(\d+)__`)
+
+// splits a line of YAML into the indentation/key and the value
+var helmLineRegex = regexp.MustCompile(`^(\s*(?:- )*(?:[^\s'"][^:]*: )?)(.*)$`)
+
+const HELM_PORT_PLACEHOLDER = 1000000001
+const HELM_GRACE_PERIOD_PLACEHOLDER = 1000000002
+
+// Get the Helm template for the install. The objects come from Objects(), with the values in the spec templated from .Values
+func (s *InstallSpec) helmTemplate() (string, error) {
+	exprs := []string{}
+	token := func(expr string) string {
+		exprs = append(exprs, expr)
+		return fmt.Sprintf("__helm_value_%d__", len(exprs)-1)
+	}
+
+	// the names and rules are part of the template, only the values are taken from .Values
+	placeholders := &InstallSpec{
+		Name:                   token(".Release.Name"),
+		Namespace:              token(".Release.Namespace"),
+		Image:                  token(".Values.image"),
+		Env:                    map[string]string{},
+		SecretEnv:              map[string]string{},
+		TerminationGracePeriod: HELM_GRACE_PERIOD_PLACEHOLDER,
+		Port:                   HELM_PORT_PLACEHOLDER,
+		ProbeScheme:            corev1.URIScheme(token(".Values.probeScheme")),
+		Rules:                  s.Rules,
+	}
+	for k := range s.Env {
+		placeholders.Env[k] = token(fmt.Sprintf("index .Values.env %s", strconv.Quote(k)))
+	}
+	for k := range s.SecretEnv {
+		placeholders.SecretEnv[k] = token(fmt.Sprintf("index .Values.secretEnv %s", strconv.Quote(k)))
+	}
+	for i, f := range s.Files {
+		data := map[string]string{}
+		for k := range f.Data {
+			data[k] = token(fmt.Sprintf("index (index .Values.files %d).data %s", i, strconv.Quote(k)))
+		}
+		placeholders.Files = append(placeholders.Files, InstallFiles{Name: f.Name, MountPath: f.MountPath, Secret: f.Secret, Data: data})
+	}
+
+	out := &strings.Builder{}
+	for _, o := range placeholders.Objects() {
+		if _, ok := o.(*corev1.Namespace); ok {
+			continue
+		}
+
+		data, err := yaml.Marshal(o)
+		if err != nil {
+			return "", err
+		}
+
+		out.WriteString("---\n")
+		for _, line := range strings.SplitAfter(string(data), "\n") {
+			out.WriteString(helmTemplateLine(line, exprs))
+		}
+	}
+
+	tmpl := strings.ReplaceAll(out.String(), strconv.Itoa(HELM_PORT_PLACEHOLDER), "{{ .Values.port }}")
+	tmpl = strings.ReplaceAll(tmpl, strconv.Itoa(HELM_GRACE_PERIOD_PLACEHOLDER), "{{ .Values.terminationGracePeriodSeconds }}")
+
+	return tmpl, nil
+}
+
+// Swap the tokens in a line of YAML for the template expressions. Values with tokens are rendered as JSON strings, which are valid YAML
+func helmTemplateLine(line string, exprs []string) string {
+	if !helmTokenRegex.MatchString(line) {
+		return line
+	}
+
+	// tokens are only in values, never in keys
+	m := helmLineRegex.FindStringSubmatch(strings.TrimRight(line, "\n"))
+	prefix, value := m[1], m[2]
+	if len(value) >= 2 && (value[0] == '\'' || value[0] == '"') && value[len(value)-1] == value[0] {
+		value = value[1 : len(value)-1]
+	}
+
+	// print the literal parts and the values together, e.g. "{{ .Release.Namespace }}-{{ .Release.Name }}"
+	args := []string{}
+	last := 0
+	for _, m := range helmTokenRegex.FindAllStringSubmatchIndex(value, -1) {
+		if m[0] > last {
+			args = append(args, strconv.Quote(value[last:m[0]]))
+		}
+		i, _ := strconv.Atoi(value[m[2]:m[3]])
+		args = append(args, "("+exprs[i]+")")
+		last = m[1]
+	}
+	if last < len(value) {
+		args = append(args, strconv.Quote(value[last:]))
+	}
+
+	if len(args) == 1 && strings.HasPrefix(args[0], "(") {
+		return fmt.Sprintf("%s{{ %s | toJson }}\n", prefix, args[0][1:len(args[0])-1])
+	}
+
+	return fmt.Sprintf("%s{{ print %s | toJson }}\n", prefix, strings.Join(args, " "))
+}
+
+// Get the keys of a map in sorted order
+func sortedKeys[V any](m map[string]V) []string {
+	keys := []string{}
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// `chaldeploy manifests [-name chaldeploy] [-namespace chaldeploy] [-image chaldeploy:latest] [-helm DIR]`
+// Prints the manifests to install chaldeploy with the config from the env vars, or writes them as a Helm chart
+func runManifests(args []string) {
+	fs := flag.NewFlagSet("manifests", flag.ExitOnError)
+	name := fs.String("name", "chaldeploy", "name for the chaldeploy objects")
+	namespace := fs.String("namespace", "chaldeploy", "namespace to install chaldeploy in (ignored for Helm, the release namespace is used)")
+	image := fs.String("image", "chaldeploy:latest", "chaldeploy image")
+	helmDir := fs.String("helm", "", "write a Helm chart to this directory instead of printing the manifests")
+	fs.Parse(args)
+
+	// log to stderr so it doesn't end up in the manifests
+	log.SetOutput(os.Stderr)
+
+	c, err := loadConfig()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	config = c
+
+	spec, err := newInstallSpec(c, *name, *namespace, *image)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	if *helmDir != "" {
+		if err := spec.WriteHelmChart(*helmDir); err != nil {
+			log.Fatalf("couldn't write the Helm chart: %v", err)
+		}
+		log.Printf("wrote Helm chart to %s", *helmDir)
+		return
+	}
+
+	if err := spec.WriteManifests(os.Stdout); err != nil {
+		log.Fatalf("couldn't write the manifests: %v", err)
+	}
+}
+
+const HELM_CHART_YAML = `apiVersion: v2
+name: %s
+description: chaldeploy, per-team challenge instances for rCTF
+type: application
+version: 0.1.0
+`
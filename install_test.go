@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"text/template"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"sigs.k8s.io/yaml"
+)
+
+func TestPermissionRules(t *testing.T) {
+	rules := permissionRules([]Permission{
+		{"", "namespaces", "list", ""},
+		{"apps", "deployments", "patch", FeatureRestart},
+		{"", "namespaces", "create", ""},
+		{"", "namespaces", "create", ""},
+	})
+
+	assert.Equal(t, []rbacv1.PolicyRule{
+		{APIGroups: []string{""}, Resources: []string{"namespaces"}, Verbs: []string{"create", "list"}},
+		{APIGroups: []string{"apps"}, Resources: []string{"deployments"}, Verbs: []string{"patch"}},
+	}, rules)
+}
+
+func TestInstallSpec(t *testing.T) {
+	t.Setenv("CHALDEPLOY_NAME", "test")
+	t.Setenv("CHALDEPLOY_PORT", "1337")
+	t.Setenv("CHALDEPLOY_IMAGE", "test:latest")
+	t.Setenv("CHALDEPLOY_SESSION_KEY", "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa")
+	t.Setenv("CHALDEPLOY_RCTF_SERVER", "https://2021.redpwn.net")
+	t.Setenv("CHALDEPLOY_K8SCONFIG", "/home/me/.kube/config")
+	t.Setenv("CHALDEPLOY_RCDS_CHALLENGE", writeRcdsChallenge(t, testRcdsChallenge))
+
+	c, err := loadConfig()
+	assert.Nil(t, err)
+	config = c
+	defer func() { config = nil }()
+
+	spec, err := newInstallSpec(c, "chaldeploy", "chaldeploy", "chaldeploy:v5")
+	assert.Nil(t, err)
+
+	// secrets are split out, the local k8s config isn't passed along
+	assert.Equal(t, map[string]string{"CHALDEPLOY_SESSION_KEY": "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"}, spec.SecretEnv)
+	assert.Equal(t, "test", spec.Env["CHALDEPLOY_NAME"])
+	assert.NotContains(t, spec.Env, "CHALDEPLOY_K8SCONFIG")
+
+	// the rCDS challenge is shipped in a ConfigMap and the path points at the mount
+	assert.Equal(t, "/etc/chaldeploy/rcds/challenge.yaml", spec.Env["CHALDEPLOY_RCDS_CHALLENGE"])
+	assert.Len(t, spec.Files, 1)
+	assert.Contains(t, spec.Files[0].Data, "challenge.yaml")
+
+	// objects from the rCDS challenge need create permissions
+	assert.Contains(t, spec.Rules, rbacv1.PolicyRule{APIGroups: []string{"apps"}, Resources: []string{"deployments"}, Verbs: []string{"create", "list", "patch"}})
+
+	buf := &bytes.Buffer{}
+	assert.Nil(t, spec.WriteManifests(buf))
+	for _, kind := range []string{"ServiceAccount", "ClusterRole", "ClusterRoleBinding", "Secret", "ConfigMap", "Deployment", "Service"} {
+		assert.Contains(t, buf.String(), "kind: "+kind+"\n")
+	}
+	assert.Contains(t, buf.String(), "image: chaldeploy:v5")
+
+	// chaldeploy's own pod passes the restricted Pod Security level
+	for _, o := range spec.Objects() {
+		if d, ok := o.(*appsv1.Deployment); ok {
+			assert.Empty(t, checkPodSecurity(d.Spec.Template.Spec, "restricted"))
+		}
+	}
+
+	// the probes follow the listen address and TLS settings
+	assert.Equal(t, 5050, spec.Port)
+	assert.Contains(t, buf.String(), "scheme: HTTP\n")
+
+	c.ListenAddr = ":8443"
+	c.TLSSelfSigned = true
+	spec, err = newInstallSpec(c, "chaldeploy", "chaldeploy", "chaldeploy:v5")
+	assert.Nil(t, err)
+	buf.Reset()
+	assert.Nil(t, spec.WriteManifests(buf))
+	assert.Contains(t, buf.String(), "containerPort: 8443\n")
+	assert.Contains(t, buf.String(), "scheme: HTTPS\n")
+
+	// the TLS cert and key are shipped in a Secret and the paths point at the mount
+	certPEM, keyPEM, err := generateSelfSignedCert([]string{"localhost"}, time.Now())
+	assert.Nil(t, err)
+	dir := t.TempDir()
+	c.TLSSelfSigned = false
+	c.TLSCert, c.TLSKey = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	assert.Nil(t, os.WriteFile(c.TLSCert, certPEM, 0600))
+	assert.Nil(t, os.WriteFile(c.TLSKey, keyPEM, 0600))
+
+	spec, err = newInstallSpec(c, "chaldeploy", "chaldeploy", "chaldeploy:v5")
+	assert.Nil(t, err)
+	assert.Equal(t, "/etc/chaldeploy/tls/tls.crt", spec.Env["CHALDEPLOY_TLS_CERT"])
+	assert.Equal(t, "/etc/chaldeploy/tls/tls.key", spec.Env["CHALDEPLOY_TLS_KEY"])
+	assert.Len(t, spec.Files, 2)
+	assert.True(t, spec.Files[0].Secret)
+	assert.Equal(t, string(keyPEM), spec.Files[0].Data["tls.key"])
+	buf.Reset()
+	assert.Nil(t, spec.WriteManifests(buf))
+	assert.Contains(t, buf.String(), "secretName: chaldeploy-tls\n")
+
+	// the assets directory isn't shipped, so it's an error rather than a path that doesn't exist in the pod
+	c.AssetsDir = dir
+	_, err = newInstallSpec(c, "chaldeploy", "chaldeploy", "chaldeploy:v5")
+	assert.NotNil(t, err)
+}
+
+// Split a YAML stream into objects, for comparing manifests regardless of formatting
+func parseYAMLStream(t *testing.T, stream string) []interface{} {
+	objs := []interface{}{}
+	for _, doc := range regexp.MustCompile(`(?m)^---\n`).Split(stream, -1) {
+		if strings.TrimSpace(doc) == "" {
+			continue
+		}
+
+		var obj interface{}
+		assert.Nil(t, yaml.Unmarshal([]byte(doc), &obj), doc)
+		if obj.(map[string]interface{})["kind"] != "Namespace" {
+			objs = append(objs, obj)
+		}
+	}
+
+	return objs
+}
+
+func TestHelmChart(t *testing.T) {
+	spec := &InstallSpec{
+		Name:                   "chaldeploy",
+		Namespace:              "chaldeploy-mychal",
+		Image:                  "chaldeploy:v5",
+		Env:                    map[string]string{"CHALDEPLOY_NAME": "my chal: \"the sequel\"", "CHALDEPLOY_PORT": "1337"},
+		SecretEnv:              map[string]string{"CHALDEPLOY_SESSION_KEY": "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"},
+		TerminationGracePeriod: 120,
+		Port:                   8443,
+		ProbeScheme:            corev1.URISchemeHTTPS,
+		Rules:                  []rbacv1.PolicyRule{{APIGroups: []string{""}, Resources: []string{"namespaces"}, Verbs: []string{"create", "delete"}}},
+		Files: []InstallFiles{
+			{Name: "tls", MountPath: INSTALL_TLS_DIR, Secret: true, Data: map[string]string{"tls.crt": "-----BEGIN CERTIFICATE-----\nabc\n-----END CERTIFICATE-----\n"}},
+			{Name: "manifests", MountPath: INSTALL_MANIFEST_DIR, Data: map[string]string{"deployment.yaml": "kind: Deployment\n"}},
+		},
+	}
+
+	dir := t.TempDir()
+	assert.Nil(t, spec.WriteHelmChart(dir))
+	tmplData, err := os.ReadFile(filepath.Join(dir, "templates", "chaldeploy.yaml"))
+	assert.Nil(t, err)
+	valuesData, err := os.ReadFile(filepath.Join(dir, "values.yaml"))
+	assert.Nil(t, err)
+
+	// render the chart like Helm would, with the release name and namespace the manifests were generated for
+	values := map[string]interface{}{}
+	assert.Nil(t, yaml.Unmarshal(valuesData, &values))
+	tmpl, err := template.New("chaldeploy.yaml").Funcs(template.FuncMap{
+		"toJson": func(v interface{}) string {
+			data, _ := json.Marshal(v)
+			return string(data)
+		},
+	}).Parse(string(tmplData))
+	assert.Nil(t, err)
+	rendered := &bytes.Buffer{}
+	assert.Nil(t, tmpl.Execute(rendered, map[string]interface{}{
+		"Values":  values,
+		"Release": map[string]interface{}{"Name": spec.Name, "Namespace": spec.Namespace},
+	}))
+
+	manifests := &bytes.Buffer{}
+	assert.Nil(t, spec.WriteManifests(manifests))
+	assert.Equal(t, parseYAMLStream(t, manifests.String()), parseYAMLStream(t, rendered.String()))
+
+	// values from values.yaml show up in the objects
+	values["image"] = "chaldeploy:v6"
+	rendered.Reset()
+	assert.Nil(t, tmpl.Execute(rendered, map[string]interface{}{
+		"Values":  values,
+		"Release": map[string]interface{}{"Name": spec.Name, "Namespace": spec.Namespace},
+	}))
+	assert.Contains(t, rendered.String(), `image: "chaldeploy:v6"`)
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"log"
 	"math"
+	"net"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -17,11 +18,20 @@ import (
 
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/discovery/cached/memory"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	_ "k8s.io/client-go/plugin/pkg/client/auth/gcp"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/restmapper"
 	"k8s.io/client-go/tools/clientcmd"
 	"k8s.io/client-go/util/homedir"
 )
@@ -30,6 +40,9 @@ import (
 // TODO: configify this
 const INSTANCE_RUNTIME = time.Duration(1) * time.Hour
 
+// how long to wait for a partially created instance to be torn down
+const ROLLBACK_TIMEOUT = time.Duration(2) * time.Minute
+
 type InstanceState int64
 
 const (
@@ -45,6 +58,10 @@ const (
 	// a Destroyed instance doesn't exist anymore, and can be (re)deployed.
 	// This is the first state of a DeploymentInstance
 	Destroyed
+
+	// a Failed instance couldn't be deployed, and whatever was created for it has been torn down.
+	// Like a Destroyed instance, it can be (re)deployed.
+	Failed
 )
 
 func (s InstanceState) String() string {
@@ -55,6 +72,8 @@ func (s InstanceState) String() string {
 		return "destroying"
 	case Destroyed:
 		return "destroyed"
+	case Failed:
+		return "failed"
 	default:
 		return "(unknown enum value)"
 	}
@@ -82,6 +101,24 @@ type DeploymentInstance struct {
 
 	// port for connecting to the instance
 	Port int
+
+	// last time the team restarted the instance
+	LastRestart *time.Time
+
+	// last time the team destroyed the instance
+	LastDestroy *time.Time
+
+	// token needed to connect to the instance, empty unless $CHALDEPLOY_ACCESS_CONTROL=token
+	AccessToken string
+
+	// CIDRs allowed to connect to the instance, empty unless $CHALDEPLOY_SOURCE_ALLOWLIST is set
+	AllowedIPs []string
+
+	// why the last deployment failed, only set if the instance is Failed
+	FailureReason string
+
+	// number of times the team extended the instance
+	Extensions int
 }
 
 // implement sync.Locker on DeploymentInstance
@@ -97,24 +134,103 @@ func (di *DeploymentInstance) GetCxn() string {
 	return fmt.Sprintf("%s:%d", di.Hostname, di.Port)
 }
 
+// InstanceSnapshot is a copy of the parts of an instance that are shown to its team
+type InstanceSnapshot struct {
+	State       InstanceState
+	Hostname    string
+	Port        int
+	ExpTime     *time.Time
+	AccessToken string
+	AllowedIPs  []string
+	Extensions  int
+}
+
+// Get a copy of the instance taken under its lock, for reading it while operations may be changing it.
+// Waits for an in-flight operation on the instance to finish
+func (di *DeploymentInstance) Snapshot() InstanceSnapshot {
+	di.mu.Lock()
+	defer di.mu.Unlock()
+
+	return InstanceSnapshot{
+		State:       di.State,
+		Hostname:    di.Hostname,
+		Port:        di.Port,
+		ExpTime:     di.ExpTime,
+		AccessToken: di.AccessToken,
+		AllowedIPs:  append([]string(nil), di.AllowedIPs...),
+		Extensions:  di.Extensions,
+	}
+}
+
+func (s InstanceSnapshot) GetCxn() string {
+	return fmt.Sprintf("%s:%d", s.Hostname, s.Port)
+}
+
 // InstanceManager stores the necessary data for creating and destroying challenge instances on a k8s cluster
 type InstanceManager struct {
 	// k8s config
 	Config *rest.Config
 
 	// k8s client
-	Clientset *kubernetes.Clientset
+	Clientset kubernetes.Interface
+
+	// k8s client for arbitrary resources from manifests
+	DynamicClient dynamic.Interface
+
+	// maps the kinds in manifests to API resources
+	Mapper meta.RESTMapper
+
+	// manifest templates or rCDS challenge to deploy instead of the default deployment/service, nil if not configured
+	Manifests ObjectSource
+
+	// k8s API actions needed to manage instances with the current config
+	Permissions []Permission
+
+	// optional features turned off because chaldeploy doesn't have the permissions for them
+	DisabledFeatures map[string]bool
 
 	// mutex for controlling access to the instance map
 	Lock *sync.RWMutex
 
 	// map of team id -> instance
 	Instances *generic_map.MapOf[string, *DeploymentInstance]
+
+	// in-flight creates and destroys, waited on when shutting down
+	ops sync.WaitGroup
+
+	// set once draining starts, so no new operations are added to ops while it's being waited on
+	draining bool
+
+	// mutex for draining
+	opsLock sync.Mutex
 }
 
-// Initialize the instance manager object, including authing to the cluster
-// TODO: ensure necessary permissions are obtained
-func (im *InstanceManager) Init() error {
+// Load the manifest templates or rCDS challenge from the config.
+// Returns nil if the challenge uses the default deployment/service
+func loadObjectSource(c *Config) (ObjectSource, error) {
+	if c.ManifestDir != "" {
+		ms, err := loadManifestSet(c.ManifestDir, c.PodSecurity)
+		if err != nil {
+			return nil, err
+		}
+
+		log.Printf("loaded %d manifest template(s) from %s", len(ms.templates), ms.Dir)
+		return ms, nil
+	} else if c.RcdsChallengePath != "" {
+		rc, err := loadRcdsChallenge(c.RcdsChallengePath)
+		if err != nil {
+			return nil, err
+		}
+
+		log.Printf("loaded rCDS challenge %s with %d container(s)", rc.Name, len(rc.Containers))
+		return rc, nil
+	}
+
+	return nil, nil
+}
+
+// Initialize the instance manager object, including authing to the cluster and checking its permissions
+func (im *InstanceManager) Init(ctx context.Context) error {
 	// load the cluster config
 	k8sConfig, err := getConfigForCluster()
 	if err != nil {
@@ -131,12 +247,47 @@ func (im *InstanceManager) Init() error {
 		im.Clientset = clientset
 	}
 
+	// create the dynamic client and mapper, used for deploying manifests
+	dynamicClient, err := dynamic.NewForConfig(im.Config)
+	if err != nil {
+		return err
+	} else {
+		im.DynamicClient = dynamicClient
+	}
+	im.Mapper = restmapper.NewDeferredDiscoveryRESTMapper(memory.NewMemCacheClient(clientset.Discovery()))
+
+	// load the manifest templates or rCDS challenge, if the challenge uses them
+	if objSource, err := loadObjectSource(config); err != nil {
+		return err
+	} else {
+		im.Manifests = objSource
+	}
+
+	// figure out what access to the cluster is needed, and make sure we have it
+	if perms, err := im.neededPermissions(); err != nil {
+		return err
+	} else {
+		im.Permissions = perms
+	}
+	missing, err := checkPermissions(ctx, im.Clientset, im.Permissions)
+	if err != nil {
+		return err
+	}
+	if len(missing) > 0 {
+		log.Printf("chaldeploy's service account is missing %d permission(s):\n%s", len(missing), formatPermissionTable(missing))
+	}
+	if disabled, err := disabledFeatures(missing); err != nil {
+		return err
+	} else {
+		im.DisabledFeatures = disabled
+	}
+
 	// initialize the map
 	im.Instances = new(generic_map.MapOf[string, *DeploymentInstance])
 
 	// get the chaldeploy namespaces for this challenge
 	namespaceClient := im.Clientset.CoreV1().Namespaces()
-	cdNamespaces, err := namespaceClient.List(context.TODO(), metav1.ListOptions{
+	cdNamespaces, err := namespaceClient.List(ctx, metav1.ListOptions{
 		LabelSelector: fmt.Sprintf("chaldeploy.captaingee.ch/managed-by=yes,chaldeploy.captaingee.ch/chal=%s", HashString(config.ChallengeName)),
 	})
 	if err != nil {
@@ -157,6 +308,29 @@ func (im *InstanceManager) Init() error {
 
 			teamId := ns.Labels["chaldeploy.captaingee.ch/team-id"]
 
+			// the namespace was being deleted when chaldeploy last stopped, let it finish
+			if ns.Status.Phase == corev1.NamespaceTerminating {
+				log.Printf("found terminating namespace %s while initializing InstanceManager, waiting for it to be deleted", ns.Name)
+				di.State = Destroying
+				im.Instances.Store(teamId, di)
+
+				im.beginOp()
+				go func(di *DeploymentInstance) {
+					defer im.ops.Done()
+
+					di.mu.Lock()
+					defer di.mu.Unlock()
+					if di.BlockUntilTerminated(ctx, 0, 8) {
+						di.State = Destroyed
+					} else {
+						// the reaper's resync marks it as destroyed once k8s is done with it
+						log.Printf("namespace %s is still terminating, it'll be checked again when the reaper runs", di.Namespace)
+					}
+				}(di)
+
+				continue
+			}
+
 			// get the expiration time for the deployment instance
 			if expTimeInt, err := strconv.Atoi(ns.Labels["chaldeploy.captaingee.ch/expiration-time"]); err != nil {
 				log.Printf("couldn't parse expiration time for %s as int, setting 1hr expiration: %s", ns.Name, ns.Labels["chaldeploy.captaingee.ch/expiration-time"])
@@ -167,19 +341,34 @@ func (im *InstanceManager) Init() error {
 				di.ExpTime = &expTime
 			}
 
+			// missing for instances that were never extended
+			di.Extensions, _ = strconv.Atoi(ns.Labels["chaldeploy.captaingee.ch/extensions"])
+
 			// get the connection info
 			servicesClient := clientset.CoreV1().Services(di.Namespace)
-			if service, err := servicesClient.Get(context.TODO(), di.AppName, metav1.GetOptions{}); err == nil {
+			if service, err := servicesClient.Get(ctx, di.AppName, metav1.GetOptions{}); err == nil {
+				di.AllowedIPs = service.Spec.LoadBalancerSourceRanges
+
 				// found a running service, check if gcp assigned an lb to it
-				if len(service.Status.LoadBalancer.Ingress) > 0 {
+				if len(service.Status.LoadBalancer.Ingress) > 0 && len(service.Spec.Ports) > 0 {
 					// it did, save it
 					di.Hostname = service.Status.LoadBalancer.Ingress[0].IP
-					di.Port = config.ChallengePort
+					di.Port = int(service.Spec.Ports[0].Port)
 				}
 			} else {
 				log.Printf("couldn't get service when enumerating existing deployments: %v", err)
 			}
 
+			// get the access token
+			if config.AccessControl == "token" {
+				secretsClient := clientset.CoreV1().Secrets(di.Namespace)
+				if secret, err := secretsClient.Get(ctx, getAccessSecretName(di.AppName), metav1.GetOptions{}); err == nil {
+					di.AccessToken = string(secret.Data["token"])
+				} else {
+					log.Printf("couldn't get access token secret when enumerating existing deployments: %v", err)
+				}
+			}
+
 			// if we couldn't get info from the running service, fill it out as unknown
 			if di.Hostname == "" {
 				di.Hostname = "<unknown>"
@@ -194,12 +383,22 @@ func (im *InstanceManager) Init() error {
 	return nil
 }
 
-// Deploy an instance of a challenge for a team
+// returned by CreateDeployment if the team destroyed their instance too recently
+var errRecreateCooldown = errors.New("instance was destroyed too recently")
+
+// returned by operations started after chaldeploy started draining for shutdown
+var errShuttingDown = errors.New("chaldeploy is shutting down")
+
+// returned by createInstance if the namespace was already there, e.g. an old instance that's still terminating
+var errNamespaceExists = errors.New("namespace already exists")
+
+// Deploy an instance of a challenge for a team. clientIP is the IP of the team member creating the instance,
+// which is allowed to connect to it if $CHALDEPLOY_SOURCE_ALLOWLIST is set
 // Returns the connection string and error
 // ref:
 //   - https://github.com/kubernetes/client-go/blob/master/examples/in-cluster-client-configuration/main.go
 //   - https://github.com/kubernetes/client-go/blob/master/examples/create-update-delete-deployment/main.go
-func (im *InstanceManager) CreateDeployment(teamId string) (string, error) {
+func (im *InstanceManager) CreateDeployment(ctx context.Context, teamId, clientIP string) (string, error) {
 	// compute a unique identifer for this deployment
 	uniqName := strings.ToLower(fmt.Sprintf("chaldeploy-%s-%s", HashString(config.ChallengeName), strings.ReplaceAll(teamId, "-", "")))
 
@@ -212,53 +411,296 @@ func (im *InstanceManager) CreateDeployment(teamId string) (string, error) {
 	}
 	di, _ = im.Instances.LoadOrStore(teamId, di)
 
+	// keep track of the operation so it can be drained on shutdown
+	if !im.beginOp() {
+		return "", errShuttingDown
+	}
+	defer im.ops.Done()
+
 	di.mu.Lock()
 	defer di.mu.Unlock()
-	if di.State == Destroyed {
-		// get the k8s objects
-		// TODO: create the other necessary resources ref rcds
-		namespace := getNamespace(uniqName, teamId)
-		deployment := getDeployment(di.AppName, teamId)
-		service := getService(di.AppName, teamId)
+	if di.State == Destroyed || di.State == Failed {
+		if cooldownRemaining(di.LastDestroy, config.RecreateCooldown, time.Now().UTC()) > 0 {
+			return "", fmt.Errorf("%w for %s (last destroy: %s)", errRecreateCooldown, teamId, di.LastDestroy.Format("2006-01-02 15:04:05 UTC"))
+		}
 
-		// set the expiration time
-		now := time.Now().UTC()
-		expTime := now.Add(INSTANCE_RUNTIME)
-		namespace.ObjectMeta.Labels["chaldeploy.captaingee.ch/expiration-time"] = strconv.Itoa(int(expTime.Unix()))
-		di.ExpTime = &expTime
+		if err := im.createInstance(ctx, di, teamId, clientIP); err != nil {
+			// don't leave a half-created instance behind, otherwise the next create fails on the existing namespace
+			im.rollbackInstance(di, teamId, err)
 
-		// create the k8s objects
-		namespaceClient := im.Clientset.CoreV1().Namespaces()
-		if _, err := namespaceClient.Create(context.TODO(), namespace, metav1.CreateOptions{}); err != nil {
-			return "", fmt.Errorf("failed to create the namespace for %s: %v", uniqName, err)
+			return "", err
 		}
+	}
+
+	return di.GetCxn(), nil
+}
+
+// Create the k8s objects for an instance and wait for them to be ready. The caller must hold the instance's lock
+func (im *InstanceManager) createInstance(ctx context.Context, di *DeploymentInstance, teamId, clientIP string) error {
+	// get the k8s objects
+	namespace := getNamespace(di.AppName, teamId)
+
+	// set the expiration time
+	now := time.Now().UTC()
+	expTime := now.Add(INSTANCE_RUNTIME)
+	namespace.ObjectMeta.Labels["chaldeploy.captaingee.ch/expiration-time"] = strconv.Itoa(int(expTime.Unix()))
+	di.ExpTime = &expTime
+	di.Extensions = 0
+
+	// only let the team creating the instance connect to it
+	di.AllowedIPs = nil
+	if config.SourceAllowlist {
+		ip := net.ParseIP(clientIP)
+		if ip == nil {
+			return fmt.Errorf("couldn't parse client IP %s to allowlist for %s", clientIP, di.AppName)
+		}
+		di.AllowedIPs = []string{ipToCIDR(ip)}
+	}
+
+	// generate a new access token, each deployment gets a different one
+	var accessSecret *corev1.Secret
+	if config.AccessControl == "token" {
+		token, err := generateAccessToken()
+		if err != nil {
+			return fmt.Errorf("failed to generate an access token for %s: %v", di.AppName, err)
+		}
+		di.AccessToken = token
+		accessSecret = getAccessSecret(di.AppName, teamId, token)
+	}
+
+	// render the manifests before anything is created so a bad template doesn't leave a namespace behind
+	var manifestObjs []*unstructured.Unstructured
+	if im.Manifests != nil {
+		objs, err := im.Manifests.Objects(&ManifestVars{
+			AppName:     di.AppName,
+			Namespace:   di.Namespace,
+			TeamId:      teamId,
+			Flag:        config.Flag,
+			Image:       config.ChallengeImage,
+			Port:        config.ChallengePort,
+			ExpTime:     expTime,
+			AccessToken: di.AccessToken,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to render the manifests for %s: %v", di.AppName, err)
+		}
+		manifestObjs = objs
+	}
+
+	// isolate the namespace before any workloads are started in it
+	ingressPorts := []intstr.IntOrString{getService(di.AppName, teamId).Spec.Ports[0].TargetPort}
+	if manifestObjs != nil {
+		ingressPorts = getServiceTargetPorts(manifestObjs, di.AppName)
+	}
+	networkPolicy := getNetworkPolicy(di.AppName, teamId, ingressPorts)
+	resourceQuota := getResourceQuota(di.AppName, teamId)
+	limitRange := getLimitRange(di.AppName, teamId)
+
+	// create the k8s objects
+	namespaceClient := im.Clientset.CoreV1().Namespaces()
+	if _, err := namespaceClient.Create(ctx, namespace, metav1.CreateOptions{}); apierrors.IsAlreadyExists(err) {
+		return fmt.Errorf("failed to create the namespace for %s: %w", di.AppName, errNamespaceExists)
+	} else if err != nil {
+		return fmt.Errorf("failed to create the namespace for %s: %v", di.AppName, err)
+	}
+	networkPoliciesClient := im.Clientset.NetworkingV1().NetworkPolicies(di.Namespace)
+	if _, err := networkPoliciesClient.Create(ctx, networkPolicy, metav1.CreateOptions{}); err != nil {
+		return fmt.Errorf("failed to create the network policy for %s: %v", di.AppName, err)
+	}
+	resourceQuotasClient := im.Clientset.CoreV1().ResourceQuotas(di.Namespace)
+	if _, err := resourceQuotasClient.Create(ctx, resourceQuota, metav1.CreateOptions{}); err != nil {
+		return fmt.Errorf("failed to create the resource quota for %s: %v", di.AppName, err)
+	}
+	limitRangesClient := im.Clientset.CoreV1().LimitRanges(di.Namespace)
+	if _, err := limitRangesClient.Create(ctx, limitRange, metav1.CreateOptions{}); err != nil {
+		return fmt.Errorf("failed to create the limit range for %s: %v", di.AppName, err)
+	}
+	if accessSecret != nil {
+		secretsClient := im.Clientset.CoreV1().Secrets(di.Namespace)
+		if _, err := secretsClient.Create(ctx, accessSecret, metav1.CreateOptions{}); err != nil {
+			return fmt.Errorf("failed to create the access token secret for %s: %v", di.AppName, err)
+		}
+	}
+	if manifestObjs != nil {
+		for _, obj := range manifestObjs {
+			if obj.GetKind() == "Service" && obj.GetName() == di.AppName && di.AllowedIPs != nil {
+				if err := unstructured.SetNestedStringSlice(obj.Object, di.AllowedIPs, "spec", "loadBalancerSourceRanges"); err != nil {
+					return fmt.Errorf("failed to set the allowed IPs on the service for %s: %v", di.AppName, err)
+				}
+			}
+
+			if err := im.createManifestObject(ctx, di.Namespace, teamId, obj); err != nil {
+				return fmt.Errorf("failed to create %s %s for %s: %v", obj.GetKind(), obj.GetName(), di.AppName, err)
+			}
+		}
+	} else {
+		deployment := getDeployment(di.AppName, teamId)
+		service := getService(di.AppName, teamId)
+		service.Spec.LoadBalancerSourceRanges = di.AllowedIPs
+
 		deploymentsClient := im.Clientset.AppsV1().Deployments(di.Namespace)
-		if _, err := deploymentsClient.Create(context.TODO(), deployment, metav1.CreateOptions{}); err != nil {
-			return "", fmt.Errorf("failed to create the deployment for %s: %v", uniqName, err)
+		if _, err := deploymentsClient.Create(ctx, deployment, metav1.CreateOptions{}); err != nil {
+			return fmt.Errorf("failed to create the deployment for %s: %v", di.AppName, err)
 		}
 		servicesClient := im.Clientset.CoreV1().Services(di.Namespace)
-		if _, err := servicesClient.Create(context.TODO(), service, metav1.CreateOptions{}); err != nil {
-			return "", fmt.Errorf("failed to create the service for %s: %v", uniqName, err)
+		if _, err := servicesClient.Create(ctx, service, metav1.CreateOptions{}); err != nil {
+			return fmt.Errorf("failed to create the service for %s: %v", di.AppName, err)
 		}
+	}
 
-		// block until deployment is finished
-		if !di.BlockUntilDeployed(20, 6) {
-			return "", fmt.Errorf("timed out waiting for challenge to finish deploying for %s", uniqName)
-		}
+	// block until deployment is finished
+	if !di.BlockUntilDeployed(ctx, 20, 6) {
+		return fmt.Errorf("timed out waiting for challenge to finish deploying for %s", di.AppName)
+	}
 
-		// update the instance state
-		createdService, err := servicesClient.Get(context.TODO(), di.AppName, metav1.GetOptions{})
-		if err != nil {
-			return "", fmt.Errorf("failed to retrieve connection info for %s: %v", uniqName, err)
+	// update the instance state
+	servicesClient := im.Clientset.CoreV1().Services(di.Namespace)
+	createdService, err := servicesClient.Get(ctx, di.AppName, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to retrieve connection info for %s: %v", di.AppName, err)
+	} else if len(createdService.Status.LoadBalancer.Ingress) == 0 {
+		return fmt.Errorf("service for %s doesn't have a load balancer address", di.AppName)
+	} else if len(createdService.Spec.Ports) == 0 {
+		return fmt.Errorf("service for %s doesn't expose any ports", di.AppName)
+	} else {
+		// manifests and rCDS challenges pick their own ports, so use what the service actually exposes
+		di.State = Running
+		di.FailureReason = ""
+		di.Hostname = createdService.Status.LoadBalancer.Ingress[0].IP
+		di.Port = int(createdService.Spec.Ports[0].Port)
+	}
+
+	return nil
+}
+
+// Tear down a partially created instance and mark it as Failed so it can be recreated. The caller must hold the instance's lock.
+// Uses its own context, since the one for the create may already be canceled
+func (im *InstanceManager) rollbackInstance(di *DeploymentInstance, teamId string, reason error) {
+	ctx, cancel := context.WithTimeout(context.Background(), ROLLBACK_TIMEOUT)
+	defer cancel()
+
+	log.Printf("rolling back partially created instance %s: %v", di.Namespace, reason)
+
+	// everything is created in the namespace, so if this create didn't make it, there's nothing to roll back,
+	// unless it's a leftover of this team's instance that nothing else is going to clean up (e.g., an earlier rollback couldn't delete it)
+	if errors.Is(reason, errNamespaceExists) {
+		if !im.isLeftoverNamespace(ctx, di.Namespace, teamId) {
+			log.Printf("not deleting namespace %s while rolling back, it wasn't created by this deployment", di.Namespace)
 		} else {
-			di.State = Running
-			di.Hostname = createdService.Status.LoadBalancer.Ingress[0].IP
-			di.Port = config.ChallengePort
+			log.Printf("deleting leftover namespace %s while rolling back", di.Namespace)
+			im.deleteRollbackNamespace(ctx, di)
 		}
+	} else {
+		im.deleteRollbackNamespace(ctx, di)
+	}
+
+	// if the namespace is still around, the next create will fail on it and roll back again
+	di.State = Failed
+	di.FailureReason = reason.Error()
+	di.ExpTime = nil
+	di.Hostname = ""
+	di.Port = 0
+	di.AccessToken = ""
+	di.AllowedIPs = nil
+}
 
+// Delete the namespace of an instance that's being rolled back and wait for it to go away. Failures are only logged
+func (im *InstanceManager) deleteRollbackNamespace(ctx context.Context, di *DeploymentInstance) {
+	deletePolicy := metav1.DeletePropagationForeground
+	err := im.Clientset.CoreV1().Namespaces().Delete(ctx, di.Namespace, metav1.DeleteOptions{
+		PropagationPolicy: &deletePolicy,
+	})
+	if err != nil && !apierrors.IsNotFound(err) {
+		log.Printf("couldn't delete namespace %s while rolling back: %v", di.Namespace, err)
+	} else if !di.BlockUntilTerminated(ctx, 0, 6) {
+		log.Printf("took too long to delete namespace %s while rolling back", di.Namespace)
 	}
+}
 
-	return di.GetCxn(), nil
+// Check if an existing namespace was left behind by the team's instance of this challenge and isn't already being deleted
+func (im *InstanceManager) isLeftoverNamespace(ctx context.Context, name, teamId string) bool {
+	ns, err := im.Clientset.CoreV1().Namespaces().Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		if !apierrors.IsNotFound(err) {
+			log.Printf("couldn't look up namespace %s while rolling back: %v", name, err)
+		}
+		return false
+	}
+
+	return ns.Labels["chaldeploy.captaingee.ch/team-id"] == teamId &&
+		ns.Labels["chaldeploy.captaingee.ch/chal"] == HashString(config.ChallengeName) &&
+		ns.Status.Phase != corev1.NamespaceTerminating
+}
+
+// Keep track of a create or destroy so it can be drained on shutdown. The caller must call im.ops.Done() when it's finished.
+// Returns false if chaldeploy is already draining, in which case the operation shouldn't be started
+func (im *InstanceManager) beginOp() bool {
+	im.opsLock.Lock()
+	defer im.opsLock.Unlock()
+
+	if im.draining {
+		return false
+	}
+
+	im.ops.Add(1)
+	return true
+}
+
+// Wait for in-flight creates and destroys to finish. New ones are refused from here on
+// Returns true if they all finished, or false if the context was canceled first
+func (im *InstanceManager) Drain(ctx context.Context) bool {
+	im.opsLock.Lock()
+	im.draining = true
+	im.opsLock.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		im.ops.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// Create an object rendered from the manifest templates in the team's namespace.
+// Only namespaced resources are allowed, since the instance is cleaned up by deleting the namespace.
+func (im *InstanceManager) createManifestObject(ctx context.Context, namespace, teamId string, obj *unstructured.Unstructured) error {
+	gvk := obj.GroupVersionKind()
+	mapping, err := im.Mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+	if err != nil {
+		return fmt.Errorf("couldn't find the API resource for %s: %v", gvk, err)
+	}
+
+	if mapping.Scope.Name() != meta.RESTScopeNameNamespace {
+		return fmt.Errorf("%s is not a namespaced resource, can't deploy it for a team", gvk.Kind)
+	}
+
+	// force the object into the team namespace and tag it like the rest of the chaldeploy objects
+	obj.SetNamespace(namespace)
+	labels := obj.GetLabels()
+	if labels == nil {
+		labels = map[string]string{}
+	}
+	labels["app.kubernetes.io/managed-by"] = "chaldeploy"
+	labels["chaldeploy.captaingee.ch/chal"] = HashString(config.ChallengeName)
+	labels["chaldeploy.captaingee.ch/team-id"] = teamId
+	obj.SetLabels(labels)
+
+	_, err = im.DynamicClient.Resource(mapping.Resource).Namespace(namespace).Create(ctx, obj, metav1.CreateOptions{})
+	return err
+}
+
+// returned when a team uses a feature that's disabled because chaldeploy doesn't have the permissions for it
+var errFeatureDisabled = errors.New("feature is disabled")
+
+// Check if an optional feature can be used
+func (im *InstanceManager) FeatureEnabled(feature string) bool {
+	return !im.DisabledFeatures[feature]
 }
 
 // get the deployment instance for a team, if there is one.
@@ -268,92 +710,306 @@ func (im *InstanceManager) GetDeploymentInstance(teamId string) *DeploymentInsta
 	return di
 }
 
+// returned when a team doesn't have an instance (or it isn't running) for the operation
+var errNoInstance = errors.New("team doesn't have a running instance")
+
+// returned by ExtendDeployment if the instance already expired
+var errInstanceExpired = errors.New("instance already expired")
+
+// returned by ExtendDeployment if the team already extended the instance the max number of times
+var errExtensionLimit = errors.New("instance was extended too many times")
+
 // Extend the expiration time of a deployment by 1hr
 // Returns the new expiration time
-func (im *InstanceManager) ExtendDeployment(teamId string) (string, error) {
+func (im *InstanceManager) ExtendDeployment(ctx context.Context, teamId string) (string, error) {
+	if !im.FeatureEnabled(FeatureExtend) {
+		return "", errFeatureDisabled
+	}
+
 	// get a ptr to the instance
 	di, ok := im.Instances.Load(teamId)
 	if !ok || di == nil {
-		return "", fmt.Errorf("tried to extend a non-exist deployment for %s", teamId)
+		return "", fmt.Errorf("%w: tried to extend a non-exist deployment for %s", errNoInstance, teamId)
 	}
 
+	di.mu.Lock()
+	defer di.mu.Unlock()
+
 	// validate state
 	if di.State != Running {
-		return "", fmt.Errorf("tried to extend a non-running deployment for %s (current state: %s)", teamId, di.State)
+		return "", fmt.Errorf("%w: tried to extend a non-running deployment for %s (current state: %s)", errNoInstance, teamId, di.State)
 	}
 
 	if di.ExpTime.Before(time.Now().UTC()) {
-		return "", fmt.Errorf("tried to extend an already expired deployment for %s (exp time: %s)", teamId, di.GetExpTime())
+		return "", fmt.Errorf("%w: tried to extend an already expired deployment for %s (exp time: %s)", errInstanceExpired, teamId, di.GetExpTime())
 	}
 
-	// update the di instance
-	newExp := di.ExpTime.Add(INSTANCE_RUNTIME)
-	di.ExpTime = &newExp
+	if config.MaxExtensions > 0 && di.Extensions >= config.MaxExtensions {
+		return "", fmt.Errorf("%w for %s (max: %d)", errExtensionLimit, teamId, config.MaxExtensions)
+	}
 
-	// update the namespace label
+	// update the namespace labels
+	newExp := di.ExpTime.Add(INSTANCE_RUNTIME)
 	namespacesClient := im.Clientset.CoreV1().Namespaces()
-	ns, err := namespacesClient.Get(context.TODO(), di.Namespace, metav1.GetOptions{})
+	ns, err := namespacesClient.Get(ctx, di.Namespace, metav1.GetOptions{})
 	if err != nil {
 		return "", fmt.Errorf("couldn't get namespace object from k8s to extend instance for %s", teamId)
 	}
 
 	ns.ObjectMeta.Labels["chaldeploy.captaingee.ch/expiration-time"] = strconv.Itoa(int(newExp.Unix()))
-	if _, err := namespacesClient.Update(context.TODO(), ns, metav1.UpdateOptions{}); err != nil {
+	ns.ObjectMeta.Labels["chaldeploy.captaingee.ch/extensions"] = strconv.Itoa(di.Extensions + 1)
+	if _, err := namespacesClient.Update(ctx, ns, metav1.UpdateOptions{}); err != nil {
 		return "", fmt.Errorf("couldn't update namespace in k8s to extend instance for %s", teamId)
 	}
 
+	// update the di instance
+	di.ExpTime = &newExp
+	di.Extensions++
+
 	return di.GetExpTime(), nil
 }
 
-// Destroy a challenge deployment
-func (im *InstanceManager) DestroyDeployment(teamId string) error {
+// returned by AllowSourceIP if the team already allowed the max number of IPs
+var errTooManyAllowedIPs = errors.New("too many IPs are allowed to connect to the instance")
+
+// Allow another IP to connect to a deployment (e.g., a teammate's)
+// Returns the list of allowed CIDRs
+func (im *InstanceManager) AllowSourceIP(ctx context.Context, teamId, clientIP string) ([]string, error) {
+	if !im.FeatureEnabled(FeatureAllowIP) {
+		return nil, errFeatureDisabled
+	}
+
 	// get a ptr to the instance
 	di, ok := im.Instances.Load(teamId)
 	if !ok || di == nil {
-		return fmt.Errorf("tried to destroy a non-exist deployment for %s", teamId)
+		return nil, fmt.Errorf("%w: tried to allow an IP for a non-exist deployment for %s", errNoInstance, teamId)
+	}
+
+	ip := net.ParseIP(clientIP)
+	if ip == nil {
+		return nil, fmt.Errorf("tried to allow an invalid IP for %s: %s", teamId, clientIP)
+	}
+	cidr := ipToCIDR(ip)
+
+	di.mu.Lock()
+	defer di.mu.Unlock()
+
+	// validate state
+	if di.State != Running {
+		return nil, fmt.Errorf("%w: tried to allow an IP for a non-running deployment for %s (current state: %s)", errNoInstance, teamId, di.State)
+	}
+
+	if Contains(di.AllowedIPs, cidr) {
+		return di.AllowedIPs, nil
 	}
 
-	return di.DestroyInstance()
+	if len(di.AllowedIPs) >= config.MaxAllowedIps {
+		return nil, fmt.Errorf("%w for %s (max: %d)", errTooManyAllowedIPs, teamId, config.MaxAllowedIps)
+	}
+
+	// update the service, the LB picks up the new source ranges on its own
+	servicesClient := im.Clientset.CoreV1().Services(di.Namespace)
+	service, err := servicesClient.Get(ctx, di.AppName, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get service to allow an IP for %s: %v", teamId, err)
+	}
+
+	allowedIPs := append(service.Spec.LoadBalancerSourceRanges, cidr)
+	service.Spec.LoadBalancerSourceRanges = allowedIPs
+	if _, err := servicesClient.Update(ctx, service, metav1.UpdateOptions{}); err != nil {
+		return nil, fmt.Errorf("couldn't update service to allow an IP for %s: %v", teamId, err)
+	}
+
+	di.AllowedIPs = allowedIPs
+
+	return di.AllowedIPs, nil
 }
 
-func (im *InstanceManager) DestroyExpiredInstances() error {
-	var retErr error = nil
+// returned by RestartDeployment if the team restarted their instance too recently
+var errRestartCooldown = errors.New("instance was restarted too recently")
+
+// Restart the pods of a deployment, like `kubectl rollout restart`.
+// The namespace, service, and expiration time are left alone, so the team keeps their endpoint
+func (im *InstanceManager) RestartDeployment(ctx context.Context, teamId string) error {
+	if !im.FeatureEnabled(FeatureRestart) {
+		return errFeatureDisabled
+	}
+
+	// get a ptr to the instance
+	di, ok := im.Instances.Load(teamId)
+	if !ok || di == nil {
+		return fmt.Errorf("%w: tried to restart a non-exist deployment for %s", errNoInstance, teamId)
+	}
+
+	di.mu.Lock()
+	defer di.mu.Unlock()
+
+	// validate state
+	if di.State != Running {
+		return fmt.Errorf("%w: tried to restart a non-running deployment for %s (current state: %s)", errNoInstance, teamId, di.State)
+	}
 
 	now := time.Now().UTC()
+	if di.LastRestart != nil && now.Before(di.LastRestart.Add(time.Duration(config.RestartCooldown)*time.Second)) {
+		return fmt.Errorf("%w for %s (last restart: %s)", errRestartCooldown, teamId, di.LastRestart.Format("2006-01-02 15:04:05 UTC"))
+	}
+
+	// bump an annotation on the pod template of every deployment so they get rolled out again
+	deploymentsClient := im.Clientset.AppsV1().Deployments(di.Namespace)
+	deployments, err := deploymentsClient.List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("couldn't list deployments to restart instance for %s: %v", teamId, err)
+	}
 
-	im.Instances.Range(func(key string, value *DeploymentInstance) bool {
-		if value.ExpTime != nil && value.ExpTime.Before(now) {
-			if err := value.DestroyInstance(); err != nil {
-				retErr = err
-				return false
+	patch := fmt.Sprintf(`{"spec":{"template":{"metadata":{"annotations":{"kubectl.kubernetes.io/restartedAt":"%s"}}}}}`, now.Format(time.RFC3339))
+	for _, d := range deployments.Items {
+		if _, err := deploymentsClient.Patch(ctx, d.Name, types.StrategicMergePatchType, []byte(patch), metav1.PatchOptions{}); err != nil {
+			return fmt.Errorf("couldn't restart deployment %s for %s: %v", d.Name, teamId, err)
+		}
+	}
+
+	di.LastRestart = &now
+
+	return nil
+}
+
+// Destroy a challenge deployment
+func (im *InstanceManager) DestroyDeployment(ctx context.Context, teamId string) error {
+	// get a ptr to the instance
+	di, ok := im.Instances.Load(teamId)
+	if !ok || di == nil {
+		return fmt.Errorf("%w: tried to destroy a non-exist deployment for %s", errNoInstance, teamId)
+	}
+
+	destroyed, err := di.DestroyInstance(ctx)
+	if err != nil || !destroyed {
+		return err
+	}
+
+	// the reaper doesn't go through here, so only teams destroying their own instance have to wait to recreate it
+	now := time.Now().UTC()
+	di.mu.Lock()
+	di.LastDestroy = &now
+	di.mu.Unlock()
+
+	return nil
+}
+
+// Pick up changes made to instances outside of this process (e.g., with `chaldeploy instances`).
+// Instances whose namespace is gone or being deleted are marked accordingly, and expiration times are reloaded from the labels.
+// Destroying instances are marked as Destroyed once their namespace is gone, so they can be recreated.
+// Instances that are locked for an operation are skipped, they'll be picked up next time
+func (im *InstanceManager) Resync(ctx context.Context) error {
+	namespaceClient := im.Clientset.CoreV1().Namespaces()
+	cdNamespaces, err := namespaceClient.List(ctx, metav1.ListOptions{
+		LabelSelector: fmt.Sprintf("chaldeploy.captaingee.ch/managed-by=yes,chaldeploy.captaingee.ch/chal=%s", HashString(config.ChallengeName)),
+	})
+	if err != nil {
+		return fmt.Errorf("couldn't list namespaces to resync instances: %v", err)
+	}
+
+	namespaces := map[string]*corev1.Namespace{}
+	for i := range cdNamespaces.Items {
+		namespaces[cdNamespaces.Items[i].Name] = &cdNamespaces.Items[i]
+	}
+
+	im.Instances.Range(func(teamId string, di *DeploymentInstance) bool {
+		if (di.State != Running && di.State != Destroying) || !di.mu.TryLock() {
+			return true
+		}
+		defer di.mu.Unlock()
+
+		ns, ok := namespaces[di.Namespace]
+		if di.State == Destroying {
+			if !ok {
+				log.Printf("namespace %s finished terminating, marking the instance as destroyed", di.Namespace)
+				di.State = Destroyed
+			} else if ns.Status.Phase != corev1.NamespaceTerminating {
+				// the delete never went through (e.g., the k8s API was down), send it again.
+				// it's checked on the next resync, once k8s is done with it
+				log.Printf("namespace %s is still around for a destroyed instance, deleting it again", di.Namespace)
+				deletePolicy := metav1.DeletePropagationForeground
+				if err := namespaceClient.Delete(ctx, di.Namespace, metav1.DeleteOptions{PropagationPolicy: &deletePolicy}); err != nil && !apierrors.IsNotFound(err) {
+					log.Printf("couldn't delete namespace %s: %v", di.Namespace, err)
+				}
+			}
+
+			return true
+		}
+
+		if !ok {
+			log.Printf("namespace %s was deleted outside of chaldeploy, marking the instance as destroyed", di.Namespace)
+			di.State = Destroyed
+		} else if ns.Status.Phase == corev1.NamespaceTerminating {
+			log.Printf("namespace %s is being deleted outside of chaldeploy, marking the instance as destroying", di.Namespace)
+			di.State = Destroying
+		} else if expTimeInt, err := strconv.Atoi(ns.Labels["chaldeploy.captaingee.ch/expiration-time"]); err == nil {
+			if expTime := time.Unix(int64(expTimeInt), 0).UTC(); di.ExpTime == nil || !expTime.Equal(*di.ExpTime) {
+				di.ExpTime = &expTime
 			}
 		}
 
 		return true
 	})
 
-	return retErr
+	return nil
 }
 
-// destroy a deployment
-func (di *DeploymentInstance) DestroyInstance() error {
-	if di.State != Running {
-		// deployment isn't running, probably already being destroyed, don't try to destroy it again
-		return nil
+// destroy a deployment. Returns false if it wasn't running, so there was nothing to destroy
+func (di *DeploymentInstance) DestroyInstance(ctx context.Context) (bool, error) {
+	// keep track of the operation so it can be drained on shutdown
+	if !im.beginOp() {
+		return false, errShuttingDown
 	}
+	defer im.ops.Done()
 
 	// acquire the lock on the deployment and mark it as being destroyed
 	di.mu.Lock()
+	if di.State != Running {
+		// deployment isn't running, probably already being destroyed, don't try to destroy it again
+		di.mu.Unlock()
+		return false, nil
+	}
 	di.State = Destroying
 	di.mu.Unlock()
 
+	return true, di.deleteNamespace(ctx)
+}
+
+// Retry destroying a deployment that got stuck in the Destroying state
+func (di *DeploymentInstance) RetryDestroy(ctx context.Context) error {
+	if !im.beginOp() {
+		return errShuttingDown
+	}
+	defer im.ops.Done()
+
+	di.mu.Lock()
+	destroying := di.State == Destroying
+	di.mu.Unlock()
+
+	if !destroying {
+		return nil
+	}
+
+	return di.deleteNamespace(ctx)
+}
+
+// Delete the namespace for a deployment and wait for it to go away.
+// The deployment is left in the Destroying state on failure so it can be retried
+func (di *DeploymentInstance) deleteNamespace(ctx context.Context) error {
 	// init client
 	client := im.Clientset.CoreV1().Namespaces()
 
-	// check if the namespace exists, return if it doesn't
-	if namespace, err := client.Get(context.TODO(), di.AppName, metav1.GetOptions{}); err != nil || namespace == nil {
-		// TODO: investigate how err can be set (e.g., failed to lookup vs successfully looked up and confirmed non-existent)
-		return nil
+	// check if the namespace exists, nothing to delete if it doesn't
+	if _, err := client.Get(ctx, di.Namespace, metav1.GetOptions{}); err != nil {
+		if apierrors.IsNotFound(err) {
+			di.mu.Lock()
+			di.State = Destroyed
+			di.mu.Unlock()
+			return nil
+		}
+
+		return fmt.Errorf("failed to look up namespace %s: %v", di.Namespace, err)
 	}
 
 	// delete resources
@@ -361,37 +1017,36 @@ func (di *DeploymentInstance) DestroyInstance() error {
 	defer di.mu.Unlock()
 	deletePolicy := metav1.DeletePropagationForeground
 
-	if err := client.Delete(context.TODO(), di.Namespace, metav1.DeleteOptions{
+	if err := client.Delete(ctx, di.Namespace, metav1.DeleteOptions{
 		PropagationPolicy: &deletePolicy,
-	}); err != nil {
+	}); err != nil && !apierrors.IsNotFound(err) {
 		return fmt.Errorf("failed to delete namespace %s: %v", di.Namespace, err)
 	}
 
-	if !di.BlockUntilTerminated(20, 6) {
+	if !di.BlockUntilTerminated(ctx, 20, 6) {
 		return fmt.Errorf("failed to delete namespace %s: took too long to delete resource from k8s", di.Namespace)
 	}
 
 	di.State = Destroyed
 
 	return nil
-
 }
 
-// Expontential backoff spin until the deployment service has an external IP assigned
+// Expontential backoff spin until the deployment service has an external IP assigned and every deployment is ready
 // Returns true if blocked until successful deployment, otherwise false.
-func (di *DeploymentInstance) BlockUntilDeployed(wait int, maxTries int) bool {
+func (di *DeploymentInstance) BlockUntilDeployed(ctx context.Context, wait int, maxTries int) bool {
 	client := im.Clientset.CoreV1().Services(di.Namespace)
 	counter := 0
 
-	if wait > 0 {
-		time.Sleep(time.Duration(wait) * time.Second)
+	if wait > 0 && !sleepCtx(ctx, time.Duration(wait)*time.Second) {
+		return false
 	}
 
 	for {
-		service, err := client.Get(context.TODO(), di.AppName, metav1.GetOptions{})
+		service, err := client.Get(ctx, di.AppName, metav1.GetOptions{})
 		if err == nil {
 			if len(service.Status.LoadBalancer.Ingress) > 0 {
-				if service.Status.LoadBalancer.Ingress[0].IP != "" {
+				if service.Status.LoadBalancer.Ingress[0].IP != "" && di.IsReady(ctx) {
 					return true
 				}
 			}
@@ -402,24 +1057,81 @@ func (di *DeploymentInstance) BlockUntilDeployed(wait int, maxTries int) bool {
 			return false
 		}
 
-		time.Sleep(time.Duration(math.Pow(2, float64(counter))) * time.Second)
+		if !sleepCtx(ctx, time.Duration(math.Pow(2, float64(counter)))*time.Second) {
+			return false
+		}
+	}
+}
+
+// Check if every deployment in the instance's namespace has all of its replicas ready
+func (di *DeploymentInstance) IsReady(ctx context.Context) bool {
+	deployments, err := im.Clientset.AppsV1().Deployments(di.Namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return false
+	}
+
+	for _, d := range deployments.Items {
+		replicas := int32(1)
+		if d.Spec.Replicas != nil {
+			replicas = *d.Spec.Replicas
+		}
+
+		if d.Status.ReadyReplicas < replicas {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Get the health of the pods in the instance's namespace:
+//   - "crashing" if a container is in CrashLoopBackOff or can't pull its image
+//   - "starting" if a pod isn't ready yet
+//   - "ready" otherwise
+//   - "unknown" if the pods couldn't be retrieved
+func (di *DeploymentInstance) GetHealth(ctx context.Context) string {
+	if !im.FeatureEnabled(FeatureCrashDetection) {
+		return "unknown"
+	}
+
+	pods, err := im.Clientset.CoreV1().Pods(di.Namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		log.Printf("couldn't list pods to get health for %s: %v", di.Namespace, err)
+		return "unknown"
+	}
+
+	health := "ready"
+	for _, p := range pods.Items {
+		for _, cs := range p.Status.ContainerStatuses {
+			if cs.State.Waiting != nil && Contains([]string{"CrashLoopBackOff", "ImagePullBackOff", "ErrImagePull"}, cs.State.Waiting.Reason) {
+				return "crashing"
+			}
+		}
+
+		for _, c := range p.Status.Conditions {
+			if c.Type == corev1.PodReady && c.Status != corev1.ConditionTrue {
+				health = "starting"
+			}
+		}
 	}
+
+	return health
 }
 
 // Exponential backoff spin until the deployment is terminated.
 // Returns true if blocked until successful deletion, otherwise false.
-func (di *DeploymentInstance) BlockUntilTerminated(wait int, maxTries int) bool {
+func (di *DeploymentInstance) BlockUntilTerminated(ctx context.Context, wait int, maxTries int) bool {
 	client := im.Clientset.CoreV1().Namespaces()
 	counter := 0
 
-	if wait > 0 {
-		time.Sleep(time.Duration(wait) * time.Second)
+	if wait > 0 && !sleepCtx(ctx, time.Duration(wait)*time.Second) {
+		return false
 	}
 
 	for {
 		// namespace won't be deleted until all of the resources contained within it are terminated
 		// wait for the ns to disappear
-		_, err := client.Get(context.TODO(), di.Namespace, metav1.GetOptions{})
+		_, err := client.Get(ctx, di.Namespace, metav1.GetOptions{})
 		if err != nil && strings.Contains(err.Error(), " not found") {
 			return true
 		}
@@ -429,17 +1141,27 @@ func (di *DeploymentInstance) BlockUntilTerminated(wait int, maxTries int) bool
 			return false
 		}
 
-		time.Sleep(time.Duration(math.Pow(2, float64(counter))) * time.Second)
+		if !sleepCtx(ctx, time.Duration(math.Pow(2, float64(counter)))*time.Second) {
+			return false
+		}
 	}
 }
 
 // Get a human readable string for the expiration time of a deployment
 func (di *DeploymentInstance) GetExpTime() string {
-	if di.ExpTime == nil {
+	return formatExpTime(di.ExpTime)
+}
+
+func (s InstanceSnapshot) GetExpTime() string {
+	return formatExpTime(s.ExpTime)
+}
+
+func formatExpTime(expTime *time.Time) string {
+	if expTime == nil {
 		return "<unknown>"
 	}
 
-	return di.ExpTime.Format("2006-01-02 15:04:05 UTC")
+	return expTime.Format("2006-01-02 15:04:05 UTC")
 }
 
 /////////////////////////////////
@@ -473,6 +1195,12 @@ func getNamespace(name, teamId string) *corev1.Namespace {
 				"chaldeploy.captaingee.ch/chal":       HashString(config.ChallengeName),
 				"chaldeploy.captaingee.ch/team-id":    teamId,
 				"chaldeploy.captaingee.ch/managed-by": "yes",
+				"pod-security.kubernetes.io/enforce":  config.PodSecurity,
+				"pod-security.kubernetes.io/warn":     config.PodSecurity,
+			},
+			Annotations: map[string]string{
+				// the label only has the hash, keep the name around for `chaldeploy instances`
+				"chaldeploy.captaingee.ch/chal-name": config.ChallengeName,
 			},
 		},
 	}
@@ -484,7 +1212,7 @@ func getDeployment(appName, teamId string) *appsv1.Deployment {
 
 	b := false
 
-	return &appsv1.Deployment{
+	deployment := &appsv1.Deployment{
 		ObjectMeta: metav1.ObjectMeta{
 			Name: appName,
 			Labels: map[string]string{
@@ -505,7 +1233,7 @@ func getDeployment(appName, teamId string) *appsv1.Deployment {
 						"chaldeploy.captaingee.ch/team-id": teamId,
 					},
 				},
-				Spec: corev1.PodSpec{
+				Spec: hardenPodSpec(corev1.PodSpec{
 					AutomountServiceAccountToken: &b,
 					Containers: []corev1.Container{
 						{
@@ -513,24 +1241,106 @@ func getDeployment(appName, teamId string) *appsv1.Deployment {
 							Image: config.ChallengeImage,
 							Ports: []corev1.ContainerPort{{ContainerPort: int32(config.ChallengePort)}},
 
-							// Resources: corev1.ResourceRequirements{
-							// 	Limits: corev1.ResourceList{
-							// 		corev1.ResourceCPU:    resource.MustParse("500m"), // TODO: configify these
-							// 		corev1.ResourceMemory: resource.MustParse("256Mi"),
-							// 	},
-							// },
+							ReadinessProbe: getProbe(config.ChallengePort, false),
+							LivenessProbe:  getProbe(config.ChallengePort, true),
+
+							// resource limits are set by the namespace LimitRange
 						},
 					},
-				},
+				}),
 			},
 		},
 	}
+
+	if config.AccessControl == "token" {
+		addGateway(&deployment.Spec.Template.Spec, appName, [][2]int{{config.GatewayPort, config.ChallengePort}})
+	}
+
+	return deployment
+}
+
+// get the probe for the challenge container, as configured by $CHALDEPLOY_PROBE.
+// Returns nil if probes are disabled
+func getProbe(port int, liveness bool) *corev1.Probe {
+	probe := &corev1.Probe{
+		PeriodSeconds:    5,
+		FailureThreshold: 3,
+	}
+
+	// give the challenge a bit to start up before it gets killed
+	if liveness {
+		probe.InitialDelaySeconds = 10
+		probe.PeriodSeconds = 10
+	}
+
+	switch {
+	case config.Probe == "tcp":
+		probe.TCPSocket = &corev1.TCPSocketAction{Port: intstr.FromInt(port)}
+	case strings.HasPrefix(config.Probe, "http:"):
+		probe.HTTPGet = &corev1.HTTPGetAction{Path: strings.TrimPrefix(config.Probe, "http:"), Port: intstr.FromInt(port)}
+	case strings.HasPrefix(config.Probe, "exec:"):
+		probe.Exec = &corev1.ExecAction{Command: strings.Fields(strings.TrimPrefix(config.Probe, "exec:"))}
+	default:
+		return nil
+	}
+
+	return probe
+}
+
+// Apply the pod and container security settings to a pod spec.
+// Everything is locked down unless the challenge opts out with the security env vars
+func hardenPodSpec(spec corev1.PodSpec) corev1.PodSpec {
+	runAsNonRoot := !config.AllowRoot
+	allowPrivilegeEscalation := config.AllowPrivilegeEscalation
+	readOnlyRootFilesystem := !config.WritableRootfs
+
+	spec.SecurityContext = &corev1.PodSecurityContext{
+		RunAsNonRoot: &runAsNonRoot,
+	}
+
+	if config.RunAsUser != 0 {
+		uid := int64(config.RunAsUser)
+		spec.SecurityContext.RunAsUser = &uid
+	}
+
+	if strings.HasPrefix(config.SeccompProfile, "Localhost/") {
+		localhostProfile := strings.TrimPrefix(config.SeccompProfile, "Localhost/")
+		spec.SecurityContext.SeccompProfile = &corev1.SeccompProfile{Type: corev1.SeccompProfileTypeLocalhost, LocalhostProfile: &localhostProfile}
+	} else {
+		spec.SecurityContext.SeccompProfile = &corev1.SeccompProfile{Type: corev1.SeccompProfileType(config.SeccompProfile)}
+	}
+
+	if config.RuntimeClass != "" {
+		runtimeClass := config.RuntimeClass
+		spec.RuntimeClassName = &runtimeClass
+	}
+
+	capabilities := &corev1.Capabilities{Drop: []corev1.Capability{"ALL"}}
+	for _, cap := range config.getCapabilities() {
+		capabilities.Add = append(capabilities.Add, corev1.Capability(cap))
+	}
+
+	for i := range spec.Containers {
+		spec.Containers[i].SecurityContext = &corev1.SecurityContext{
+			AllowPrivilegeEscalation: &allowPrivilegeEscalation,
+			ReadOnlyRootFilesystem:   &readOnlyRootFilesystem,
+			Capabilities:             capabilities,
+		}
+	}
+
+	return spec
 }
 
 // get the service struct for the target app
 func getService(appName, teamId string) *corev1.Service {
 	selector := getSelector(appName, teamId)
 
+	// send traffic through the gateway if connections need an access token
+	targetPort := config.ChallengePort
+	if config.AccessControl == "token" {
+		targetPort = config.GatewayPort
+	}
+
 	return &corev1.Service{
 		ObjectMeta: metav1.ObjectMeta{
 			Name: appName,
@@ -543,7 +1353,7 @@ func getService(appName, teamId string) *corev1.Service {
 		},
 		Spec: corev1.ServiceSpec{
 			Ports: []corev1.ServicePort{
-				{Port: int32(config.ChallengePort), TargetPort: intstr.FromInt(config.ChallengePort), Protocol: corev1.ProtocolTCP},
+				{Port: int32(config.ChallengePort), TargetPort: intstr.FromInt(targetPort), Protocol: corev1.ProtocolTCP},
 			},
 			Selector: selector.MatchLabels,
 			Type:     corev1.ServiceTypeLoadBalancer,
@@ -551,6 +1361,216 @@ func getService(appName, teamId string) *corev1.Service {
 	}
 }
 
+// get the name of the secret holding an instance's access token
+func getAccessSecretName(appName string) string {
+	return appName + "-access"
+}
+
+// get the secret struct holding an instance's access token
+func getAccessSecret(appName, teamId, token string) *corev1.Secret {
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: getAccessSecretName(appName),
+			Labels: map[string]string{
+				"app":                              appName,
+				"app.kubernetes.io/managed-by":     "chaldeploy",
+				"chaldeploy.captaingee.ch/chal":    HashString(config.ChallengeName),
+				"chaldeploy.captaingee.ch/team-id": teamId,
+			},
+		},
+		Type:       corev1.SecretTypeOpaque,
+		StringData: map[string]string{"token": token},
+	}
+}
+
+// Add the access token gateway sidecar to a pod spec. ports is a list of {listen port, challenge port}.
+// The sidecar has its own locked down security context, since it's chaldeploy code and never needs the challenge's opt-outs
+func addGateway(spec *corev1.PodSpec, appName string, ports [][2]int) {
+	t := true
+	f := false
+	uid := int64(65534)
+
+	mappings := []string{}
+	containerPorts := []corev1.ContainerPort{}
+	for _, p := range ports {
+		mappings = append(mappings, fmt.Sprintf("%d:%d", p[0], p[1]))
+		containerPorts = append(containerPorts, corev1.ContainerPort{ContainerPort: int32(p[0])})
+	}
+
+	spec.Containers = append(spec.Containers, corev1.Container{
+		Name:  "chaldeploy-gateway",
+		Image: config.GatewayImage,
+		Args:  []string{"gateway"},
+		Ports: containerPorts,
+		Env: []corev1.EnvVar{
+			{Name: "CHALDEPLOY_GATEWAY_PORTS", Value: strings.Join(mappings, ",")},
+			{
+				Name: "CHALDEPLOY_GATEWAY_TOKEN",
+				ValueFrom: &corev1.EnvVarSource{
+					SecretKeyRef: &corev1.SecretKeySelector{
+						LocalObjectReference: corev1.LocalObjectReference{Name: getAccessSecretName(appName)},
+						Key:                  "token",
+					},
+				},
+			},
+		},
+		Resources: corev1.ResourceRequirements{
+			Limits: corev1.ResourceList{
+				corev1.ResourceCPU:    resource.MustParse("100m"),
+				corev1.ResourceMemory: resource.MustParse("64Mi"),
+			},
+		},
+		SecurityContext: &corev1.SecurityContext{
+			RunAsNonRoot:             &t,
+			RunAsUser:                &uid,
+			AllowPrivilegeEscalation: &f,
+			ReadOnlyRootFilesystem:   &t,
+			Capabilities:             &corev1.Capabilities{Drop: []corev1.Capability{"ALL"}},
+		},
+	})
+}
+
+// get the resource quota struct for the namespace, caps the total resources an instance can use
+func getResourceQuota(name, teamId string) *corev1.ResourceQuota {
+	return &corev1.ResourceQuota{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   name,
+			Labels: getNamespace(name, teamId).Labels,
+		},
+		Spec: corev1.ResourceQuotaSpec{
+			Hard: corev1.ResourceList{
+				corev1.ResourcePods:                   *resource.NewQuantity(int64(config.QuotaPods), resource.DecimalSI),
+				corev1.ResourceLimitsCPU:              resource.MustParse(config.QuotaCpu),
+				corev1.ResourceLimitsMemory:           resource.MustParse(config.QuotaMemory),
+				corev1.ResourceServices:               *resource.NewQuantity(int64(config.QuotaServices), resource.DecimalSI),
+				corev1.ResourcePersistentVolumeClaims: *resource.NewQuantity(int64(config.QuotaPvcs), resource.DecimalSI),
+			},
+		},
+	}
+}
+
+// get the limit range struct for the namespace.
+// The quota on limits requires every container to have one, so this fills them in for containers that don't
+func getLimitRange(name, teamId string) *corev1.LimitRange {
+	return &corev1.LimitRange{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   name,
+			Labels: getNamespace(name, teamId).Labels,
+		},
+		Spec: corev1.LimitRangeSpec{
+			Limits: []corev1.LimitRangeItem{
+				{
+					Type: corev1.LimitTypeContainer,
+					Default: corev1.ResourceList{
+						corev1.ResourceCPU:    resource.MustParse(config.ContainerCpu),
+						corev1.ResourceMemory: resource.MustParse(config.ContainerMemory),
+					},
+				},
+			},
+		},
+	}
+}
+
+// get the network policy struct for the namespace.
+// Denies everything by default, other than traffic between pods in the namespace, ingress on the exposed
+// ports, and the egress allowed by $CHALDEPLOY_EGRESS
+func getNetworkPolicy(appName, teamId string, ingressPorts []intstr.IntOrString) *networkingv1.NetworkPolicy {
+	tcp := corev1.ProtocolTCP
+	udp := corev1.ProtocolUDP
+	dnsPort := intstr.FromInt(53)
+
+	// pods in the namespace can always talk to each other (e.g., app -> db)
+	sameNamespace := []networkingv1.NetworkPolicyPeer{{PodSelector: &metav1.LabelSelector{}}}
+
+	ingress := []networkingv1.NetworkPolicyIngressRule{{From: sameNamespace}}
+
+	// a rule without ports allows every port, so only add it if there's something exposed
+	if len(ingressPorts) > 0 {
+		ingressRule := networkingv1.NetworkPolicyIngressRule{}
+		for i := range ingressPorts {
+			ingressRule.Ports = append(ingressRule.Ports, networkingv1.NetworkPolicyPort{Protocol: &tcp, Port: &ingressPorts[i]})
+		}
+		ingress = append(ingress, ingressRule)
+	}
+
+	egress := []networkingv1.NetworkPolicyEgressRule{{To: sameNamespace}}
+
+	if config.Egress == "dns" || config.Egress == "internet" {
+		egress = append(egress, networkingv1.NetworkPolicyEgressRule{
+			To: []networkingv1.NetworkPolicyPeer{{
+				NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"kubernetes.io/metadata.name": "kube-system"}},
+			}},
+			Ports: []networkingv1.NetworkPolicyPort{{Protocol: &udp, Port: &dnsPort}, {Protocol: &tcp, Port: &dnsPort}},
+		})
+	}
+
+	if config.Egress == "internet" {
+		// public internet only, keep instances off of the cluster/VPC network and the metadata server
+		egress = append(egress, networkingv1.NetworkPolicyEgressRule{
+			To: []networkingv1.NetworkPolicyPeer{{
+				IPBlock: &networkingv1.IPBlock{
+					CIDR:   "0.0.0.0/0",
+					Except: []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "100.64.0.0/10", "169.254.0.0/16"},
+				},
+			}},
+		})
+	}
+
+	return &networkingv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: appName,
+			Labels: map[string]string{
+				"app":                              appName,
+				"app.kubernetes.io/managed-by":     "chaldeploy",
+				"chaldeploy.captaingee.ch/chal":    HashString(config.ChallengeName),
+				"chaldeploy.captaingee.ch/team-id": teamId,
+			},
+		},
+		Spec: networkingv1.NetworkPolicySpec{
+			PodSelector: metav1.LabelSelector{},
+			PolicyTypes: []networkingv1.PolicyType{networkingv1.PolicyTypeIngress, networkingv1.PolicyTypeEgress},
+			Ingress:     ingress,
+			Egress:      egress,
+		},
+	}
+}
+
+// get the ports on the pods that the exposed service sends traffic to
+func getServiceTargetPorts(objs []*unstructured.Unstructured, appName string) []intstr.IntOrString {
+	ports := []intstr.IntOrString{}
+
+	for _, o := range objs {
+		if o.GetKind() != "Service" || o.GetName() != appName {
+			continue
+		}
+
+		servicePorts, _, _ := unstructured.NestedSlice(o.Object, "spec", "ports")
+		for _, sp := range servicePorts {
+			spMap, ok := sp.(map[string]interface{})
+			if !ok {
+				continue
+			}
+
+			// the target port defaults to the service port
+			target, ok := spMap["targetPort"]
+			if !ok {
+				target = spMap["port"]
+			}
+
+			switch t := target.(type) {
+			case int64:
+				ports = append(ports, intstr.FromInt(int(t)))
+			case float64:
+				ports = append(ports, intstr.FromInt(int(t)))
+			case string:
+				ports = append(ports, intstr.FromString(t))
+			}
+		}
+	}
+
+	return ports
+}
+
 // Identify the proper source for the cluster config and load it
 // Load order:
 //   - $CHALDEPLOY_K8SCONFIG
@@ -562,7 +1582,7 @@ func getConfigForCluster() (*rest.Config, error) {
 		log.Printf("using k8s config path from env var: %s", config.K8sConfigPath)
 
 		// check if it exists
-		if _, err := os.Stat(config.K8sConfigPath); os.IsExist(err) {
+		if _, err := os.Stat(config.K8sConfigPath); err == nil {
 			// file exists, try to use it
 			k8sConfig, err := clientcmd.BuildConfigFromFlags("", config.K8sConfigPath)
 			if err != nil {
@@ -575,7 +1595,7 @@ func getConfigForCluster() (*rest.Config, error) {
 		}
 	} else {
 		// no path was specified, try an injected service account
-		if _, err := os.Stat("/var/run/secrets/kubernetes.io/serviceaccount"); os.IsExist(err) {
+		if _, err := os.Stat("/var/run/secrets/kubernetes.io/serviceaccount"); err == nil {
 			log.Println("found a service account, using k8s config from it")
 
 			// ref: https://github.com/kubernetes/client-go/blob/master/examples/in-cluster-client-configuration/main.go#L41
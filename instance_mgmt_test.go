@@ -1,12 +1,195 @@
 package main
 
 import (
+	"context"
+	"fmt"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes/fake"
 )
 
 func TestImageName(t *testing.T) {
 	assert.Equal(t, "test-nc", getImageName("captaingeech/test-nc:latest"))
 	assert.Equal(t, "ubuntu", getImageName("library.docker.io/_/ubuntu:18.04"))
 }
+
+func TestNetworkPolicy(t *testing.T) {
+	config = &Config{ChallengeName: "test chal name", ChallengePort: 31337, Egress: "none"}
+	defer func() { config = nil }()
+
+	np := getNetworkPolicy("chaldeploy-abc-team", "team", []intstr.IntOrString{intstr.FromInt(31337)})
+	assert.Len(t, np.Spec.Ingress, 2)
+	assert.Equal(t, 31337, np.Spec.Ingress[1].Ports[0].Port.IntValue())
+	assert.Len(t, np.Spec.Egress, 1)
+
+	config.Egress = "dns"
+	np = getNetworkPolicy("chaldeploy-abc-team", "team", []intstr.IntOrString{intstr.FromInt(31337)})
+	assert.Len(t, np.Spec.Egress, 2)
+
+	config.Egress = "internet"
+	np = getNetworkPolicy("chaldeploy-abc-team", "team", nil)
+	assert.Len(t, np.Spec.Ingress, 1)
+	assert.Len(t, np.Spec.Egress, 3)
+	assert.Equal(t, "0.0.0.0/0", np.Spec.Egress[2].To[0].IPBlock.CIDR)
+}
+
+func TestServiceTargetPorts(t *testing.T) {
+	config = &Config{SeccompProfile: "RuntimeDefault"}
+	defer func() { config = nil }()
+
+	rc, err := loadRcdsChallenge(writeRcdsChallenge(t, testRcdsChallenge))
+	assert.Nil(t, err)
+
+	objs, err := rc.Objects(&ManifestVars{AppName: "chaldeploy-abc-team"})
+	assert.Nil(t, err)
+
+	assert.Equal(t, []intstr.IntOrString{intstr.FromInt(8080)}, getServiceTargetPorts(objs, "chaldeploy-abc-team"))
+}
+
+func TestResourceQuota(t *testing.T) {
+	config = &Config{ChallengeName: "test chal name", QuotaPods: 3, QuotaCpu: "1", QuotaMemory: "1Gi", QuotaServices: 2, ContainerCpu: "250m", ContainerMemory: "128Mi"}
+	defer func() { config = nil }()
+
+	rq := getResourceQuota("chaldeploy-abc-team", "team")
+	assert.Equal(t, "team", rq.Labels["chaldeploy.captaingee.ch/team-id"])
+	assert.Equal(t, int64(3), rq.Spec.Hard.Pods().Value())
+	assert.Equal(t, "1Gi", rq.Spec.Hard.Name(corev1.ResourceLimitsMemory, resource.BinarySI).String())
+	assert.Equal(t, int64(0), rq.Spec.Hard.Name(corev1.ResourcePersistentVolumeClaims, resource.DecimalSI).Value())
+
+	lr := getLimitRange("chaldeploy-abc-team", "team")
+	assert.Equal(t, "250m", lr.Spec.Limits[0].Default.Cpu().String())
+}
+
+func TestHardenPodSpec(t *testing.T) {
+	config = &Config{SeccompProfile: "RuntimeDefault"}
+	defer func() { config = nil }()
+
+	spec := hardenPodSpec(corev1.PodSpec{Containers: []corev1.Container{{Name: "a"}, {Name: "b"}}})
+	assert.True(t, *spec.SecurityContext.RunAsNonRoot)
+	assert.Nil(t, spec.SecurityContext.RunAsUser)
+	assert.Equal(t, corev1.SeccompProfileTypeRuntimeDefault, spec.SecurityContext.SeccompProfile.Type)
+	assert.Nil(t, spec.RuntimeClassName)
+	for _, c := range spec.Containers {
+		assert.False(t, *c.SecurityContext.AllowPrivilegeEscalation)
+		assert.True(t, *c.SecurityContext.ReadOnlyRootFilesystem)
+		assert.Equal(t, []corev1.Capability{"ALL"}, c.SecurityContext.Capabilities.Drop)
+		assert.Empty(t, c.SecurityContext.Capabilities.Add)
+	}
+
+	// pwn challenge that needs ptrace
+	config = &Config{AllowRoot: true, WritableRootfs: true, Capabilities: "sys_ptrace", SeccompProfile: "Unconfined", RuntimeClass: "gvisor", RunAsUser: 1000}
+	spec = hardenPodSpec(corev1.PodSpec{Containers: []corev1.Container{{Name: "a"}}})
+	assert.False(t, *spec.SecurityContext.RunAsNonRoot)
+	assert.Equal(t, int64(1000), *spec.SecurityContext.RunAsUser)
+	assert.Equal(t, corev1.SeccompProfileTypeUnconfined, spec.SecurityContext.SeccompProfile.Type)
+	assert.Equal(t, "gvisor", *spec.RuntimeClassName)
+	assert.False(t, *spec.Containers[0].SecurityContext.ReadOnlyRootFilesystem)
+	assert.Equal(t, []corev1.Capability{"SYS_PTRACE"}, spec.Containers[0].SecurityContext.Capabilities.Add)
+}
+
+func TestProbe(t *testing.T) {
+	config = &Config{Probe: "tcp"}
+	defer func() { config = nil }()
+
+	p := getProbe(31337, false)
+	assert.Equal(t, 31337, p.TCPSocket.Port.IntValue())
+	assert.Equal(t, int32(0), p.InitialDelaySeconds)
+	assert.Equal(t, int32(10), getProbe(31337, true).InitialDelaySeconds)
+
+	config.Probe = "http:/healthz"
+	p = getProbe(8080, false)
+	assert.Equal(t, "/healthz", p.HTTPGet.Path)
+	assert.Nil(t, p.TCPSocket)
+
+	config.Probe = "exec:cat /tmp/ready"
+	assert.Equal(t, []string{"cat", "/tmp/ready"}, getProbe(8080, false).Exec.Command)
+
+	config.Probe = "none"
+	assert.Nil(t, getProbe(8080, false))
+}
+
+func TestGatewaySidecar(t *testing.T) {
+	config = &Config{ChallengeName: "test chal name", ChallengeImage: "captaingeech/test-nc:latest", ChallengePort: 31337, SeccompProfile: "RuntimeDefault", AccessControl: "none", GatewayImage: "chaldeploy:latest", GatewayPort: 31336}
+	defer func() { config = nil }()
+
+	assert.Len(t, getDeployment("chaldeploy-abc-team", "team").Spec.Template.Spec.Containers, 1)
+	assert.Equal(t, 31337, getService("chaldeploy-abc-team", "team").Spec.Ports[0].TargetPort.IntValue())
+
+	config.AccessControl = "token"
+	containers := getDeployment("chaldeploy-abc-team", "team").Spec.Template.Spec.Containers
+	assert.Len(t, containers, 2)
+	assert.Equal(t, "chaldeploy:latest", containers[1].Image)
+	assert.Equal(t, "31336:31337", containers[1].Env[0].Value)
+	assert.Equal(t, "chaldeploy-abc-team-access", containers[1].Env[1].ValueFrom.SecretKeyRef.Name)
+	assert.Equal(t, 31336, getService("chaldeploy-abc-team", "team").Spec.Ports[0].TargetPort.IntValue())
+}
+
+func TestRollbackExistingNamespace(t *testing.T) {
+	config = &Config{ChallengeName: "pwn1"}
+	expTime := time.Now().UTC().Add(time.Hour)
+	terminating := testInstanceNamespace("chaldeploy-a-team2", "pwn1", "team2", expTime)
+	terminating.Status.Phase = corev1.NamespaceTerminating
+	im = &InstanceManager{Clientset: fake.NewSimpleClientset(
+		testInstanceNamespace("chaldeploy-a-team1", "pwn1", "team1", expTime),
+		terminating,
+		testInstanceNamespace("chaldeploy-a-team3", "web1", "team3", expTime),
+	)}
+	defer func() { config, im = nil, nil }()
+
+	rollback := func(name, teamId string) bool {
+		di := &DeploymentInstance{AppName: name, Namespace: name, State: Destroyed, mu: &sync.Mutex{}}
+		im.rollbackInstance(di, teamId, fmt.Errorf("failed to create the namespace for %s: %w", name, errNamespaceExists))
+		assert.Equal(t, Failed, di.State)
+
+		_, err := im.Clientset.CoreV1().Namespaces().Get(context.Background(), name, metav1.GetOptions{})
+		return err == nil
+	}
+
+	// a leftover of the team's instance is cleaned up so the next create can go through
+	assert.False(t, rollback("chaldeploy-a-team1", "team1"))
+
+	// namespaces that are already terminating or belong to something else are left alone
+	assert.True(t, rollback("chaldeploy-a-team2", "team2"))
+	assert.True(t, rollback("chaldeploy-a-team3", "team3"))
+}
+
+func TestDrainRefusesNewOperations(t *testing.T) {
+	im = &InstanceManager{}
+	defer func() { im = nil }()
+
+	assert.True(t, im.beginOp())
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.False(t, im.Drain(ctx))
+
+	// nothing new is started once draining, the in-flight one still counts
+	assert.False(t, im.beginOp())
+	di := &DeploymentInstance{State: Running, mu: &sync.Mutex{}}
+	_, err := di.DestroyInstance(context.Background())
+	assert.ErrorIs(t, err, errShuttingDown)
+	assert.Equal(t, Running, di.State)
+
+	im.ops.Done()
+	assert.True(t, im.Drain(context.Background()))
+}
+
+func TestSnapshot(t *testing.T) {
+	di := &DeploymentInstance{State: Running, Hostname: "10.0.0.1", Port: 1337, AllowedIPs: []string{"1.2.3.4/32"}, mu: &sync.Mutex{}}
+	snap := di.Snapshot()
+	assert.Equal(t, "10.0.0.1:1337", snap.GetCxn())
+
+	// changes to the instance don't show up in the copy
+	di.mu.Lock()
+	di.State = Destroying
+	di.AllowedIPs[0] = "5.6.7.8/32"
+	di.mu.Unlock()
+	assert.Equal(t, Running, snap.State)
+	assert.Equal(t, []string{"1.2.3.4/32"}, snap.AllowedIPs)
+}
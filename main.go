@@ -1,8 +1,14 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"io/fs"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -11,14 +17,24 @@ import (
 
 // globals
 var config *Config = nil
-var store *sessions.CookieStore = nil
+var store *SessionStore = nil
 var im *InstanceManager = nil
+var reaper *Reaper = nil
+var rateLimits *RateLimits = nil
+
+// templates and static files, the built-in ones unless they're overridden
+var assets fs.FS = embeddedAssets
+
+// context for instance operations started by requests. operations outlive the request that started them so a
+// client disconnecting doesn't leave a half-created instance, but get canceled if they don't finish draining on shutdown
+var opCtx context.Context = nil
 
 // Log the incoming requests
 func loggingMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// don't log healthcheck b/c i don't care
-		if r.RequestURI == "/healthcheck" {
+		// don't log healthchecks b/c i don't care
+		if Contains([]string{"/healthcheck", "/readyz", "/livez"}, r.RequestURI) {
+			next.ServeHTTP(w, r)
 			return
 		}
 
@@ -39,11 +55,114 @@ func (h sessionHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	} else {
 		s, _ := store.Get(r, "session")
 
+		// banned teams get logged out, handlers treat that like any other request without a session
+		if !revalidateSession(w, r, s, time.Now().UTC()) {
+			s, _ = store.New(r, "session")
+		}
+
 		h(w, r, s)
 	}
 }
 
+// Set up the routes for the web app
+func newRouter() *mux.Router {
+	router := mux.NewRouter()
+
+	// TODO: admin route to look for things stuck in "Destroying" state
+	router.Use(loggingMiddleware)
+	router.Use(securityHeadersMiddleware)
+	router.HandleFunc("/", indexPage).Methods("GET")
+	router.HandleFunc("/healthcheck", healthCheck).Methods("GET")
+	router.HandleFunc("/readyz", readinessCheck).Methods("GET")
+	router.HandleFunc("/livez", livenessCheck).Methods("GET")
+
+	// rate limits are turned off if they weren't loaded
+	limits := rateLimits
+	if limits == nil {
+		limits = &RateLimits{}
+	}
+
+	api := router.PathPrefix("/api").Subrouter()
+	api.Use(rateLimitIP(limits.IP))
+	api.Use(csrfMiddleware)
+	api.HandleFunc("/openapi.json", openAPISpec).Methods("GET")
+	api.Path("/csrf").Handler(sessionHandler(csrfTokenRequest)).Methods("GET")
+	api.Path("/auth").Handler(rateLimitIP(limits.Auth)(sessionHandler(authRequest))).Methods("POST")
+	api.Path("/status").Handler(sessionHandler(statusRequest)).Methods("GET")
+	api.Path("/create").Handler(sessionHandler(rateLimitSession(limits.Create, createInstanceRequest))).Methods("POST")
+	api.Path("/extend").Handler(sessionHandler(rateLimitSession(limits.Manage, extendInstanceRequest))).Methods("POST")
+	api.Path("/restart").Handler(sessionHandler(rateLimitSession(limits.Manage, restartInstanceRequest))).Methods("POST")
+	api.Path("/allow-ip").Handler(sessionHandler(rateLimitSession(limits.Manage, allowIPRequest))).Methods("POST")
+	api.Path("/destroy").Handler(sessionHandler(rateLimitSession(limits.Manage, destroyInstanceRequest))).Methods("POST")
+	api.Path("/logout").Handler(sessionHandler(logoutRequest)).Methods("POST")
+
+	// v2 api, JSON everywhere with structured errors. v1 is kept for the frontend
+	v2 := api.PathPrefix("/v2").Subrouter()
+	v2.Path("/auth").Handler(rateLimitIP(limits.Auth)(sessionHandler(authRequestV2))).Methods("POST")
+	v2.Path("/instance").Handler(teamHandler(getInstanceRequestV2)).Methods("GET")
+	v2.Path("/instance").Handler(teamHandler(rateLimitTeam(limits.Create, createInstanceRequestV2))).Methods("POST")
+	v2.Path("/instance").Handler(teamHandler(rateLimitTeam(limits.Manage, destroyInstanceRequestV2))).Methods("DELETE")
+	v2.Path("/instance/extend").Handler(teamHandler(rateLimitTeam(limits.Manage, extendInstanceRequestV2))).Methods("POST")
+	v2.Path("/instance/restart").Handler(teamHandler(rateLimitTeam(limits.Manage, restartInstanceRequestV2))).Methods("POST")
+	v2.Path("/instance/allowed-ips").Handler(teamHandler(rateLimitTeam(limits.Manage, allowIPRequestV2))).Methods("POST")
+
+	// admin api is on its own listener if there is one
+	if config.AdminListenAddr == "" {
+		addAdminRoutes(router)
+	}
+
+	static, err := fs.Sub(assets, "static")
+	if err != nil {
+		// only fails if the path is invalid
+		panic(err)
+	}
+	router.PathPrefix("/").Handler(http.FileServer(http.FS(static)))
+
+	return router
+}
+
+// Add the admin api, only enabled with an admin token
+func addAdminRoutes(router *mux.Router) {
+	if config.AdminToken != "" {
+		admin := router.PathPrefix("/admin").Subrouter()
+		admin.Use(adminMiddleware)
+		admin.HandleFunc("/teams/{teamId}/sessions", revokeTeamSessionsRequest).Methods("DELETE")
+	}
+}
+
+// Set up the routes for the admin listener, which shouldn't be exposed publicly
+func newAdminRouter() *mux.Router {
+	router := mux.NewRouter()
+
+	router.Use(loggingMiddleware)
+	router.Use(securityHeadersMiddleware)
+	router.HandleFunc("/healthcheck", healthCheck).Methods("GET")
+	router.HandleFunc("/readyz", readinessCheck).Methods("GET")
+	router.HandleFunc("/livez", livenessCheck).Methods("GET")
+	addAdminRoutes(router)
+
+	return router
+}
+
 func main() {
+	// the gateway sidecar runs from the same binary, but doesn't need any of the web app
+	if len(os.Args) > 1 && os.Args[1] == "gateway" {
+		runGateway()
+		return
+	}
+
+	// print the install manifests for the current config
+	if len(os.Args) > 1 && os.Args[1] == "manifests" {
+		runManifests(os.Args[2:])
+		return
+	}
+
+	// manage instances on the cluster
+	if len(os.Args) > 1 && os.Args[1] == "instances" {
+		runInstancesCli(os.Args[2:])
+		return
+	}
+
 	// load config
 	if c, err := loadConfig(); err != nil {
 		log.Fatalln(err)
@@ -51,47 +170,94 @@ func main() {
 		config = c
 	}
 
-	// initialize router
-	router := mux.NewRouter()
-
 	// initialize session store
 	if sessKeyLen := len(config.SessionKey); !Contains([]int{32, 64}, sessKeyLen) {
 		log.Fatalf("the session key is an invalid length: %d (must be 32 or 64)", sessKeyLen)
 	}
-	store = sessions.NewCookieStore([]byte(config.SessionKey))
-	store.Options.SameSite = http.SameSiteStrictMode
+	sessionBackend, err := newSessionBackend(config)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	store = newSessionStore([]byte(config.SessionKey), sessionBackend, time.Duration(config.SessionTTL)*time.Second)
+	store.Options.Secure = config.CookieSecure || config.tlsEnabled()
+	store.Options.HttpOnly = config.CookieHttpOnly
+
+	if rateLimits, err = newRateLimits(config); err != nil {
+		log.Fatalln(err)
+	}
+
+	if assets, err = newAssets(config); err != nil {
+		log.Fatalln(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	opCtx = ctx
+
+	// clean up expired sessions in the background
+	go pruneSessions(ctx, sessionBackend)
 
 	// initialize instance manager
 	im = &InstanceManager{}
-	if err := im.Init(); err != nil {
+	if err := im.Init(ctx); err != nil {
 		log.Fatalf("couldn't init InstanceManager: %v", err)
 	}
 
 	// start background thread to destroy expired instances
-	go func(im *InstanceManager) {
-		for {
-			if err := im.DestroyExpiredInstances(); err != nil {
-				log.Printf("couldn't destroy expired instances: %v", err)
-				return
+	reaper = newReaper(im, config.ReaperWorkers, time.Duration(config.ReaperInterval)*time.Second)
+	// it has its own context so it can be stopped before draining, otherwise it could keep starting destroys
+	reaperCtx, reaperCancel := context.WithCancel(ctx)
+	defer reaperCancel()
+	reaperDone := make(chan struct{})
+	go func() {
+		reaper.Run(reaperCtx)
+		close(reaperDone)
+	}()
+
+	// start the servers
+	tlsConfig, err := newTLSConfig(config)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	servers := []*http.Server{{Addr: config.ListenAddr, Handler: newRouter(), TLSConfig: tlsConfig}}
+	if config.AdminListenAddr != "" {
+		servers = append(servers, &http.Server{Addr: config.AdminListenAddr, Handler: newAdminRouter(), TLSConfig: tlsConfig})
+	}
+	for _, srv := range servers {
+		go func(srv *http.Server) {
+			if err := listenAndServe(srv); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				log.Fatalln(err)
 			}
+		}(srv)
+	}
+
+	// wait for k8s to tell us to stop
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	log.Printf("received %v, shutting down", <-sigs)
 
-			time.Sleep(time.Duration(1) * time.Minute)
+	// stop the reaper and taking new requests, then let in-flight operations finish.
+	// the reaper's in-flight destroys are canceled, they're picked up again on the next start
+	reaperCancel()
+	<-reaperDone
+	drainCtx, drainCancel := context.WithTimeout(context.Background(), time.Duration(config.DrainTimeout)*time.Second)
+	defer drainCancel()
+	for _, srv := range servers {
+		if err := srv.Shutdown(drainCtx); err != nil {
+			log.Printf("couldn't gracefully shut down the server on %s: %v", srv.Addr, err)
 		}
-	}(im)
+	}
+	if im.Drain(drainCtx) {
+		log.Println("all operations finished")
+		return
+	}
 
-	// setup router
-	// TODO: admin route to look for things stuck in "Destroying" state
-	router.Use(loggingMiddleware)
-	router.HandleFunc("/", indexPage).Methods("GET")
-	router.HandleFunc("/healthcheck", healthCheck).Methods("GET")
-	router.Path("/api/auth").Handler(sessionHandler(authRequest)).Methods("POST")
-	router.Path("/api/status").Handler(sessionHandler(statusRequest)).Methods("GET")
-	router.Path("/api/create").Handler(sessionHandler(createInstanceRequest)).Methods("POST")
-	router.Path("/api/extend").Handler(sessionHandler(extendInstanceRequest)).Methods("POST")
-	router.Path("/api/destroy").Handler(sessionHandler(destroyInstanceRequest)).Methods("POST")
-	router.PathPrefix("/").Handler(http.FileServer(http.Dir("./static/")))
-
-	// start the server
-	log.Println("starting server on port 5050")
-	log.Fatalln(http.ListenAndServe(":5050", router))
+	// cancel whatever is left, canceled creates get rolled back
+	log.Println("timed out waiting for operations to finish, canceling them")
+	cancel()
+	rollbackCtx, rollbackCancel := context.WithTimeout(context.Background(), ROLLBACK_TIMEOUT)
+	defer rollbackCancel()
+	if !im.Drain(rollbackCtx) {
+		log.Println("timed out waiting for canceled operations to roll back")
+	}
 }
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/yaml"
+)
+
+// Variables available to the manifest templates when they are rendered for a team
+type ManifestVars struct {
+	// name of the app, the manifests must contain a LoadBalancer Service with this name
+	AppName string
+
+	// k8s namespace the manifests are deployed into
+	Namespace string
+
+	// rCTF team id
+	TeamId string
+
+	// flag for the challenge ($CHALDEPLOY_FLAG)
+	Flag string
+
+	// image path for the challenge ($CHALDEPLOY_IMAGE)
+	Image string
+
+	// port exposed by the challenge ($CHALDEPLOY_PORT)
+	Port int
+
+	// expiration time for the instance
+	ExpTime time.Time
+
+	// access token for the instance, empty unless $CHALDEPLOY_ACCESS_CONTROL=token
+	AccessToken string
+}
+
+// ObjectSource produces the k8s objects that are deployed into a team's namespace
+type ObjectSource interface {
+	Objects(vars *ManifestVars) ([]*unstructured.Unstructured, error)
+}
+
+// ManifestSet is a directory of YAML manifests that are rendered as Go templates and deployed for each team
+type ManifestSet struct {
+	// directory the manifests were loaded from
+	Dir string
+
+	// parsed templates, one per file, sorted by filename
+	templates []*template.Template
+}
+
+// Load every .yaml/.yml file in a directory as a manifest template.
+// The set is test-rendered so template errors, and pods the namespace's Pod Security level would reject,
+// are caught at startup instead of on the first deployment.
+func loadManifestSet(dir, podSecurity string) (*ManifestSet, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read manifest directory %s: %v", dir, err)
+	}
+
+	ms := &ManifestSet{Dir: dir}
+
+	// sort the files so the objects are always created in the same order
+	names := []string{}
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+
+		if ext := filepath.Ext(e.Name()); ext == ".yaml" || ext == ".yml" {
+			names = append(names, e.Name())
+		}
+	}
+	sort.Strings(names)
+
+	if len(names) == 0 {
+		return nil, fmt.Errorf("no manifests found in %s", dir)
+	}
+
+	for _, name := range names {
+		t, err := template.New(name).Option("missingkey=error").ParseFiles(filepath.Join(dir, name))
+		if err != nil {
+			return nil, fmt.Errorf("couldn't parse manifest template %s: %v", name, err)
+		}
+
+		ms.templates = append(ms.templates, t)
+	}
+
+	// make sure the templates render into something deployable
+	objs, err := ms.Objects(testManifestVars())
+	if err != nil {
+		return nil, err
+	}
+
+	for _, obj := range objs {
+		spec, err := podSpecFromObject(obj)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't decode the pod spec of %s %s: %v", obj.GetKind(), obj.GetName(), err)
+		}
+
+		if spec == nil {
+			continue
+		}
+
+		if violations := checkPodSecurity(*spec, podSecurity); len(violations) > 0 {
+			return nil, fmt.Errorf("%s %s isn't allowed by the %s pod security level, fix the manifest or change $CHALDEPLOY_POD_SECURITY:\n  %s",
+				obj.GetKind(), obj.GetName(), podSecurity, strings.Join(violations, "\n  "))
+		}
+	}
+
+	return ms, nil
+}
+
+// Get the pod spec from an object that runs pods, nil if it doesn't
+func podSpecFromObject(obj *unstructured.Unstructured) (*corev1.PodSpec, error) {
+	var path []string
+	switch obj.GetKind() {
+	case "Pod":
+		path = []string{"spec"}
+	case "Deployment", "StatefulSet", "DaemonSet", "ReplicaSet", "Job":
+		path = []string{"spec", "template", "spec"}
+	case "CronJob":
+		path = []string{"spec", "jobTemplate", "spec", "template", "spec"}
+	default:
+		return nil, nil
+	}
+
+	raw, found, err := unstructured.NestedMap(obj.Object, path...)
+	if err != nil || !found {
+		return nil, err
+	}
+
+	spec := &corev1.PodSpec{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(raw, spec); err != nil {
+		return nil, err
+	}
+
+	return spec, nil
+}
+
+// volume types allowed by the restricted Pod Security Standard
+var restrictedVolumeTypes = []string{"configMap", "csi", "downwardAPI", "emptyDir", "ephemeral", "persistentVolumeClaim", "projected", "secret"}
+
+// Check a pod spec against a Pod Security Standard level, returns why it would be rejected.
+// Covers the checks a challenge is likely to trip, the cluster still has the final say
+// ref: https://kubernetes.io/docs/concepts/security/pod-security-standards/
+func checkPodSecurity(spec corev1.PodSpec, level string) []string {
+	violations := []string{}
+	if level == "privileged" {
+		return violations
+	}
+
+	if spec.HostNetwork || spec.HostPID || spec.HostIPC {
+		violations = append(violations, "host namespaces (hostNetwork, hostPID, hostIPC) aren't allowed")
+	}
+
+	podSeccomp := ""
+	podRunAsNonRoot := false
+	if sc := spec.SecurityContext; sc != nil {
+		if sc.SeccompProfile != nil {
+			podSeccomp = string(sc.SeccompProfile.Type)
+		}
+		if sc.RunAsNonRoot != nil {
+			podRunAsNonRoot = *sc.RunAsNonRoot
+		}
+		if sc.RunAsUser != nil && *sc.RunAsUser == 0 && level == "restricted" {
+			violations = append(violations, "the pod can't run as UID 0")
+		}
+	}
+	if podSeccomp == string(corev1.SeccompProfileTypeUnconfined) {
+		violations = append(violations, "the pod can't use an Unconfined seccomp profile")
+	}
+
+	for _, v := range spec.Volumes {
+		if v.HostPath != nil {
+			violations = append(violations, fmt.Sprintf("volume %s can't be a hostPath", v.Name))
+		} else if level == "restricted" {
+			// the volume source is the only field set besides the name
+			raw, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&v)
+			if err != nil {
+				continue
+			}
+			for k := range raw {
+				if k != "name" && !Contains(restrictedVolumeTypes, k) {
+					violations = append(violations, fmt.Sprintf("volume %s can't be a %s", v.Name, k))
+				}
+			}
+		}
+	}
+
+	containers := append(append([]corev1.Container{}, spec.InitContainers...), spec.Containers...)
+	for _, c := range containers {
+		for _, p := range c.Ports {
+			if p.HostPort != 0 {
+				violations = append(violations, fmt.Sprintf("container %s can't use a hostPort", c.Name))
+			}
+		}
+
+		sc := c.SecurityContext
+		if sc == nil {
+			sc = &corev1.SecurityContext{}
+		}
+
+		if sc.Privileged != nil && *sc.Privileged {
+			violations = append(violations, fmt.Sprintf("container %s can't be privileged", c.Name))
+		}
+
+		// container settings override the pod's
+		seccomp := podSeccomp
+		if sc.SeccompProfile != nil {
+			seccomp = string(sc.SeccompProfile.Type)
+			if sc.SeccompProfile.Type == corev1.SeccompProfileTypeUnconfined {
+				violations = append(violations, fmt.Sprintf("container %s can't use an Unconfined seccomp profile", c.Name))
+			}
+		}
+		runAsNonRoot := podRunAsNonRoot
+		if sc.RunAsNonRoot != nil {
+			runAsNonRoot = *sc.RunAsNonRoot
+		}
+
+		adds := []string{}
+		dropsAll := false
+		if sc.Capabilities != nil {
+			for _, cap := range sc.Capabilities.Add {
+				adds = append(adds, strings.TrimPrefix(string(cap), "CAP_"))
+			}
+			for _, cap := range sc.Capabilities.Drop {
+				dropsAll = dropsAll || cap == "ALL"
+			}
+		}
+		for _, cap := range adds {
+			if !Contains(baselineCapabilities, cap) || (level == "restricted" && cap != "NET_BIND_SERVICE") {
+				violations = append(violations, fmt.Sprintf("container %s can't add capability %s", c.Name, cap))
+			}
+		}
+
+		if level != "restricted" {
+			continue
+		}
+
+		if sc.AllowPrivilegeEscalation == nil || *sc.AllowPrivilegeEscalation {
+			violations = append(violations, fmt.Sprintf("container %s must set allowPrivilegeEscalation: false", c.Name))
+		}
+		if !dropsAll {
+			violations = append(violations, fmt.Sprintf("container %s must drop ALL capabilities", c.Name))
+		}
+		if !runAsNonRoot {
+			violations = append(violations, fmt.Sprintf("container %s must set runAsNonRoot: true (on the pod or the container)", c.Name))
+		}
+		if sc.RunAsUser != nil && *sc.RunAsUser == 0 {
+			violations = append(violations, fmt.Sprintf("container %s can't run as UID 0", c.Name))
+		}
+		if seccomp != string(corev1.SeccompProfileTypeRuntimeDefault) && seccomp != string(corev1.SeccompProfileTypeLocalhost) {
+			violations = append(violations, fmt.Sprintf("container %s must use the RuntimeDefault or a Localhost seccomp profile (on the pod or the container)", c.Name))
+		}
+	}
+
+	return violations
+}
+
+// Placeholder variables for rendering manifests without a real team, e.g. to validate them
+func testManifestVars() *ManifestVars {
+	return &ManifestVars{
+		AppName:     "chaldeploy-test",
+		Namespace:   "chaldeploy-test",
+		TeamId:      "00000000-0000-0000-0000-000000000000",
+		Flag:        "flag{test}",
+		Image:       "test:latest",
+		Port:        1337,
+		ExpTime:     time.Now().UTC(),
+		AccessToken: "00000000000000000000000000000000",
+	}
+}
+
+// Render the manifests for a team and decode them into k8s objects
+func (ms *ManifestSet) Objects(vars *ManifestVars) ([]*unstructured.Unstructured, error) {
+	objs := []*unstructured.Unstructured{}
+
+	for _, t := range ms.templates {
+		buf := &bytes.Buffer{}
+		if err := t.Execute(buf, vars); err != nil {
+			return nil, fmt.Errorf("couldn't render manifest template %s: %v", t.Name(), err)
+		}
+
+		fileObjs, err := decodeManifests(buf)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't decode manifest %s: %v", t.Name(), err)
+		}
+
+		objs = append(objs, fileObjs...)
+	}
+
+	// the service is used to get the connection info, make sure it's there
+	foundService := false
+	for _, o := range objs {
+		if o.GetKind() == "Service" && o.GetName() == vars.AppName {
+			foundService = true
+			break
+		}
+	}
+	if !foundService {
+		return nil, fmt.Errorf("manifests in %s don't contain a Service named {{ .AppName }}", ms.Dir)
+	}
+
+	return objs, nil
+}
+
+// Decode a (potentially multi-document) YAML stream into k8s objects
+func decodeManifests(r io.Reader) ([]*unstructured.Unstructured, error) {
+	objs := []*unstructured.Unstructured{}
+	decoder := yaml.NewYAMLOrJSONDecoder(r, 4096)
+
+	for {
+		obj := &unstructured.Unstructured{}
+		if err := decoder.Decode(&obj.Object); err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+
+			return nil, err
+		}
+
+		// skip empty documents (e.g., a leading '---')
+		if len(obj.Object) == 0 {
+			continue
+		}
+
+		if obj.GetKind() == "" || obj.GetAPIVersion() == "" {
+			return nil, fmt.Errorf("object is missing kind or apiVersion: %s", strings.TrimSpace(fmt.Sprint(obj.Object)))
+		}
+
+		objs = append(objs, obj)
+	}
+
+	return objs, nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const testManifest = `---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: {{ .AppName }}
+spec:
+  template:
+    spec:
+      containers:
+      - name: app
+        image: {{ .Image }}
+        env:
+        - name: FLAG
+          value: "{{ .Flag }}"
+        - name: TEAM
+          value: "{{ .TeamId }}"
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: {{ .AppName }}
+spec:
+  type: LoadBalancer
+  ports:
+  - port: {{ .Port }}
+`
+
+func writeManifest(t *testing.T, dir, name, contents string) {
+	if err := os.WriteFile(filepath.Join(dir, name), []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestManifestSet(t *testing.T) {
+	dir := t.TempDir()
+	writeManifest(t, dir, "app.yaml", testManifest)
+	writeManifest(t, dir, "README.md", "not a manifest")
+
+	ms, err := loadManifestSet(dir, "baseline")
+	assert.Nil(t, err)
+	assert.NotNil(t, ms)
+
+	objs, err := ms.Objects(&ManifestVars{
+		AppName:   "chaldeploy-abc-team",
+		Namespace: "chaldeploy-abc-team",
+		TeamId:    "team",
+		Flag:      "flag{asdf}",
+		Image:     "testimg:latest",
+		Port:      31337,
+		ExpTime:   time.Now().UTC(),
+	})
+	assert.Nil(t, err)
+	assert.Len(t, objs, 2)
+
+	assert.Equal(t, "Deployment", objs[0].GetKind())
+	assert.Equal(t, "chaldeploy-abc-team", objs[0].GetName())
+	assert.Contains(t, objs[0].Object["spec"].(map[string]interface{})["template"], "spec")
+	assert.Equal(t, "Service", objs[1].GetKind())
+}
+
+func TestManifestSetMissingService(t *testing.T) {
+	dir := t.TempDir()
+	writeManifest(t, dir, "app.yaml", strings.Split(testManifest, "---\napiVersion: v1")[0])
+
+	ms, err := loadManifestSet(dir, "baseline")
+	assert.NotNil(t, err)
+	assert.Nil(t, ms)
+}
+
+func TestManifestSetBadTemplate(t *testing.T) {
+	dir := t.TempDir()
+	writeManifest(t, dir, "app.yaml", testManifest+"\n# {{ .NotAVar }}\n")
+
+	ms, err := loadManifestSet(dir, "baseline")
+	assert.NotNil(t, err)
+	assert.Nil(t, ms)
+}
+
+func TestManifestSetEmptyDir(t *testing.T) {
+	ms, err := loadManifestSet(t.TempDir(), "baseline")
+	assert.NotNil(t, err)
+	assert.Nil(t, ms)
+}
+
+func TestManifestSetPodSecurity(t *testing.T) {
+	dir := t.TempDir()
+	writeManifest(t, dir, "app.yaml", testManifest)
+
+	// the test manifest doesn't lock down its pod
+	ms, err := loadManifestSet(dir, "restricted")
+	assert.NotNil(t, err)
+	assert.Nil(t, ms)
+	assert.Contains(t, err.Error(), "container app must set allowPrivilegeEscalation: false")
+
+	hardened := strings.Replace(testManifest, "      containers:\n", `      securityContext:
+        runAsNonRoot: true
+        seccompProfile:
+          type: RuntimeDefault
+      containers:
+`, 1)
+	hardened = strings.Replace(hardened, "        env:\n", `        securityContext:
+          allowPrivilegeEscalation: false
+          capabilities:
+            drop: ["ALL"]
+        env:
+`, 1)
+	writeManifest(t, dir, "app.yaml", hardened)
+	ms, err = loadManifestSet(dir, "restricted")
+	assert.Nil(t, err)
+	assert.NotNil(t, ms)
+}
+
+func TestCheckPodSecurity(t *testing.T) {
+	b := true
+	spec := corev1.PodSpec{
+		HostNetwork: true,
+		Volumes:     []corev1.Volume{{Name: "host", VolumeSource: corev1.VolumeSource{HostPath: &corev1.HostPathVolumeSource{Path: "/"}}}},
+		Containers: []corev1.Container{{
+			Name:            "app",
+			SecurityContext: &corev1.SecurityContext{Privileged: &b, Capabilities: &corev1.Capabilities{Add: []corev1.Capability{"SYS_ADMIN"}}},
+		}},
+	}
+
+	assert.Empty(t, checkPodSecurity(spec, "privileged"))
+	assert.Len(t, checkPodSecurity(spec, "baseline"), 4)
+
+	// restricted only allows some volume types
+	spec = corev1.PodSpec{Volumes: []corev1.Volume{{Name: "nfs", VolumeSource: corev1.VolumeSource{NFS: &corev1.NFSVolumeSource{Server: "nfs", Path: "/"}}}}}
+	assert.Empty(t, checkPodSecurity(spec, "baseline"))
+	assert.Equal(t, []string{"volume nfs can't be a nfs"}, checkPodSecurity(spec, "restricted"))
+}
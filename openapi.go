@@ -0,0 +1,443 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// a possible response to an API operation
+type apiResponse struct {
+	Description string
+
+	// value whose type is the body of the response, nil if there isn't one
+	Body interface{}
+
+	// content type of the body, defaults to application/json
+	ContentType string
+}
+
+// apiOperation documents a single route under /api, used to generate the OpenAPI spec
+type apiOperation struct {
+	Method  string
+	Path    string
+	Summary string
+
+	// if the team has to be logged in
+	Auth bool
+
+	// value whose type is the body of the request, nil if there isn't one
+	Request interface{}
+
+	// content type of the request body, defaults to application/json
+	RequestContentType string
+
+	Responses map[int]apiResponse
+}
+
+// Response for a v2 error
+func errorResponse(description string) apiResponse {
+	return apiResponse{Description: description, Body: APIErrorResponse{}}
+}
+
+// Plain text response, for the v1 api
+func textResponse(description string) apiResponse {
+	return apiResponse{Description: description, Body: "", ContentType: "text/plain"}
+}
+
+// every route under /api. TestOpenAPIMatchesRouter makes sure this matches the router
+var apiOperations = []apiOperation{
+	// v1, used by the frontend
+	{
+		Method: "GET", Path: "/api/csrf", Summary: "Get the CSRF token for the session, in a cookie if the client isn't logged in",
+		Responses: map[int]apiResponse{
+			200: {Description: "CSRF token to send in the X-CSRF-Token header", Body: CSRFTokenResponse{}},
+		},
+	},
+	{
+		Method: "POST", Path: "/api/auth", Summary: "Log in with an rCTF auth url or login token, returns the team name",
+		Request: "", RequestContentType: "text/plain",
+		Responses: map[int]apiResponse{
+			200: textResponse("Logged in, the body is the team name"),
+			403: {Description: "rCTF rejected the token"},
+		},
+	},
+	{
+		Method: "GET", Path: "/api/status", Summary: "Get the status of the team's instance", Auth: true,
+		Responses: map[int]apiResponse{
+			200: {Description: "Status of the instance", Body: StatusResponse{}},
+		},
+	},
+	{
+		Method: "POST", Path: "/api/create", Summary: "Create an instance for the team", Auth: true,
+		Responses: map[int]apiResponse{
+			200: {Description: "Instance is running", Body: CreateInstanceResponse{}},
+			429: {Description: "Instance was destroyed too recently"},
+		},
+	},
+	{
+		Method: "POST", Path: "/api/extend", Summary: "Extend the team's instance, returns the new expiration time", Auth: true,
+		Responses: map[int]apiResponse{
+			200: textResponse("New expiration time"),
+			404: {Description: "Extending instances is disabled"},
+		},
+	},
+	{
+		Method: "POST", Path: "/api/restart", Summary: "Restart the team's instance", Auth: true,
+		Responses: map[int]apiResponse{
+			200: {Description: "Instance was restarted"},
+			404: {Description: "Restarting instances is disabled"},
+			429: {Description: "Instance was restarted too recently"},
+		},
+	},
+	{
+		Method: "POST", Path: "/api/allow-ip", Summary: "Allow an IP to connect to the team's instance, the requester's IP if the body is empty", Auth: true,
+		Request: "", RequestContentType: "text/plain",
+		Responses: map[int]apiResponse{
+			200: {Description: "IPs allowed to connect", Body: AllowIPResponse{}},
+			400: {Description: "Invalid IP"},
+			404: {Description: "The source allowlist is disabled"},
+			409: {Description: "Too many IPs are allowed"},
+		},
+	},
+	{
+		Method: "POST", Path: "/api/destroy", Summary: "Destroy the team's instance", Auth: true,
+		Responses: map[int]apiResponse{
+			200: {Description: "Instance was destroyed"},
+		},
+	},
+	{
+		Method: "POST", Path: "/api/logout", Summary: "Log out, deleting the session",
+		Responses: map[int]apiResponse{
+			200: {Description: "Logged out"},
+		},
+	},
+
+	// v2, for integrations
+	{
+		Method: "POST", Path: "/api/v2/auth", Summary: "Log in with an rCTF auth url or login token",
+		Request: V2AuthRequest{},
+		Responses: map[int]apiResponse{
+			200: {Description: "Logged in", Body: V2AuthResponse{}},
+			400: errorResponse("Invalid request body"),
+			401: errorResponse("rCTF rejected the token"),
+			502: errorResponse("Couldn't reach rCTF"),
+		},
+	},
+	{
+		Method: "GET", Path: "/api/v2/instance", Summary: "Get the team's instance", Auth: true,
+		Responses: map[int]apiResponse{
+			200: {Description: "The team's instance", Body: InstanceResponse{}},
+			404: errorResponse("The team doesn't have an instance"),
+		},
+	},
+	{
+		Method: "POST", Path: "/api/v2/instance", Summary: "Create an instance for the team, returns once it's running", Auth: true,
+		Responses: map[int]apiResponse{
+			201: {Description: "Instance is running", Body: InstanceResponse{}},
+			409: errorResponse("The team already has an instance"),
+			429: errorResponse("Instance was destroyed too recently, or too many instances were created"),
+			500: errorResponse("Instance couldn't be deployed"),
+		},
+	},
+	{
+		Method: "DELETE", Path: "/api/v2/instance", Summary: "Destroy the team's instance", Auth: true,
+		Responses: map[int]apiResponse{
+			200: {Description: "Instance was destroyed", Body: InstanceResponse{}},
+			404: errorResponse("The team doesn't have a running instance"),
+		},
+	},
+	{
+		Method: "POST", Path: "/api/v2/instance/extend", Summary: "Push back the expiration time of the team's instance", Auth: true,
+		Responses: map[int]apiResponse{
+			200: {Description: "Instance was extended", Body: InstanceResponse{}},
+			403: errorResponse("Instance can't be extended any more"),
+			404: errorResponse("The team doesn't have a running instance, or extending is disabled"),
+			409: errorResponse("Instance already expired"),
+		},
+	},
+	{
+		Method: "POST", Path: "/api/v2/instance/restart", Summary: "Restart the team's instance, keeping the endpoint and expiration time", Auth: true,
+		Responses: map[int]apiResponse{
+			202: {Description: "Instance is restarting", Body: InstanceResponse{}},
+			404: errorResponse("The team doesn't have a running instance, or restarting is disabled"),
+			429: errorResponse("Instance was restarted too recently"),
+		},
+	},
+	{
+		Method: "POST", Path: "/api/v2/instance/allowed-ips", Summary: "Allow an IP to connect to the team's instance, the requester's IP if it's empty", Auth: true,
+		Request: V2AllowIPRequest{},
+		Responses: map[int]apiResponse{
+			200: {Description: "IP was allowed", Body: InstanceResponse{}},
+			400: errorResponse("Invalid request body or IP"),
+			404: errorResponse("The team doesn't have a running instance, or the source allowlist is disabled"),
+			409: errorResponse("Too many IPs are allowed"),
+		},
+	},
+
+	{
+		Method: "GET", Path: "/api/openapi.json", Summary: "Get this OpenAPI spec",
+		Responses: map[int]apiResponse{
+			200: {Description: "OpenAPI 3 spec", Body: map[string]interface{}{}},
+		},
+	},
+}
+
+// JSON schema for a Go type. Named structs are added to schemas and referenced
+func jsonSchema(t reflect.Type, schemas map[string]interface{}) map[string]interface{} {
+	if t == reflect.TypeOf(time.Time{}) {
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		return jsonSchema(t.Elem(), schemas)
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": jsonSchema(t.Elem(), schemas)}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": jsonSchema(t.Elem(), schemas)}
+	case reflect.Interface:
+		return map[string]interface{}{}
+	case reflect.Struct:
+		ref := map[string]interface{}{"$ref": "#/components/schemas/" + t.Name()}
+		if _, exists := schemas[t.Name()]; exists {
+			return ref
+		}
+
+		// reserve the name before walking the fields, in case the type references itself
+		schemas[t.Name()] = nil
+
+		properties := map[string]interface{}{}
+		required := []string{}
+		addStructFields(t, schemas, properties, &required)
+
+		schema := map[string]interface{}{"type": "object", "properties": properties}
+		if len(required) > 0 {
+			schema["required"] = required
+		}
+		schemas[t.Name()] = schema
+
+		return ref
+	}
+
+	panic(fmt.Sprintf("can't make a JSON schema for %v", t))
+}
+
+// Add the JSON fields of a struct to a schema, following encoding/json's rules for tags and embedded structs
+func addStructFields(t reflect.Type, schemas map[string]interface{}, properties map[string]interface{}, required *[]string) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+
+		tagParts := strings.Split(tag, ",")
+		if f.Anonymous && tagParts[0] == "" && f.Type.Kind() == reflect.Struct {
+			// embedded fields are flattened into the parent
+			addStructFields(f.Type, schemas, properties, required)
+			continue
+		}
+
+		name := tagParts[0]
+		if name == "" {
+			name = f.Name
+		}
+
+		properties[name] = jsonSchema(f.Type, schemas)
+		if !Contains(tagParts[1:], "omitempty") {
+			*required = append(*required, name)
+		}
+	}
+}
+
+// Content object for a request or response body
+func apiContent(body interface{}, contentType string, schemas map[string]interface{}) map[string]interface{} {
+	if contentType == "" {
+		contentType = "application/json"
+	}
+
+	return map[string]interface{}{
+		contentType: map[string]interface{}{"schema": jsonSchema(reflect.TypeOf(body), schemas)},
+	}
+}
+
+// Build the OpenAPI 3 spec for the API
+func generateOpenAPI(ops []apiOperation) map[string]interface{} {
+	schemas := map[string]interface{}{}
+	paths := map[string]interface{}{}
+
+	for _, op := range ops {
+		responses := map[string]interface{}{}
+		for code, resp := range op.Responses {
+			r := map[string]interface{}{"description": resp.Description}
+			if resp.Body != nil {
+				r["content"] = apiContent(resp.Body, resp.ContentType, schemas)
+			}
+			responses[fmt.Sprint(code)] = r
+		}
+
+		operation := map[string]interface{}{
+			"operationId": operationId(op),
+			"summary":     op.Summary,
+			"responses":   responses,
+		}
+		if op.Auth {
+			security := []interface{}{map[string]interface{}{"session": []string{}}}
+			if strings.HasPrefix(op.Path, "/api/v2/") {
+				security = append(security, map[string]interface{}{"bearer": []string{}})
+			}
+			operation["security"] = security
+			responses["401"] = unauthenticatedResponse(op, schemas)
+
+			if strings.HasPrefix(op.Path, "/api/v2/") {
+				responses["502"] = mergeResponse(responses["502"], "Couldn't check the bearer token with rCTF")
+				responses["502"].(map[string]interface{})["content"] = apiContent(APIErrorResponse{}, "", schemas)
+			}
+		}
+		if op.Method != "GET" {
+			// bearer tokens are only accepted by v2, where they don't need a CSRF token
+			operation["parameters"] = []interface{}{map[string]interface{}{
+				"name":        CSRF_HEADER,
+				"in":          "header",
+				"description": "CSRF token from GET /api/csrf, required unless a bearer token is used",
+				"required":    !strings.HasPrefix(op.Path, "/api/v2/"),
+				"schema":      map[string]interface{}{"type": "string"},
+			}}
+			responses["403"] = csrfFailedResponse(op, schemas, responses["403"])
+		}
+		// every route under /api is rate limited by IP
+		responses["429"] = rateLimitedResponse(op, schemas, responses["429"])
+		if op.Request != nil {
+			operation["requestBody"] = map[string]interface{}{"content": apiContent(op.Request, op.RequestContentType, schemas)}
+		}
+
+		item, ok := paths[op.Path].(map[string]interface{})
+		if !ok {
+			item = map[string]interface{}{}
+			paths[op.Path] = item
+		}
+		item[strings.ToLower(op.Method)] = operation
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":       "chaldeploy",
+			"description": "Deploy a CTF challenge instance for your team. Integrations should use the v2 API under /api/v2",
+			"version":     "2.0.0",
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": schemas,
+			"securitySchemes": map[string]interface{}{
+				"session": map[string]interface{}{"type": "apiKey", "in": "cookie", "name": "session"},
+				"bearer": map[string]interface{}{
+					"type":        "http",
+					"scheme":      "bearer",
+					"description": "rCTF auth token, only for the v2 API",
+				},
+			},
+		},
+	}
+}
+
+// Response for a request without a session. v1 doesn't have a body, v2 has an error
+func unauthenticatedResponse(op apiOperation, schemas map[string]interface{}) map[string]interface{} {
+	if !strings.HasPrefix(op.Path, "/api/v2/") {
+		return map[string]interface{}{"description": "Not logged in"}
+	}
+
+	return map[string]interface{}{
+		"description": "Not logged in, or rCTF rejected the auth token",
+		"content":     apiContent(APIErrorResponse{}, "", schemas),
+	}
+}
+
+// Add another reason for a response to the operation's own response for the status code, if it has one
+func mergeResponse(existing interface{}, description string) map[string]interface{} {
+	if e, ok := existing.(map[string]interface{}); ok {
+		e["description"] = e["description"].(string) + ", or " + strings.ToLower(description[:1]) + description[1:]
+		return e
+	}
+
+	return map[string]interface{}{"description": description}
+}
+
+// Response for a request without a valid CSRF token, merged with the operation's own 403 if it has one
+func csrfFailedResponse(op apiOperation, schemas map[string]interface{}, existing interface{}) map[string]interface{} {
+	resp := mergeResponse(existing, "Missing or invalid CSRF token")
+	if strings.HasPrefix(op.Path, "/api/v2/") {
+		resp["content"] = apiContent(APIErrorResponse{}, "", schemas)
+	}
+
+	return resp
+}
+
+// Response for a request over the rate limit, merged with the operation's own 429 if it has one
+func rateLimitedResponse(op apiOperation, schemas map[string]interface{}, existing interface{}) map[string]interface{} {
+	resp := mergeResponse(existing, "Too many requests")
+	resp["headers"] = map[string]interface{}{
+		"Retry-After": map[string]interface{}{
+			"description": "Seconds to wait before trying again",
+			"schema":      map[string]interface{}{"type": "integer"},
+		},
+	}
+	if strings.HasPrefix(op.Path, "/api/v2/") {
+		resp["content"] = apiContent(APIErrorResponse{}, "", schemas)
+	}
+
+	return resp
+}
+
+// Unique name for an operation, used by client generators for method names (e.g., "postApiV2InstanceExtend")
+func operationId(op apiOperation) string {
+	sb := strings.Builder{}
+	sb.WriteString(strings.ToLower(op.Method))
+
+	for _, part := range strings.FieldsFunc(op.Path, func(r rune) bool { return r == '/' || r == '-' || r == '.' }) {
+		sb.WriteString(strings.ToUpper(part[:1]) + part[1:])
+	}
+
+	return sb.String()
+}
+
+// rendered once, the spec doesn't change while the app is running
+var cachedOpenAPI []byte
+var cachedOpenAPIOnce sync.Once
+
+// GET /api/openapi.json
+// OpenAPI 3 spec for the API
+func openAPISpec(w http.ResponseWriter, r *http.Request) {
+	cachedOpenAPIOnce.Do(func() {
+		var err error
+		if cachedOpenAPI, err = json.Marshal(generateOpenAPI(apiOperations)); err != nil {
+			log.Printf("couldn't marshal the OpenAPI spec: %v", err)
+		}
+	})
+
+	if cachedOpenAPI == nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Add("Content-type", "application/json")
+	w.Write(cachedOpenAPI)
+}
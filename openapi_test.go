@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOpenAPIMatchesRouter(t *testing.T) {
+	config = &Config{AdminToken: "admin"}
+	defer func() { config = nil }()
+
+	// every /api route on the router is documented
+	routes := map[string]bool{}
+	err := newRouter().Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		path, err := route.GetPathTemplate()
+		if err != nil || !strings.HasPrefix(path, "/api/") {
+			return nil
+		}
+
+		methods, err := route.GetMethods()
+		if err != nil {
+			return nil
+		}
+
+		for _, m := range methods {
+			routes[m+" "+path] = true
+		}
+		return nil
+	})
+	assert.Nil(t, err)
+
+	documented := map[string]bool{}
+	for _, op := range apiOperations {
+		documented[op.Method+" "+op.Path] = true
+	}
+
+	assert.Equal(t, routes, documented)
+}
+
+// Find every $ref in a spec
+func findRefs(v interface{}, refs *[]string) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, child := range v {
+			if ref, ok := child.(string); ok && k == "$ref" {
+				*refs = append(*refs, ref)
+			} else {
+				findRefs(child, refs)
+			}
+		}
+	case []interface{}:
+		for _, child := range v {
+			findRefs(child, refs)
+		}
+	}
+}
+
+func TestOpenAPISpec(t *testing.T) {
+	rec := httptest.NewRecorder()
+	openAPISpec(rec, httptest.NewRequest("GET", "/api/openapi.json", nil))
+	assert.Equal(t, 200, rec.Code)
+
+	spec := map[string]interface{}{}
+	assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), &spec))
+	assert.Equal(t, "3.0.3", spec["openapi"])
+
+	// every reference points at a schema
+	schemas := spec["components"].(map[string]interface{})["schemas"].(map[string]interface{})
+	refs := []string{}
+	findRefs(spec["paths"], &refs)
+	findRefs(schemas, &refs)
+	assert.NotEmpty(t, refs)
+	for _, ref := range refs {
+		assert.Contains(t, schemas, strings.TrimPrefix(ref, "#/components/schemas/"))
+	}
+
+	// schemas match the JSON the handlers send
+	instance := schemas["InstanceResponse"].(map[string]interface{})
+	properties := instance["properties"].(map[string]interface{})
+	assert.Len(t, properties, reflect.TypeOf(InstanceResponse{}).NumField())
+	assert.Equal(t, map[string]interface{}{"type": "string", "format": "date-time"}, properties["expTime"])
+	assert.Equal(t, map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "string"}}, properties["allowedIps"])
+	assert.ElementsMatch(t, []interface{}{"state", "extensions", "maxExtensions"}, instance["required"])
+
+	errResp := schemas["APIErrorResponse"].(map[string]interface{})["properties"].(map[string]interface{})
+	assert.Equal(t, "#/components/schemas/APIError", errResp["error"].(map[string]interface{})["$ref"])
+
+	// operations
+	paths := spec["paths"].(map[string]interface{})
+	extend := paths["/api/v2/instance/extend"].(map[string]interface{})["post"].(map[string]interface{})
+	assert.Equal(t, "postApiV2InstanceExtend", extend["operationId"])
+	assert.Contains(t, extend["responses"], "401")
+	assert.Len(t, extend["security"], 2)
+
+	status := paths["/api/status"].(map[string]interface{})["get"].(map[string]interface{})
+	assert.Len(t, status["security"], 1)
+
+	// rate limits apply everywhere, and rCTF being down fails bearer auth
+	assert.Contains(t, status["responses"], "429")
+	assert.NotContains(t, status["responses"], "502")
+	assert.Contains(t, extend["responses"], "429")
+	assert.Contains(t, extend["responses"], "502")
+	create := paths["/api/v2/instance"].(map[string]interface{})["post"].(map[string]interface{})
+	tooMany := create["responses"].(map[string]interface{})["429"].(map[string]interface{})
+	assert.Equal(t, "Instance was destroyed too recently, or too many instances were created, or too many requests", tooMany["description"])
+	assert.Contains(t, tooMany["headers"], "Retry-After")
+
+	auth := paths["/api/v2/auth"].(map[string]interface{})["post"].(map[string]interface{})
+	assert.Nil(t, auth["security"])
+	assert.Contains(t, auth["requestBody"].(map[string]interface{})["content"], "application/json")
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	authorizationv1 "k8s.io/api/authorization/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// optional features, they're turned off if chaldeploy doesn't have the permissions for them
+const (
+	FeatureExtend         = "extend"
+	FeatureRestart        = "restart"
+	FeatureAllowIP        = "allow-ip"
+	FeatureCrashDetection = "crash detection"
+)
+
+// Permission is a single action chaldeploy takes against the k8s API
+type Permission struct {
+	// API group of the resource, empty for the core group
+	Group string
+
+	// plural resource name (e.g., "deployments")
+	Resource string
+
+	// API verb (e.g., "create")
+	Verb string
+
+	// optional feature that needs the permission, empty if chaldeploy can't run without it
+	Feature string
+}
+
+func (p Permission) String() string {
+	if p.Group == "" {
+		return fmt.Sprintf("%s %s", p.Verb, p.Resource)
+	}
+
+	return fmt.Sprintf("%s %s.%s", p.Verb, p.Resource, p.Group)
+}
+
+// permissions needed no matter how the challenge is deployed
+var basePermissions = []Permission{
+	// instance lifecycle, and finding existing instances on startup
+	{"", "namespaces", "get", ""},
+	{"", "namespaces", "list", ""},
+	{"", "namespaces", "create", ""},
+	{"", "namespaces", "delete", ""},
+	{"", "namespaces", "update", FeatureExtend},
+
+	// namespace isolation and limits. these aren't optional, instances shouldn't run without them
+	{"networking.k8s.io", "networkpolicies", "create", ""},
+	{"", "resourcequotas", "create", ""},
+	{"", "limitranges", "create", ""},
+
+	// connection info, source allowlist
+	{"", "services", "get", ""},
+	{"", "services", "update", FeatureAllowIP},
+
+	// readiness, health, restarts
+	{"apps", "deployments", "list", ""},
+	{"apps", "deployments", "patch", FeatureRestart},
+	{"", "pods", "list", FeatureCrashDetection},
+}
+
+// permissions for the default deployment/service, when manifests or an rCDS challenge aren't used
+var defaultObjectPermissions = []Permission{
+	{"apps", "deployments", "create", ""},
+	{"", "services", "create", ""},
+}
+
+// permissions for per-instance access tokens
+var accessTokenPermissions = []Permission{
+	{"", "secrets", "get", ""},
+	{"", "secrets", "create", ""},
+}
+
+// Get every permission chaldeploy needs with the current config.
+// If manifests or an rCDS challenge are used, they are rendered to find the resources they create
+func (im *InstanceManager) neededPermissions() ([]Permission, error) {
+	perms := append([]Permission{}, basePermissions...)
+
+	if config.AccessControl == "token" {
+		perms = append(perms, accessTokenPermissions...)
+	}
+
+	if im.Manifests == nil {
+		perms = append(perms, defaultObjectPermissions...)
+	} else {
+		objs, err := im.Manifests.Objects(testManifestVars())
+		if err != nil {
+			return nil, err
+		}
+
+		for _, obj := range objs {
+			gvk := obj.GroupVersionKind()
+
+			// without a cluster to ask (e.g., generating the install manifests), guess the resource from the kind
+			if im.Mapper == nil {
+				resource, _ := meta.UnsafeGuessKindToResource(gvk)
+				perms = append(perms, Permission{resource.Group, resource.Resource, "create", ""})
+				continue
+			}
+
+			mapping, err := im.Mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+			if err != nil {
+				return nil, fmt.Errorf("couldn't find the API resource for %s: %v", gvk, err)
+			}
+
+			perms = append(perms, Permission{mapping.Resource.Group, mapping.Resource.Resource, "create", ""})
+		}
+	}
+
+	return dedupePermissions(perms), nil
+}
+
+// Remove duplicate permissions and sort them by resource, so they're easier to read
+func dedupePermissions(perms []Permission) []Permission {
+	seen := map[Permission]bool{}
+	ret := []Permission{}
+	for _, p := range perms {
+		if !seen[p] {
+			seen[p] = true
+			ret = append(ret, p)
+		}
+	}
+
+	sort.SliceStable(ret, func(i, j int) bool {
+		if ret[i].Group != ret[j].Group {
+			return ret[i].Group < ret[j].Group
+		}
+		return ret[i].Resource < ret[j].Resource
+	})
+
+	return ret
+}
+
+// Ask the k8s API which of the permissions chaldeploy's service account doesn't have.
+// Namespaced resources are checked across all namespaces, since instances get a new namespace each time
+func checkPermissions(ctx context.Context, clientset kubernetes.Interface, perms []Permission) ([]Permission, error) {
+	missing := []Permission{}
+
+	client := clientset.AuthorizationV1().SelfSubjectAccessReviews()
+	for _, p := range perms {
+		review := &authorizationv1.SelfSubjectAccessReview{
+			Spec: authorizationv1.SelfSubjectAccessReviewSpec{
+				ResourceAttributes: &authorizationv1.ResourceAttributes{
+					Group:    p.Group,
+					Resource: p.Resource,
+					Verb:     p.Verb,
+				},
+			},
+		}
+
+		resp, err := client.Create(ctx, review, metav1.CreateOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("couldn't check permission to %s: %v", p, err)
+		}
+
+		if !resp.Status.Allowed {
+			missing = append(missing, p)
+		}
+	}
+
+	return missing, nil
+}
+
+// Figure out which optional features have to be turned off because of missing permissions.
+// Returns an error if a permission chaldeploy can't run without is missing
+func disabledFeatures(missing []Permission) (map[string]bool, error) {
+	disabled := map[string]bool{}
+	required := []string{}
+
+	for _, p := range missing {
+		if p.Feature == "" {
+			required = append(required, p.String())
+		} else {
+			disabled[p.Feature] = true
+		}
+	}
+
+	if len(required) > 0 {
+		return nil, fmt.Errorf("chaldeploy's service account is missing required permissions: %s", strings.Join(required, ", "))
+	}
+
+	return disabled, nil
+}
+
+// Format the missing permissions as a table for the logs
+func formatPermissionTable(missing []Permission) string {
+	sb := &strings.Builder{}
+	tw := tabwriter.NewWriter(sb, 0, 4, 2, ' ', 0)
+
+	fmt.Fprintln(tw, "PERMISSION\tFEATURE\tEFFECT")
+	for _, p := range missing {
+		if p.Feature == "" {
+			fmt.Fprintf(tw, "%s\t(required)\tchaldeploy can't start\n", p)
+		} else {
+			fmt.Fprintf(tw, "%s\t%s\tfeature disabled\n", p, p.Feature)
+		}
+	}
+	tw.Flush()
+
+	return sb.String()
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestDedupePermissions(t *testing.T) {
+	perms := dedupePermissions([]Permission{
+		{"apps", "deployments", "create", ""},
+		{"", "services", "get", ""},
+		{"apps", "deployments", "create", ""},
+		{"", "namespaces", "get", ""},
+	})
+
+	assert.Equal(t, []Permission{
+		{"", "namespaces", "get", ""},
+		{"", "services", "get", ""},
+		{"apps", "deployments", "create", ""},
+	}, perms)
+	assert.Equal(t, "create deployments.apps", perms[2].String())
+}
+
+func TestCheckPermissions(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	clientset.PrependReactor("create", "selfsubjectaccessreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8stesting.CreateAction).GetObject().(*authorizationv1.SelfSubjectAccessReview)
+		review.Status.Allowed = review.Spec.ResourceAttributes.Resource != "secrets"
+		return true, review, nil
+	})
+
+	missing, err := checkPermissions(context.Background(), clientset, append(basePermissions, accessTokenPermissions...))
+	assert.Nil(t, err)
+	assert.Equal(t, accessTokenPermissions, missing)
+}
+
+func TestDisabledFeatures(t *testing.T) {
+	disabled, err := disabledFeatures([]Permission{
+		{"apps", "deployments", "patch", FeatureRestart},
+		{"", "pods", "list", FeatureCrashDetection},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]bool{FeatureRestart: true, FeatureCrashDetection: true}, disabled)
+
+	_, err = disabledFeatures([]Permission{
+		{"apps", "deployments", "patch", FeatureRestart},
+		{"networking.k8s.io", "networkpolicies", "create", ""},
+	})
+	assert.ErrorContains(t, err, "create networkpolicies.networking.k8s.io")
+
+	table := formatPermissionTable([]Permission{
+		{"apps", "deployments", "patch", FeatureRestart},
+		{"", "limitranges", "create", ""},
+	})
+	assert.Contains(t, table, "patch deployments.apps  restart     feature disabled")
+	assert.Contains(t, table, "create limitranges      (required)  chaldeploy can't start")
+}
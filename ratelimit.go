@@ -0,0 +1,241 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/captainGeech42/chaldeploy/internal/generic_map"
+	"github.com/gorilla/sessions"
+	"golang.org/x/time/rate"
+)
+
+// token bucket for a single IP or team
+type rateLimiterEntry struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// RateLimiter is a set of token buckets keyed by IP or team ID
+type RateLimiter struct {
+	// tokens added per second
+	Limit rate.Limit
+
+	// max tokens in a bucket
+	Burst int
+
+	// how long it takes an empty bucket to fill back up, idle buckets are forgotten after this
+	Period time.Duration
+
+	buckets   *generic_map.MapOf[string, *rateLimiterEntry]
+	lastPrune time.Time
+	mu        sync.Mutex
+}
+
+// Parse a rate limit in the form of "<count>/<period>" (e.g., "10/1m"), allowing bursts of up to count requests.
+// Returns nil if the limit is "none"
+func parseRateLimit(s string) (*RateLimiter, error) {
+	if s == "none" {
+		return nil, nil
+	}
+
+	parts := strings.Split(s, "/")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid rate limit, must be <count>/<period> or none: %s", s)
+	}
+
+	count, err := strconv.Atoi(parts[0])
+	if err != nil || count < 1 {
+		return nil, fmt.Errorf("invalid rate limit count, must be a positive integer: %s", s)
+	}
+
+	period, err := time.ParseDuration(parts[1])
+	if err != nil || period <= 0 {
+		return nil, fmt.Errorf("invalid rate limit period, must be a positive duration (e.g., 1m): %s", s)
+	}
+
+	return &RateLimiter{
+		Limit:   rate.Limit(float64(count) / period.Seconds()),
+		Burst:   count,
+		Period:  period,
+		buckets: new(generic_map.MapOf[string, *rateLimiterEntry]),
+	}, nil
+}
+
+// Take a token from the bucket for a key. If the bucket is empty, returns false and how long until there's a token
+func (rl *RateLimiter) Allow(key string, now time.Time) (bool, time.Duration) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	rl.prune(now)
+
+	entry, ok := rl.buckets.Load(key)
+	if !ok {
+		entry = &rateLimiterEntry{limiter: rate.NewLimiter(rl.Limit, rl.Burst)}
+		rl.buckets.Store(key, entry)
+	}
+	entry.lastSeen = now
+
+	r := entry.limiter.ReserveN(now, 1)
+	if delay := r.DelayFrom(now); delay > 0 {
+		r.CancelAt(now)
+		return false, delay
+	}
+
+	return true, 0
+}
+
+// Forget buckets that have been idle long enough to fill back up, at most once per period
+func (rl *RateLimiter) prune(now time.Time) {
+	if now.Sub(rl.lastPrune) < rl.Period {
+		return
+	}
+	rl.lastPrune = now
+
+	rl.buckets.Range(func(key string, entry *rateLimiterEntry) bool {
+		if now.Sub(entry.lastSeen) >= rl.Period {
+			rl.buckets.Delete(key)
+		}
+		return true
+	})
+}
+
+// rate limits from the config, nil if they're turned off
+type RateLimits struct {
+	// every /api request, per IP
+	IP *RateLimiter
+
+	// logging in, per IP
+	Auth *RateLimiter
+
+	// creating an instance, per team
+	Create *RateLimiter
+
+	// extending, restarting, allowing IPs, and destroying, per team
+	Manage *RateLimiter
+}
+
+// Load the rate limits from the config
+func newRateLimits(c *Config) (*RateLimits, error) {
+	limits := &RateLimits{}
+
+	for _, l := range []struct {
+		dst   **RateLimiter
+		value string
+	}{
+		{&limits.IP, c.RateLimitIP},
+		{&limits.Auth, c.RateLimitAuth},
+		{&limits.Create, c.RateLimitCreate},
+		{&limits.Manage, c.RateLimitManage},
+	} {
+		rl, err := parseRateLimit(l.value)
+		if err != nil {
+			return nil, err
+		}
+		*l.dst = rl
+	}
+
+	return limits, nil
+}
+
+// Set the Retry-After header, in whole seconds
+func setRetryAfter(w http.ResponseWriter, d time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(d.Seconds()))))
+}
+
+// Respond with a 429. v2 requests get a JSON error, v1 requests don't have a body
+func writeRateLimited(w http.ResponseWriter, r *http.Request, retryAfter time.Duration) {
+	setRetryAfter(w, retryAfter)
+
+	if strings.HasPrefix(r.URL.Path, "/api/v2/") {
+		writeAPIError(w, http.StatusTooManyRequests, "rate_limited", "too many requests, try again in a bit", true)
+		return
+	}
+
+	w.WriteHeader(http.StatusTooManyRequests)
+}
+
+// Limit the requests from each IP, for routes that aren't tied to a team
+func rateLimitIP(rl *RateLimiter) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if rl == nil {
+			return next
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if ok, retryAfter := rl.Allow(requestIP(r), time.Now().UTC()); !ok {
+				writeRateLimited(w, r, retryAfter)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// Limit the requests from each team to a v1 route. Requests without a session are left for the handler to reject
+func rateLimitSession(rl *RateLimiter, h sessionHandler) sessionHandler {
+	if rl == nil {
+		return h
+	}
+
+	return func(w http.ResponseWriter, r *http.Request, s *sessions.Session) {
+		if teamId, ok := s.Values["id"].(string); ok && !s.IsNew {
+			if ok, retryAfter := rl.Allow(teamId, time.Now().UTC()); !ok {
+				writeRateLimited(w, r, retryAfter)
+				return
+			}
+		}
+
+		h(w, r, s)
+	}
+}
+
+// Limit the requests from each team to a v2 route
+func rateLimitTeam(rl *RateLimiter, h teamHandler) teamHandler {
+	if rl == nil {
+		return h
+	}
+
+	return func(w http.ResponseWriter, r *http.Request, team Team) {
+		if ok, retryAfter := rl.Allow(team.Id, time.Now().UTC()); !ok {
+			writeRateLimited(w, r, retryAfter)
+			return
+		}
+
+		h(w, r, team)
+	}
+}
+
+// How long until a cooldown that started at a time is over, 0 if it already is
+func cooldownRemaining(start *time.Time, cooldown int, now time.Time) time.Duration {
+	if start == nil {
+		return 0
+	}
+
+	if remaining := start.Add(time.Duration(cooldown) * time.Second).Sub(now); remaining > 0 {
+		return remaining
+	}
+
+	return 0
+}
+
+// Set Retry-After if a team's request failed because of a cooldown on their instance
+func setCooldownRetryAfter(w http.ResponseWriter, err error, teamId string) {
+	di := im.GetDeploymentInstance(teamId)
+	if di == nil {
+		return
+	}
+
+	now := time.Now().UTC()
+	if errors.Is(err, errRecreateCooldown) {
+		setRetryAfter(w, cooldownRemaining(di.LastDestroy, config.RecreateCooldown, now))
+	} else if errors.Is(err, errRestartCooldown) {
+		setRetryAfter(w, cooldownRemaining(di.LastRestart, config.RestartCooldown, now))
+	}
+}
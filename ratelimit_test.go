@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/captainGeech42/chaldeploy/internal/generic_map"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRateLimit(t *testing.T) {
+	rl, err := parseRateLimit("10/1m")
+	assert.Nil(t, err)
+	assert.Equal(t, 10, rl.Burst)
+	assert.Equal(t, time.Minute, rl.Period)
+
+	rl, err = parseRateLimit("none")
+	assert.Nil(t, err)
+	assert.Nil(t, rl)
+
+	for _, s := range []string{"10", "0/1m", "ten/1m", "10/forever", "10/-1m"} {
+		_, err = parseRateLimit(s)
+		assert.NotNil(t, err, s)
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	rl, _ := parseRateLimit("2/1m")
+	now := time.Now().UTC()
+
+	// bursts up to the count, then one token every 30s
+	ok, _ := rl.Allow("a", now)
+	assert.True(t, ok)
+	ok, _ = rl.Allow("a", now)
+	assert.True(t, ok)
+	ok, retryAfter := rl.Allow("a", now)
+	assert.False(t, ok)
+	assert.Equal(t, 30*time.Second, retryAfter)
+
+	// other keys have their own bucket
+	ok, _ = rl.Allow("b", now)
+	assert.True(t, ok)
+
+	ok, _ = rl.Allow("a", now.Add(30*time.Second))
+	assert.True(t, ok)
+
+	// idle buckets are forgotten
+	rl.Allow("c", now.Add(10*time.Minute))
+	_, exists := rl.buckets.Load("a")
+	assert.False(t, exists)
+}
+
+func TestRateLimitedRequests(t *testing.T) {
+	config = &Config{RecreateCooldown: 60}
+	im = &InstanceManager{Instances: new(generic_map.MapOf[string, *DeploymentInstance])}
+	defer func() { config, im = nil, nil }()
+
+	rl, _ := parseRateLimit("1/1h")
+	h := teamHandler(rateLimitTeam(rl, createInstanceRequestV2))
+	store = newSessionStore([]byte("aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"), newMemorySessionBackend(), time.Hour)
+	defer func() { store = nil }()
+
+	// destroyed a second ago, has to wait to recreate it
+	lastDestroy := time.Now().UTC().Add(-time.Second)
+	im.Instances.Store("ratelimit", &DeploymentInstance{State: Destroyed, LastDestroy: &lastDestroy, mu: &sync.Mutex{}})
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, newV2Request(t, "POST", "ratelimit", ""))
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+	assert.Contains(t, rec.Body.String(), "recreate_cooldown")
+	assert.Equal(t, "59", rec.Header().Get("Retry-After"))
+
+	// out of tokens
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, newV2Request(t, "POST", "ratelimit", ""))
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+	assert.Contains(t, rec.Body.String(), "rate_limited")
+	assert.Equal(t, "3600", rec.Header().Get("Retry-After"))
+}
+
+func TestCooldownRemaining(t *testing.T) {
+	now := time.Now().UTC()
+	start := now.Add(-10 * time.Second)
+
+	assert.Equal(t, time.Duration(0), cooldownRemaining(nil, 60, now))
+	assert.Equal(t, 50*time.Second, cooldownRemaining(&start, 60, now))
+	assert.Equal(t, time.Duration(0), cooldownRemaining(&start, 5, now))
+}
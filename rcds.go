@@ -0,0 +1,293 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"sigs.k8s.io/yaml"
+)
+
+// Partial struct for an rCDS challenge.yaml, only the fields relevant to deploying the challenge are parsed
+// ref: https://github.com/redpwn/rcds/blob/master/rcds/challenge/challenge.schema.yaml
+type RcdsChallenge struct {
+	Name string `json:"name"`
+
+	// can be a string or an object (e.g., {file: flag.txt}), only string flags are used
+	Flag json.RawMessage `json:"flag"`
+
+	// map of container name -> container config
+	Containers map[string]RcdsContainer `json:"containers"`
+
+	// map of container name -> exposed ports
+	Expose map[string][]RcdsExpose `json:"expose"`
+}
+
+// Container config from an rCDS challenge.yaml
+type RcdsContainer struct {
+	Image string `json:"image"`
+
+	// chaldeploy can't build images, only checked so a useful error can be given
+	Build interface{} `json:"build"`
+
+	Replicas *int32 `json:"replicas"`
+
+	Ports []int `json:"ports"`
+
+	Environment map[string]interface{} `json:"environment"`
+
+	Resources *corev1.ResourceRequirements `json:"resources"`
+}
+
+// Exposed port config from an rCDS challenge.yaml
+type RcdsExpose struct {
+	// port on the container
+	Target int `json:"target"`
+
+	// port to expose over TCP
+	Tcp int `json:"tcp"`
+
+	// subdomain to expose over HTTP, not supported by chaldeploy
+	Http string `json:"http"`
+}
+
+// Load and validate an rCDS challenge.yaml
+func loadRcdsChallenge(path string) (*RcdsChallenge, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read rCDS challenge %s: %v", path, err)
+	}
+
+	rc := &RcdsChallenge{}
+	if err := yaml.Unmarshal(data, rc); err != nil {
+		return nil, fmt.Errorf("couldn't parse rCDS challenge %s: %v", path, err)
+	}
+
+	if len(rc.Containers) == 0 {
+		return nil, errors.New("rCDS challenge doesn't define any containers")
+	}
+
+	for name, c := range rc.Containers {
+		if c.Image == "" {
+			if c.Build != nil {
+				return nil, fmt.Errorf("rCDS container %s is built from source, which chaldeploy doesn't support. push the image and set `image` instead", name)
+			}
+
+			return nil, fmt.Errorf("rCDS container %s doesn't have an image", name)
+		}
+	}
+
+	// chaldeploy gives each team a single LoadBalancer, so only one container can be exposed
+	if len(rc.Expose) != 1 {
+		return nil, fmt.Errorf("rCDS challenge must expose exactly one container (found %d)", len(rc.Expose))
+	}
+	for name, ports := range rc.Expose {
+		if _, ok := rc.Containers[name]; !ok {
+			return nil, fmt.Errorf("rCDS challenge exposes a non-existent container: %s", name)
+		}
+
+		if len(ports) == 0 {
+			return nil, fmt.Errorf("rCDS challenge doesn't expose any ports for %s", name)
+		}
+
+		for _, p := range ports {
+			if p.Http != "" {
+				return nil, fmt.Errorf("rCDS challenge exposes %s over HTTP, only TCP is supported", name)
+			}
+
+			if p.Tcp == 0 || p.Target == 0 {
+				return nil, fmt.Errorf("rCDS challenge has an invalid expose config for %s: both target and tcp must be set", name)
+			}
+		}
+	}
+
+	return rc, nil
+}
+
+// Get the name of the exposed container and its exposed ports
+func (rc *RcdsChallenge) exposed() (string, []RcdsExpose) {
+	for name, ports := range rc.Expose {
+		return name, ports
+	}
+
+	return "", nil
+}
+
+// Get the flag, if it's set as a plain string
+func (rc *RcdsChallenge) flag() string {
+	var flag string
+	if err := json.Unmarshal(rc.Flag, &flag); err != nil {
+		return ""
+	}
+
+	return flag
+}
+
+// Fill in the challenge fields that weren't set with env vars
+func (rc *RcdsChallenge) applyToConfig(c *Config) {
+	name, ports := rc.exposed()
+
+	if c.ChallengeName == "" {
+		c.ChallengeName = rc.Name
+	}
+
+	if c.ChallengePort == 0 {
+		c.ChallengePort = ports[0].Tcp
+	}
+
+	if c.ChallengeImage == "" {
+		c.ChallengeImage = rc.Containers[name].Image
+	}
+
+	if c.Flag == "" {
+		c.Flag = rc.flag()
+	}
+}
+
+// Translate the rCDS challenge into k8s objects for a team.
+// Like rCDS, each container gets a Deployment and a Service named after the container, so containers
+// can reach each other by name. The exposed container also gets the LoadBalancer Service named after the app.
+func (rc *RcdsChallenge) Objects(vars *ManifestVars) ([]*unstructured.Unstructured, error) {
+	objs := []runtime.Object{}
+
+	// iterate the containers in a stable order, map order is random
+	names := []string{}
+	for name := range rc.Containers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		c := rc.Containers[name]
+		labels := map[string]string{
+			"app":                                vars.AppName,
+			"chaldeploy.captaingee.ch/container": name,
+		}
+
+		container := corev1.Container{
+			Name:  name,
+			Image: c.Image,
+		}
+		for _, p := range c.Ports {
+			container.Ports = append(container.Ports, corev1.ContainerPort{ContainerPort: int32(p)})
+		}
+		if c.Resources != nil {
+			container.Resources = *c.Resources
+		}
+
+		// probe the exposed container on the port the LB sends traffic to
+		if exposedName, ports := rc.exposed(); exposedName == name {
+			container.ReadinessProbe = getProbe(ports[0].Target, false)
+			container.LivenessProbe = getProbe(ports[0].Target, true)
+		}
+
+		// sort the env vars so the spec is deterministic
+		envNames := []string{}
+		for k := range c.Environment {
+			envNames = append(envNames, k)
+		}
+		sort.Strings(envNames)
+		for _, k := range envNames {
+			container.Env = append(container.Env, corev1.EnvVar{Name: k, Value: fmt.Sprint(c.Environment[k])})
+		}
+
+		b := false
+		deployment := &appsv1.Deployment{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "apps/v1", Kind: "Deployment"},
+			ObjectMeta: metav1.ObjectMeta{Name: name, Labels: labels},
+			Spec: appsv1.DeploymentSpec{
+				Replicas: c.Replicas,
+				Selector: &metav1.LabelSelector{MatchLabels: labels},
+				Template: corev1.PodTemplateSpec{
+					ObjectMeta: metav1.ObjectMeta{Labels: labels},
+					Spec: hardenPodSpec(corev1.PodSpec{
+						AutomountServiceAccountToken: &b,
+						Containers:                   []corev1.Container{container},
+					}),
+				},
+			},
+		}
+
+		// the exposed container gets the gateway, one listen port per exposed port
+		if exposedName, ports := rc.exposed(); exposedName == name && config.AccessControl == "token" {
+			gatewayPorts := [][2]int{}
+			for i, p := range ports {
+				gatewayPorts = append(gatewayPorts, [2]int{config.GatewayPort + i, p.Target})
+			}
+			addGateway(&deployment.Spec.Template.Spec, vars.AppName, gatewayPorts)
+		}
+
+		objs = append(objs, deployment)
+
+		// internal service so the other containers can reach this one
+		if len(c.Ports) > 0 {
+			service := &corev1.Service{
+				TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "Service"},
+				ObjectMeta: metav1.ObjectMeta{Name: name, Labels: labels},
+				Spec: corev1.ServiceSpec{
+					Selector: labels,
+					Type:     corev1.ServiceTypeClusterIP,
+				},
+			}
+			for _, p := range c.Ports {
+				service.Spec.Ports = append(service.Spec.Ports, corev1.ServicePort{
+					Name:       fmt.Sprintf("port-%d", p),
+					Port:       int32(p),
+					TargetPort: intstr.FromInt(p),
+					Protocol:   corev1.ProtocolTCP,
+				})
+			}
+			objs = append(objs, service)
+		}
+	}
+
+	// public service for the exposed container
+	exposedName, ports := rc.exposed()
+	lbService := &corev1.Service{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "Service"},
+		ObjectMeta: metav1.ObjectMeta{Name: vars.AppName, Labels: map[string]string{"app": vars.AppName}},
+		Spec: corev1.ServiceSpec{
+			Selector: map[string]string{
+				"app":                                vars.AppName,
+				"chaldeploy.captaingee.ch/container": exposedName,
+			},
+			Type: corev1.ServiceTypeLoadBalancer,
+		},
+	}
+	for i, p := range ports {
+		// send traffic through the gateway if connections need an access token
+		targetPort := p.Target
+		if config.AccessControl == "token" {
+			targetPort = config.GatewayPort + i
+		}
+
+		lbService.Spec.Ports = append(lbService.Spec.Ports, corev1.ServicePort{
+			Name:       fmt.Sprintf("port-%d", p.Tcp),
+			Port:       int32(p.Tcp),
+			TargetPort: intstr.FromInt(targetPort),
+			Protocol:   corev1.ProtocolTCP,
+		})
+	}
+	objs = append(objs, lbService)
+
+	// convert everything to unstructured so it can be created the same way as manifests
+	ret := []*unstructured.Unstructured{}
+	for _, o := range objs {
+		u, err := runtime.DefaultUnstructuredConverter.ToUnstructured(o)
+		if err != nil {
+			return nil, err
+		}
+
+		ret = append(ret, &unstructured.Unstructured{Object: u})
+	}
+
+	return ret, nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+const testRcdsChallenge = `name: web-with-db
+author: someone
+flag: flag{rcds}
+containers:
+  app:
+    image: captaingeech/test-web:latest
+    ports: [8080]
+    environment:
+      DB_HOST: db
+      DB_PORT: 5432
+    resources:
+      limits:
+        cpu: 500m
+        memory: 256Mi
+  db:
+    image: postgres:14
+    ports: [5432]
+expose:
+  app:
+  - target: 8080
+    tcp: 31337
+`
+
+func writeRcdsChallenge(t *testing.T, contents string) string {
+	path := filepath.Join(t.TempDir(), "challenge.yaml")
+	if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestRcdsChallenge(t *testing.T) {
+	config = &Config{SeccompProfile: "RuntimeDefault"}
+	defer func() { config = nil }()
+
+	rc, err := loadRcdsChallenge(writeRcdsChallenge(t, testRcdsChallenge))
+	assert.Nil(t, err)
+	assert.NotNil(t, rc)
+
+	c := &Config{ChallengeName: "override"}
+	rc.applyToConfig(c)
+	assert.Equal(t, "override", c.ChallengeName)
+	assert.Equal(t, 31337, c.ChallengePort)
+	assert.Equal(t, "captaingeech/test-web:latest", c.ChallengeImage)
+	assert.Equal(t, "flag{rcds}", c.Flag)
+
+	objs, err := rc.Objects(&ManifestVars{AppName: "chaldeploy-abc-team"})
+	assert.Nil(t, err)
+
+	// deployment + service for each container, plus the LB
+	assert.Len(t, objs, 5)
+	kinds := []string{}
+	for _, o := range objs {
+		kinds = append(kinds, o.GetKind()+"/"+o.GetName())
+	}
+	assert.Equal(t, []string{"Deployment/app", "Service/app", "Deployment/db", "Service/db", "Service/chaldeploy-abc-team"}, kinds)
+
+	// generated pods are hardened
+	runAsNonRoot, _, _ := unstructured.NestedBool(objs[0].Object, "spec", "template", "spec", "securityContext", "runAsNonRoot")
+	assert.True(t, runAsNonRoot)
+
+	lb := objs[4].Object["spec"].(map[string]interface{})
+	assert.Equal(t, "LoadBalancer", lb["type"])
+	assert.Equal(t, "app", lb["selector"].(map[string]interface{})["chaldeploy.captaingee.ch/container"])
+}
+
+func TestRcdsChallengeBuildOnly(t *testing.T) {
+	rc, err := loadRcdsChallenge(writeRcdsChallenge(t, `name: x
+containers:
+  main:
+    build: .
+    ports: [1337]
+expose:
+  main:
+  - target: 1337
+    tcp: 1337
+`))
+	assert.NotNil(t, err)
+	assert.Nil(t, rc)
+}
+
+func TestRcdsChallengeHttpExpose(t *testing.T) {
+	rc, err := loadRcdsChallenge(writeRcdsChallenge(t, `name: x
+containers:
+  main:
+    image: x:latest
+    ports: [80]
+expose:
+  main:
+  - target: 80
+    http: x
+`))
+	assert.NotNil(t, err)
+	assert.Nil(t, rc)
+}
+
+func TestRcdsConfig(t *testing.T) {
+	t.Setenv("CHALDEPLOY_RCDS_CHALLENGE", writeRcdsChallenge(t, testRcdsChallenge))
+	t.Setenv("CHALDEPLOY_SESSION_KEY", "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa")
+	t.Setenv("CHALDEPLOY_RCTF_SERVER", "https://2021.redpwn.net")
+
+	config, err := loadConfig()
+	assert.Nil(t, err)
+	assert.NotNil(t, config)
+
+	assert.Equal(t, "web-with-db", config.ChallengeName)
+	assert.Equal(t, 31337, config.ChallengePort)
+}
@@ -7,6 +7,10 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"sync"
+	"time"
+
+	"github.com/captainGeech42/chaldeploy/internal/generic_map"
 )
 
 // Fields always present in an API response from rCTF
@@ -79,6 +83,9 @@ func authToRctf(loginToken string) (string, error) {
 	return rctfResp.Data.AuthToken, nil
 }
 
+// returned by getUserInfo if rCTF rejected the auth token
+var errBadAuthToken = errors.New("rCTF rejected the auth token")
+
 // Get user info from the rCTF API
 func getUserInfo(authToken string) (*RctfUserInfoData, error) {
 	if config == nil {
@@ -110,9 +117,60 @@ func getUserInfo(authToken string) (*RctfUserInfoData, error) {
 		return nil, err
 	}
 
-	if rctfResp.Kind != "goodUserData" {
+	if rctfResp.Kind != "goodUserData" && resp.StatusCode >= 400 && resp.StatusCode < 500 {
+		return nil, fmt.Errorf("%w (%s): %s", errBadAuthToken, rctfResp.Kind, rctfResp.Message)
+	} else if rctfResp.Kind != "goodUserData" {
 		return nil, fmt.Errorf("got bad data from rCTF api (%s): %s", rctfResp.Kind, rctfResp.Message)
 	}
 
 	return &rctfResp.Data, nil
 }
+
+// user info for an auth token, or the error if rCTF rejected it
+type cachedUserInfo struct {
+	info    *RctfUserInfoData
+	err     error
+	expTime time.Time
+}
+
+// Cache of user info by auth token, so requests authenticated with a token don't all go to rCTF
+var userInfoCache = new(generic_map.MapOf[string, cachedUserInfo])
+var userInfoCacheLastPrune time.Time
+var userInfoCachePruneLock sync.Mutex
+
+// Get user info from the rCTF API, cached for $CHALDEPLOY_TOKEN_CACHE_TTL seconds.
+// Rejected tokens are cached too, other errors aren't
+func getCachedUserInfo(authToken string, now time.Time) (*RctfUserInfoData, error) {
+	if c, ok := userInfoCache.Load(authToken); ok && now.Before(c.expTime) {
+		return c.info, c.err
+	}
+
+	info, err := getUserInfo(authToken)
+	if err != nil && !errors.Is(err, errBadAuthToken) {
+		return nil, err
+	}
+
+	ttl := time.Duration(config.TokenCacheTTL) * time.Second
+	userInfoCache.Store(authToken, cachedUserInfo{info: info, err: err, expTime: now.Add(ttl)})
+	pruneUserInfoCache(now, ttl)
+
+	return info, err
+}
+
+// Remove expired entries from the user info cache, at most once per ttl
+func pruneUserInfoCache(now time.Time, ttl time.Duration) {
+	userInfoCachePruneLock.Lock()
+	defer userInfoCachePruneLock.Unlock()
+
+	if now.Sub(userInfoCacheLastPrune) < ttl {
+		return
+	}
+	userInfoCacheLastPrune = now
+
+	userInfoCache.Range(func(token string, c cachedUserInfo) bool {
+		if !now.Before(c.expTime) {
+			userInfoCache.Delete(token)
+		}
+		return true
+	})
+}
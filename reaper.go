@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// max time to wait before retrying a deployment that couldn't be destroyed
+const REAPER_MAX_BACKOFF = time.Duration(15) * time.Minute
+
+// extra time a run gets before the reaper is considered stuck, destroying a namespace can take a few minutes
+const REAPER_RUN_GRACE = time.Duration(10) * time.Minute
+
+// ReaperStatus is the outcome of the last run of the reaper
+type ReaperStatus struct {
+	// when the last run started, zero if the reaper hasn't run yet
+	LastRun time.Time `json:"lastRun"`
+
+	// how long the last run took
+	Duration string `json:"duration"`
+
+	// number of instances destroyed by the last run
+	Destroyed int `json:"destroyed"`
+
+	// number of instances that couldn't be destroyed by the last run
+	Failed int `json:"failed"`
+
+	// number of instances waiting to be retried
+	Retrying int `json:"retrying"`
+
+	// error from the last failed destroy, if any
+	LastError string `json:"lastError,omitempty"`
+}
+
+// a deployment that couldn't be destroyed, and when to try it again
+type reapFailure struct {
+	attempts int
+	nextTry  time.Time
+}
+
+// Reaper destroys expired instances in the background
+type Reaper struct {
+	// max number of instances to destroy at once
+	Workers int
+
+	// how often to look for expired instances
+	Interval time.Duration
+
+	// instances to check for expiry
+	im *InstanceManager
+
+	// destroys a deployment, swapped out in tests
+	destroy func(ctx context.Context, di *DeploymentInstance) error
+
+	// picks up changes made to instances outside of chaldeploy, swapped out in tests
+	resync func(ctx context.Context) error
+
+	// lock for the status and failures
+	mu sync.Mutex
+
+	// outcome of the last run
+	status ReaperStatus
+
+	// when Run was called, zero if the reaper isn't running
+	started time.Time
+
+	// deployments that couldn't be destroyed, keyed by team id
+	failures map[string]*reapFailure
+}
+
+// Create a reaper for the instances managed by an InstanceManager
+func newReaper(im *InstanceManager, workers int, interval time.Duration) *Reaper {
+	if workers < 1 {
+		workers = 1
+	}
+
+	return &Reaper{
+		Workers:  workers,
+		Interval: interval,
+		im:       im,
+		destroy:  reapInstance,
+		resync:   im.Resync,
+		failures: map[string]*reapFailure{},
+	}
+}
+
+// Destroy an expired deployment, or retry one that previously failed to be destroyed
+func reapInstance(ctx context.Context, di *DeploymentInstance) error {
+	if di.State == Destroying {
+		return di.RetryDestroy(ctx)
+	}
+
+	_, err := di.DestroyInstance(ctx)
+	return err
+}
+
+// How long to wait before retrying a deployment that failed to be destroyed.
+// Doubles with each attempt, capped at REAPER_MAX_BACKOFF
+func reaperBackoff(attempts int, base time.Duration) time.Duration {
+	backoff := base
+	for i := 1; i < attempts && backoff < REAPER_MAX_BACKOFF; i++ {
+		backoff *= 2
+	}
+
+	if backoff > REAPER_MAX_BACKOFF {
+		backoff = REAPER_MAX_BACKOFF
+	}
+
+	return backoff
+}
+
+// Look for expired instances every interval until the context is canceled.
+// Errors are recorded and retried, they don't stop the reaper
+func (r *Reaper) Run(ctx context.Context) {
+	r.mu.Lock()
+	r.started = time.Now().UTC()
+	r.mu.Unlock()
+
+	for {
+		status := r.RunOnce(ctx)
+		if status.Failed > 0 {
+			log.Printf("reaper couldn't destroy %d instance(s), last error: %s", status.Failed, status.LastError)
+		}
+
+		if !sleepCtx(ctx, r.Interval) {
+			return
+		}
+	}
+}
+
+// Destroy the expired instances and retry the ones that are due, using up to r.Workers at once
+func (r *Reaper) RunOnce(ctx context.Context) ReaperStatus {
+	start := time.Now().UTC()
+
+	// instances may have been extended or destroyed with `chaldeploy instances`
+	if err := r.resync(ctx); err != nil {
+		log.Printf("reaper couldn't resync instances: %v", err)
+	}
+
+	// figure out what needs to be destroyed
+	due := map[string]*DeploymentInstance{}
+	r.mu.Lock()
+	r.im.Instances.Range(func(teamId string, di *DeploymentInstance) bool {
+		if f, failed := r.failures[teamId]; failed {
+			if di.State != Destroying {
+				// someone else finished it off (or it was recreated), stop retrying
+				delete(r.failures, teamId)
+			} else if !f.nextTry.After(start) {
+				due[teamId] = di
+			}
+		} else if di.State == Running && di.ExpTime != nil && di.ExpTime.Before(start) {
+			due[teamId] = di
+		}
+
+		return true
+	})
+	r.mu.Unlock()
+
+	// destroy them with a bounded number of workers
+	type result struct {
+		teamId string
+		err    error
+	}
+	jobs := make(chan string)
+	results := make(chan result, len(due))
+	wg := sync.WaitGroup{}
+	for i := 0; i < r.Workers && i < len(due); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for teamId := range jobs {
+				results <- result{teamId, r.destroy(ctx, due[teamId])}
+			}
+		}()
+	}
+	for teamId := range due {
+		jobs <- teamId
+	}
+	close(jobs)
+	wg.Wait()
+	close(results)
+
+	// record the outcome
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	status := ReaperStatus{LastRun: start}
+	for res := range results {
+		if res.err == nil {
+			delete(r.failures, res.teamId)
+			status.Destroyed++
+			continue
+		}
+
+		f, ok := r.failures[res.teamId]
+		if !ok {
+			f = &reapFailure{}
+			r.failures[res.teamId] = f
+		}
+		f.attempts++
+		f.nextTry = time.Now().UTC().Add(reaperBackoff(f.attempts, r.Interval))
+
+		status.Failed++
+		status.LastError = res.err.Error()
+	}
+	status.Retrying = len(r.failures)
+	status.Duration = time.Since(start).Round(time.Millisecond).String()
+
+	r.status = status
+	return status
+}
+
+// Get the outcome of the last run
+func (r *Reaper) Status() ReaperStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.status
+}
+
+// Check if the reaper has finished a run recently. A run can take a while if a lot of
+// instances expire at once, so it gets a few intervals plus REAPER_RUN_GRACE before it's considered stuck
+func (r *Reaper) Healthy(now time.Time) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	last := r.status.LastRun
+	if last.IsZero() {
+		if r.started.IsZero() {
+			return false
+		}
+		last = r.started
+	}
+
+	return now.Sub(last) < 3*r.Interval+REAPER_RUN_GRACE
+}
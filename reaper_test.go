@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/captainGeech42/chaldeploy/internal/generic_map"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReaperBackoff(t *testing.T) {
+	base := time.Duration(1) * time.Minute
+	assert.Equal(t, base, reaperBackoff(1, base))
+	assert.Equal(t, 2*base, reaperBackoff(2, base))
+	assert.Equal(t, 8*base, reaperBackoff(4, base))
+	assert.Equal(t, REAPER_MAX_BACKOFF, reaperBackoff(100, base))
+}
+
+func TestReaperRunOnce(t *testing.T) {
+	past := time.Now().UTC().Add(-time.Minute)
+	future := time.Now().UTC().Add(time.Hour)
+
+	testIm := &InstanceManager{Instances: new(generic_map.MapOf[string, *DeploymentInstance])}
+	testIm.Instances.Store("expired", &DeploymentInstance{AppName: "expired", State: Running, ExpTime: &past, mu: &sync.Mutex{}})
+	testIm.Instances.Store("stuck", &DeploymentInstance{AppName: "stuck", State: Running, ExpTime: &past, mu: &sync.Mutex{}})
+	testIm.Instances.Store("active", &DeploymentInstance{AppName: "active", State: Running, ExpTime: &future, mu: &sync.Mutex{}})
+
+	r := newReaper(testIm, 2, time.Duration(1)*time.Minute)
+	r.resync = func(ctx context.Context) error { return nil }
+	destroyed := generic_map.MapOf[string, bool]{}
+	r.destroy = func(ctx context.Context, di *DeploymentInstance) error {
+		if di.AppName == "stuck" {
+			di.State = Destroying
+			return errors.New("namespace is stuck")
+		}
+
+		di.State = Destroyed
+		destroyed.Store(di.AppName, true)
+		return nil
+	}
+
+	status := r.RunOnce(context.Background())
+	assert.Equal(t, 1, status.Destroyed)
+	assert.Equal(t, 1, status.Failed)
+	assert.Equal(t, 1, status.Retrying)
+	assert.Equal(t, "namespace is stuck", status.LastError)
+	assert.Equal(t, status, r.Status())
+
+	_, ok := destroyed.Load("expired")
+	assert.True(t, ok)
+	_, ok = destroyed.Load("active")
+	assert.False(t, ok)
+
+	// the failure isn't retried until its backoff is up
+	status = r.RunOnce(context.Background())
+	assert.Equal(t, 0, status.Failed)
+	assert.Equal(t, 1, status.Retrying)
+
+	r.failures["stuck"].nextTry = time.Now().UTC().Add(-time.Second)
+	status = r.RunOnce(context.Background())
+	assert.Equal(t, 1, status.Failed)
+	assert.Equal(t, 2, r.failures["stuck"].attempts)
+
+	// stops retrying once the instance isn't stuck anymore
+	di, _ := testIm.Instances.Load("stuck")
+	di.State = Destroyed
+	status = r.RunOnce(context.Background())
+	assert.Equal(t, 0, status.Retrying)
+}
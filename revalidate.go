@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/captainGeech42/chaldeploy/internal/generic_map"
+	"github.com/gorilla/sessions"
+)
+
+// last time the team for each session was checked with rCTF, by session ID
+var sessionValidations = new(generic_map.MapOf[string, time.Time])
+
+// Check that rCTF still accepts the auth token for a session, at most once every $CHALDEPLOY_REVALIDATE_INTERVAL seconds.
+// If the team was banned or deleted, every session for the team is deleted and false is returned.
+// If rCTF can't be reached, the session is trusted until the next request
+func revalidateSession(w http.ResponseWriter, r *http.Request, s *sessions.Session, now time.Time) bool {
+	if config.RevalidateInterval == 0 || s.IsNew {
+		return true
+	}
+
+	teamId, ok := s.Values["id"].(string)
+	authToken, hasToken := s.Values["authToken"].(string)
+	if !ok || !hasToken {
+		return true
+	}
+
+	if last, ok := sessionValidations.Load(s.ID); ok && now.Sub(last) < time.Duration(config.RevalidateInterval)*time.Second {
+		return true
+	}
+
+	userInfo, err := getCachedUserInfo(authToken, now)
+	if err != nil && !errors.Is(err, errBadAuthToken) {
+		log.Printf("couldn't re-validate %s (ID: %s) with rCTF: %v", s.Values["teamName"], teamId, err)
+		return true
+	} else if err == nil && userInfo.Id == teamId {
+		sessionValidations.Store(s.ID, now)
+		return true
+	}
+
+	log.Printf("rCTF no longer accepts %s (ID: %s), logging them out", s.Values["teamName"], teamId)
+
+	if n, err := store.Backend.DeleteTeam(teamId); err != nil {
+		log.Printf("couldn't delete the sessions for %s: %v", teamId, err)
+	} else {
+		log.Printf("deleted %d session(s) for %s", n, teamId)
+	}
+
+	// expire the cookie too
+	sessionValidations.Delete(s.ID)
+	s.Options.MaxAge = -1
+	if err := s.Save(r, w); err != nil {
+		log.Printf("couldn't delete the session for %s: %v", teamId, err)
+	}
+
+	if config.DestroyInvalidTeams {
+		destroyInvalidTeamInstance(teamId)
+	}
+
+	return false
+}
+
+// Destroy the instance for a team that's no longer valid, in the background
+func destroyInvalidTeamInstance(teamId string) {
+	di := im.GetDeploymentInstance(teamId)
+	if di == nil || di.State != Running {
+		return
+	}
+
+	log.Printf("destroying the instance for invalid team %s", teamId)
+
+	go func() {
+		if err := im.DestroyDeployment(opCtx, teamId); err != nil {
+			log.Printf("couldn't destroy the instance for invalid team %s: %v", teamId, err)
+		}
+	}()
+}
+
+// Forget about validations for sessions that were last checked before a time, they're re-validated on the next request
+func pruneSessionValidations(before time.Time) {
+	sessionValidations.Range(func(id string, last time.Time) bool {
+		if last.Before(before) {
+			sessionValidations.Delete(id)
+		}
+		return true
+	})
+}
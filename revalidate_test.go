@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/captainGeech42/chaldeploy/internal/generic_map"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRevalidateSession(t *testing.T) {
+	// fake rCTF where the team can be banned
+	banned := false
+	userInfoCalls := 0
+	rctf := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userInfoCalls++
+		if banned {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"kind":"badToken","message":"The token provided is invalid."}`)
+			return
+		}
+		fmt.Fprint(w, `{"kind":"goodUserData","message":"ok","data":{"name":"g33chpwn","id":"revalidate"}}`)
+	}))
+	defer rctf.Close()
+
+	config = &Config{RctfServer: rctf.URL, TokenCacheTTL: 60, RevalidateInterval: 300}
+	store = newSessionStore([]byte("aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"), newMemorySessionBackend(), time.Hour)
+	im = &InstanceManager{Instances: new(generic_map.MapOf[string, *DeploymentInstance])}
+	defer func() { config, store, im = nil, nil, nil }()
+
+	// log in twice as the team
+	cookies := []*http.Cookie{}
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest("POST", "/api/auth", nil)
+		rec := httptest.NewRecorder()
+		s, _ := store.Get(req, "session")
+		s.Values["id"] = "revalidate"
+		s.Values["teamName"] = "g33chpwn"
+		s.Values["authToken"] = "revalidatetoken"
+		assert.Nil(t, s.Save(req, rec))
+		cookies = append(cookies, rec.Result().Cookies()[0])
+	}
+
+	check := func(c *http.Cookie, now time.Time) bool {
+		req := httptest.NewRequest("GET", "/api/status", nil)
+		req.AddCookie(c)
+		s, _ := store.Get(req, "session")
+		return revalidateSession(httptest.NewRecorder(), req, s, now)
+	}
+
+	// only checked with rCTF once per interval
+	now := time.Now().UTC()
+	assert.True(t, check(cookies[0], now))
+	assert.True(t, check(cookies[0], now.Add(time.Minute)))
+	assert.Equal(t, 1, userInfoCalls)
+
+	// banned teams get logged out everywhere once the interval and cache expire
+	banned = true
+	assert.True(t, check(cookies[0], now.Add(2*time.Minute)))
+	assert.False(t, check(cookies[1], now.Add(10*time.Minute)))
+	assert.Equal(t, 2, userInfoCalls)
+
+	n, _ := store.Backend.DeleteTeam("revalidate")
+	assert.Equal(t, 0, n)
+}
@@ -2,11 +2,11 @@ package main
 
 import (
 	"encoding/json"
-	// deliberately using this instead of html/template to leave html comments in more easily.
-	// templated data is not user controlled
-	"text/template"
-
+	"errors"
+	"fmt"
+	"html/template"
 	"io"
+	"net"
 	"net/http"
 	"net/url"
 	"strings"
@@ -21,10 +21,24 @@ import (
 var cachedIndex = ""
 var cachedIndexLock sync.Mutex
 
+// html/template strips comments, so this one gets passed in as trusted HTML
+const INDEX_HACKER_COMMENT = "<!-- ATTENTION HACKERS: THIS IS NOT THE CHALLENGE YOU ARE LOOKING FOR -->"
+
+// IndexData is everything the index template gets. Only add fields here that are safe to show to teams,
+// the config has secrets in it
+type IndexData struct {
+	ChallengeName   string
+	SourceAllowlist bool
+
+	// trusted HTML, never put anything from the config or a request in here
+	HackerComment template.HTML
+}
+
 func indexPage(w http.ResponseWriter, r *http.Request) {
 	if config == nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		log.Println("indexPage was called before config was set, can't render template")
+		return
 	}
 
 	// check if the index has been rendered yet
@@ -44,7 +58,7 @@ func indexPage(w http.ResponseWriter, r *http.Request) {
 
 			log.Println("actually rendering the index page")
 
-			t, err := template.ParseFiles("templates/index.html")
+			t, err := template.ParseFS(assets, "templates/index.html")
 			if err != nil {
 				w.WriteHeader(http.StatusInternalServerError)
 				log.Printf("failed to parse index template: %v", err)
@@ -52,7 +66,11 @@ func indexPage(w http.ResponseWriter, r *http.Request) {
 			}
 
 			sb := &strings.Builder{}
-			err = t.Execute(sb, config)
+			err = t.Execute(sb, IndexData{
+				ChallengeName:   config.ChallengeName,
+				SourceAllowlist: config.SourceAllowlist,
+				HackerComment:   template.HTML(INDEX_HACKER_COMMENT),
+			})
 			if err != nil {
 				w.WriteHeader(http.StatusInternalServerError)
 				log.Printf("failed to render index template: %v", err)
@@ -68,76 +86,131 @@ func indexPage(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte(cachedIndex))
 }
 
+// Get the IP of the client that sent a request, honoring X-Forwarded-For from trusted proxies
+func requestIP(r *http.Request) string {
+	// already validated when the config was loaded
+	trustedProxies, _ := config.getTrustedProxies()
+
+	return getClientIP(r, trustedProxies)
+}
+
+type HealthResponse struct {
+	Status string `json:"status"`
+
+	// outcome of the last run of the expired instance reaper, nil if it isn't running
+	Reaper *ReaperStatus `json:"reaper,omitempty"`
+}
+
 // GET /healthcheck
+// Always 200 while the app is up, includes the status of the reaper
 func healthCheck(w http.ResponseWriter, r *http.Request) {
-	w.Write([]byte("app good to go"))
-}
+	resp := HealthResponse{Status: "app good to go"}
+	if reaper != nil {
+		status := reaper.Status()
+		resp.Reaper = &status
+	}
 
-// POST /api/auth
-// Takes the auth url/login token, and gets an auth token for the rCTF api
-// Returns back the team name and 200 if successful, otherwise 403/500+
-func authRequest(w http.ResponseWriter, r *http.Request, s *sessions.Session) {
-	body, err := io.ReadAll(r.Body)
+	respBytes, err := json.Marshal(resp)
 	if err != nil {
-		log.Printf("error handling client auth, couldn't read body: %v", err)
+		log.Printf("error handling healthcheck, couldn't marshal response data: %v", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	bodyStr := string(body)
-	parts := strings.Split(bodyStr, "/login?token=")
+	w.Header().Add("Content-type", "application/json")
+	w.Write(respBytes)
+}
+
+// returned by loginTeam if rCTF rejected the login token
+var errBadLoginToken = errors.New("rCTF rejected the login token")
+
+// Log a team in with their rCTF auth url/login token, and save the team info to their session
+func loginTeam(w http.ResponseWriter, r *http.Request, s *sessions.Session, rawToken string) (*RctfUserInfoData, error) {
+	parts := strings.Split(rawToken, "/login?token=")
 	loginToken := parts[len(parts)-1]
 
 	// check if the token is url encoded, and decode if so
 	if strings.Contains(loginToken, "%") {
-		loginToken, err = url.QueryUnescape(loginToken)
+		decoded, err := url.QueryUnescape(loginToken)
 		if err != nil {
-			log.Printf("error handling client auth, couldn't decode login token: %v", err)
-			w.WriteHeader(http.StatusInternalServerError)
-			return
+			return nil, fmt.Errorf("couldn't decode login token: %v", err)
 		}
+		loginToken = decoded
 	}
 
 	authToken, err := authToRctf(loginToken)
 	if err != nil {
-		log.Printf("error handling client auth, couldn't auth to rCTF: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+		return nil, fmt.Errorf("couldn't auth to rCTF: %v", err)
 	}
 
 	if authToken == "" {
-		w.WriteHeader(http.StatusForbidden)
-		return
+		return nil, errBadLoginToken
 	}
 
 	// have a valid auth token, get team info
 	userInfo, err := getUserInfo(authToken)
 	if err != nil {
-		log.Printf("error handling client auth, couldn't get user info from rCTF: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+		return nil, fmt.Errorf("couldn't get user info from rCTF: %v", err)
 	}
 
-	// save the team data to the user's session
+	// save the team data to the user's session, under a new session ID
+	if err := store.RenewID(s); err != nil {
+		return nil, fmt.Errorf("couldn't renew the session ID: %v", err)
+	}
+	if _, ok := s.Values["csrfToken"]; !ok {
+		// keep the token the client got before logging in
+		if token := csrfCookieToken(r); token != "" {
+			s.Values["csrfToken"] = token
+		}
+	}
 	s.Values["teamName"] = userInfo.TeamName
 	s.Values["id"] = userInfo.Id
 	s.Values["authToken"] = authToken
 	if err = s.Save(r, w); err != nil {
-		log.Printf("error handling client auth, couldn't save the session: %v", err)
+		return nil, fmt.Errorf("couldn't save the session: %v", err)
+	}
+
+	log.Printf("successfully authenticated %s (ID: %s)", userInfo.TeamName, userInfo.Id)
+
+	return userInfo, nil
+}
+
+// POST /api/auth
+// Takes the auth url/login token, and gets an auth token for the rCTF api
+// Returns back the team name and 200 if successful, otherwise 403/500+
+func authRequest(w http.ResponseWriter, r *http.Request, s *sessions.Session) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		log.Printf("error handling client auth, couldn't read body: %v", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	log.Printf("successfully authenticated %s (ID: %s)", userInfo.TeamName, userInfo.Id)
+	userInfo, err := loginTeam(w, r, s, string(body))
+	if errors.Is(err, errBadLoginToken) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	} else if err != nil {
+		log.Printf("error handling client auth: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
 
 	// send back the team name
 	w.Write([]byte(userInfo.TeamName))
 }
 
 type StatusResponse struct {
-	State   string `json:"state"` // "active" || "inactive"
+	State   string `json:"state"` // "active" || "inactive" || "failed"
 	Host    string `json:"host,omitempty"`
 	ExpTime string `json:"expTime,omitempty"`
+	Health  string `json:"health,omitempty"` // "ready" || "starting" || "crashing" || "unknown"
+
+	// token to send when connecting to the instance, only set if access control is enabled
+	AccessToken string `json:"accessToken,omitempty"`
+
+	// CIDRs allowed to connect to the instance, only set if the source allowlist is enabled
+	AllowedIPs []string `json:"allowedIps,omitempty"`
 }
 
 // GET /api/status
@@ -153,9 +226,16 @@ func statusRequest(w http.ResponseWriter, r *http.Request, s *sessions.Session)
 	di := im.GetDeploymentInstance(s.Values["id"].(string))
 
 	var resp StatusResponse
+	var snap InstanceSnapshot
+	if di != nil {
+		snap = di.Snapshot()
+	}
 
-	if di != nil && di.State == Running {
-		resp = StatusResponse{State: "active", Host: di.GetCxn(), ExpTime: di.GetExpTime()}
+	if di != nil && snap.State == Running {
+		resp = StatusResponse{State: "active", Host: snap.GetCxn(), ExpTime: snap.GetExpTime(), Health: di.GetHealth(r.Context()), AccessToken: snap.AccessToken, AllowedIPs: snap.AllowedIPs}
+	} else if di != nil && snap.State == Failed {
+		// the reason is only logged, it may have cluster details that teams shouldn't see
+		resp = StatusResponse{State: "failed"}
 	} else {
 		resp = StatusResponse{State: "inactive"}
 	}
@@ -176,6 +256,7 @@ type CreateInstanceResponse struct {
 
 // POST /api/create
 // Create a deployment instance for the team
+// 429 means the team has to wait after destroying their instance before creating another
 func createInstanceRequest(w http.ResponseWriter, r *http.Request, s *sessions.Session) {
 	// make sure the session is valid
 	if _, exists := s.Values["id"]; s.IsNew || !exists {
@@ -186,10 +267,16 @@ func createInstanceRequest(w http.ResponseWriter, r *http.Request, s *sessions.S
 	log.Printf("Deploying instance for %s (ID: %s)", s.Values["teamName"], s.Values["id"])
 
 	// create the deployment
-	cxn, err := im.CreateDeployment(s.Values["id"].(string))
+	cxn, err := im.CreateDeployment(opCtx, s.Values["id"].(string), requestIP(r))
 	if err != nil {
 		log.Printf("couldn't create a deployment for %s: %v", s.Values["teamName"], err)
-		w.WriteHeader(http.StatusInternalServerError)
+
+		if errors.Is(err, errRecreateCooldown) {
+			setCooldownRetryAfter(w, err, s.Values["id"].(string))
+			w.WriteHeader(http.StatusTooManyRequests)
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
 		return
 	}
 
@@ -217,10 +304,15 @@ func extendInstanceRequest(w http.ResponseWriter, r *http.Request, s *sessions.S
 
 	log.Printf("Extending instance for %s (ID: %s)", s.Values["teamName"], s.Values["id"])
 
-	newExp, err := im.ExtendDeployment(s.Values["id"].(string))
+	newExp, err := im.ExtendDeployment(opCtx, s.Values["id"].(string))
 	if err != nil {
 		log.Printf("couldn't extend deployment for %s: %v", s.Values["teamName"], err)
-		w.WriteHeader(http.StatusInternalServerError)
+
+		if errors.Is(err, errFeatureDisabled) {
+			w.WriteHeader(http.StatusNotFound)
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
 		return
 	}
 
@@ -228,6 +320,94 @@ func extendInstanceRequest(w http.ResponseWriter, r *http.Request, s *sessions.S
 	w.Write([]byte(newExp))
 }
 
+// POST /api/restart
+// Restart the pods of a deployment instance, keeping the endpoint and expiration time
+// 200 means successfully restarted, 429 means the team has to wait before restarting again
+func restartInstanceRequest(w http.ResponseWriter, r *http.Request, s *sessions.Session) {
+	// make sure the session is valid
+	if _, exists := s.Values["id"]; s.IsNew || !exists {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	log.Printf("Restarting instance for %s (ID: %s)", s.Values["teamName"], s.Values["id"])
+
+	if err := im.RestartDeployment(opCtx, s.Values["id"].(string)); err != nil {
+		log.Printf("couldn't restart deployment for %s: %v", s.Values["teamName"], err)
+
+		if errors.Is(err, errRestartCooldown) {
+			setCooldownRetryAfter(w, err, s.Values["id"].(string))
+			w.WriteHeader(http.StatusTooManyRequests)
+		} else if errors.Is(err, errFeatureDisabled) {
+			w.WriteHeader(http.StatusNotFound)
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+type AllowIPResponse struct {
+	AllowedIPs []string `json:"allowedIps"`
+}
+
+// POST /api/allow-ip
+// Allow another IP to connect to the team's deployment instance.
+// The body is the IP to allow, if it's empty the IP sending the request is allowed
+func allowIPRequest(w http.ResponseWriter, r *http.Request, s *sessions.Session) {
+	// make sure the session is valid
+	if _, exists := s.Values["id"]; s.IsNew || !exists {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	if !config.SourceAllowlist || !im.FeatureEnabled(FeatureAllowIP) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, 64))
+	if err != nil {
+		log.Printf("error handling allow IP request, couldn't read body: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	ip := strings.TrimSpace(string(body))
+	if ip == "" {
+		ip = requestIP(r)
+	} else if net.ParseIP(ip) == nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	log.Printf("Allowing %s to connect to instance for %s (ID: %s)", ip, s.Values["teamName"], s.Values["id"])
+
+	allowedIPs, err := im.AllowSourceIP(opCtx, s.Values["id"].(string), ip)
+	if err != nil {
+		log.Printf("couldn't allow IP for %s: %v", s.Values["teamName"], err)
+
+		if errors.Is(err, errTooManyAllowedIPs) {
+			w.WriteHeader(http.StatusConflict)
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+
+	respBytes, err := json.Marshal(AllowIPResponse{AllowedIPs: allowedIPs})
+	if err != nil {
+		log.Printf("error handling allow IP request, couldn't marshal response data: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Add("Content-type", "application/json")
+	w.Write(respBytes)
+}
+
 // POST /api/destroy
 // Destroy a deployment instance
 // 200 means successfully destroy
@@ -240,7 +420,7 @@ func destroyInstanceRequest(w http.ResponseWriter, r *http.Request, s *sessions.
 
 	log.Printf("Destroying instance for %s (ID: %s)", s.Values["teamName"], s.Values["id"])
 
-	if err := im.DestroyDeployment(s.Values["id"].(string)); err != nil {
+	if err := im.DestroyDeployment(opCtx, s.Values["id"].(string)); err != nil {
 		log.Printf("error handling delete instance request, couldn't delete deployment: %v", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
@@ -248,3 +428,16 @@ func destroyInstanceRequest(w http.ResponseWriter, r *http.Request, s *sessions.
 
 	w.WriteHeader(http.StatusOK)
 }
+
+// POST /api/logout
+// Log out, deleting the session
+func logoutRequest(w http.ResponseWriter, r *http.Request, s *sessions.Session) {
+	s.Options.MaxAge = -1
+	if err := s.Save(r, w); err != nil {
+		log.Printf("error handling logout, couldn't delete the session: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
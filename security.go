@@ -0,0 +1,131 @@
+package main
+
+import (
+	"crypto/subtle"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+)
+
+// only allow resources from chaldeploy itself, and don't let other sites frame it
+const CONTENT_SECURITY_POLICY = "default-src 'self'; img-src 'self' data:; object-src 'none'; base-uri 'none'; form-action 'self'; frame-ancestors 'none'"
+
+// header the CSRF token has to be sent in for state-changing requests
+const CSRF_HEADER = "X-CSRF-Token"
+
+// cookie with the CSRF token for clients that aren't logged in, so they don't get a session on the server until they log in
+const CSRF_COOKIE = "csrf"
+
+// Add security headers to every response
+func securityHeadersMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Security-Policy", CONTENT_SECURITY_POLICY)
+		w.Header().Set("X-Frame-Options", "DENY")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("Referrer-Policy", "no-referrer")
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Check if a request needs a CSRF token. Safe methods don't change anything, and v2 requests
+// authenticated with a bearer token can't be forged by a browser
+func needsCSRFToken(r *http.Request) bool {
+	if r.Method == "GET" || r.Method == "HEAD" || r.Method == "OPTIONS" {
+		return false
+	}
+
+	return !(strings.HasPrefix(r.URL.Path, "/api/v2/") && r.Header.Get("Authorization") != "")
+}
+
+// Reject state-changing requests that don't have the CSRF token for the session
+func csrfMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !needsCSRFToken(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// logged in sessions have the token on the server, everyone else has it in the CSRF cookie
+		s, _ := store.Get(r, "session")
+		expected, ok := s.Values["csrfToken"].(string)
+		if !ok || s.IsNew {
+			expected = csrfCookieToken(r)
+		}
+		if expected == "" || subtle.ConstantTimeCompare([]byte(r.Header.Get(CSRF_HEADER)), []byte(expected)) != 1 {
+			log.Printf("rejected %s request from %s to %s without a valid CSRF token", r.Method, r.RemoteAddr, r.RequestURI)
+
+			if strings.HasPrefix(r.URL.Path, "/api/v2/") {
+				writeAPIError(w, http.StatusForbidden, "csrf_failed", "send the token from GET /api/csrf in the "+CSRF_HEADER+" header", false)
+			} else {
+				w.WriteHeader(http.StatusForbidden)
+			}
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+type CSRFTokenResponse struct {
+	// send this in the X-CSRF-Token header of every POST/DELETE with the session cookie
+	Token string `json:"token"`
+}
+
+// Get the CSRF token from the CSRF cookie, empty if there isn't a valid one
+func csrfCookieToken(r *http.Request) string {
+	c, err := r.Cookie(CSRF_COOKIE)
+	if err != nil {
+		return ""
+	}
+
+	var token string
+	if err := securecookie.DecodeMulti(CSRF_COOKIE, c.Value, &token, store.Codecs...); err != nil {
+		return ""
+	}
+
+	return token
+}
+
+// GET /api/csrf
+// Get the CSRF token for the session. Clients that aren't logged in get it in a cookie, and it's moved to the session when they log in
+func csrfTokenRequest(w http.ResponseWriter, r *http.Request, s *sessions.Session) {
+	if token, ok := s.Values["csrfToken"].(string); ok && !s.IsNew {
+		writeJSON(w, http.StatusOK, CSRFTokenResponse{Token: token})
+		return
+	}
+
+	token := csrfCookieToken(r)
+	if token == "" {
+		var err error
+		if token, err = generateSessionId(); err != nil {
+			log.Printf("error handling CSRF token request, couldn't generate a token: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if s.IsNew {
+		// nothing is stored on the server until the client logs in
+		encoded, err := securecookie.EncodeMulti(CSRF_COOKIE, token, store.Codecs...)
+		if err != nil {
+			log.Printf("error handling CSRF token request, couldn't encode the cookie: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		opts := *store.Options
+		http.SetCookie(w, sessions.NewCookie(CSRF_COOKIE, encoded, &opts))
+	} else {
+		s.Values["csrfToken"] = token
+		if err := s.Save(r, w); err != nil {
+			log.Printf("error handling CSRF token request, couldn't save the session: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	writeJSON(w, http.StatusOK, CSRFTokenResponse{Token: token})
+}
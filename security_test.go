@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSecurityHeaders(t *testing.T) {
+	rec := httptest.NewRecorder()
+	securityHeadersMiddleware(http.HandlerFunc(livenessCheck)).ServeHTTP(rec, httptest.NewRequest("GET", "/livez", nil))
+
+	assert.Equal(t, CONTENT_SECURITY_POLICY, rec.Header().Get("Content-Security-Policy"))
+	assert.Equal(t, "DENY", rec.Header().Get("X-Frame-Options"))
+	assert.Equal(t, "no-referrer", rec.Header().Get("Referrer-Policy"))
+}
+
+func TestCSRF(t *testing.T) {
+	config = &Config{}
+	store = newSessionStore([]byte("aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"), newMemorySessionBackend(), time.Hour)
+	defer func() { config, store = nil, nil }()
+
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) })
+	h := csrfMiddleware(ok)
+
+	// get a token, which starts a session
+	rec := httptest.NewRecorder()
+	sessionHandler(csrfTokenRequest).ServeHTTP(rec, httptest.NewRequest("GET", "/api/csrf", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	tokenResp := CSRFTokenResponse{}
+	assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), &tokenResp))
+	assert.NotEmpty(t, tokenResp.Token)
+	cookie := rec.Result().Cookies()[0]
+
+	send := func(method, path, token, authz string) int {
+		req := httptest.NewRequest(method, path, nil)
+		req.AddCookie(cookie)
+		if token != "" {
+			req.Header.Set(CSRF_HEADER, token)
+		}
+		if authz != "" {
+			req.Header.Set("Authorization", authz)
+		}
+
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	assert.Equal(t, http.StatusOK, send("GET", "/api/status", "", ""))
+	assert.Equal(t, http.StatusForbidden, send("POST", "/api/create", "", ""))
+	assert.Equal(t, http.StatusForbidden, send("POST", "/api/create", "nope", ""))
+	assert.Equal(t, http.StatusOK, send("POST", "/api/create", tokenResp.Token, ""))
+	assert.Equal(t, http.StatusForbidden, send("DELETE", "/api/v2/instance", "", ""))
+	assert.Equal(t, http.StatusOK, send("DELETE", "/api/v2/instance", tokenResp.Token, ""))
+
+	// bearer tokens don't need it, but only on v2
+	assert.Equal(t, http.StatusOK, send("POST", "/api/v2/instance", "", "Bearer token"))
+	assert.Equal(t, http.StatusForbidden, send("POST", "/api/create", "", "Bearer token"))
+
+	// the same token is handed out for the session
+	req := httptest.NewRequest("GET", "/api/csrf", nil)
+	req.AddCookie(cookie)
+	rec = httptest.NewRecorder()
+	sessionHandler(csrfTokenRequest).ServeHTTP(rec, req)
+	assert.Contains(t, rec.Body.String(), tokenResp.Token)
+}
+
+func TestCSRFBeforeLogin(t *testing.T) {
+	rctf := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/v1/auth/login" {
+			fmt.Fprint(w, `{"kind":"goodLogin","message":"ok","data":{"authToken":"csrftoken"}}`)
+			return
+		}
+		fmt.Fprint(w, `{"kind":"goodUserData","message":"ok","data":{"name":"g33chpwn","id":"csrf"}}`)
+	}))
+	defer rctf.Close()
+
+	config = &Config{RctfServer: rctf.URL, TokenCacheTTL: 60}
+	backend := newMemorySessionBackend()
+	store = newSessionStore([]byte("aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"), backend, time.Hour)
+	defer func() { config, store = nil, nil }()
+
+	// clients that aren't logged in don't get a session on the server
+	rec := httptest.NewRecorder()
+	sessionHandler(csrfTokenRequest).ServeHTTP(rec, httptest.NewRequest("GET", "/api/csrf", nil))
+	tokenResp := CSRFTokenResponse{}
+	assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), &tokenResp))
+	csrfCookie := rec.Result().Cookies()[0]
+	assert.Equal(t, CSRF_COOKIE, csrfCookie.Name)
+	n, _ := backend.Prune(time.Now().UTC().Add(48 * time.Hour))
+	assert.Equal(t, 0, n)
+
+	// logging in with it carries the token over to the session
+	req := httptest.NewRequest("POST", "/api/auth", strings.NewReader("logintoken"))
+	req.AddCookie(csrfCookie)
+	req.Header.Set(CSRF_HEADER, tokenResp.Token)
+	rec = httptest.NewRecorder()
+	csrfMiddleware(sessionHandler(authRequest)).ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	sessionCookie := rec.Result().Cookies()[0]
+
+	req = httptest.NewRequest("POST", "/api/create", nil)
+	req.AddCookie(sessionCookie)
+	req.Header.Set(CSRF_HEADER, tokenResp.Token)
+	rec = httptest.NewRecorder()
+	csrfMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	n, _ = backend.DeleteTeam("csrf")
+	assert.Equal(t, 1, n)
+}
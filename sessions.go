@@ -0,0 +1,418 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/captainGeech42/chaldeploy/internal/generic_map"
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+)
+
+// how often expired sessions are removed from the session backend
+const SESSION_PRUNE_INTERVAL = time.Duration(10) * time.Minute
+
+// SessionRecord is the data for a session, kept on the server
+type SessionRecord struct {
+	// team the session is logged in as, empty if it isn't logged in
+	TeamId string `json:"teamId"`
+
+	ExpTime time.Time `json:"expTime"`
+
+	// gob encoded session values
+	Data []byte `json:"data"`
+}
+
+// SessionBackend stores session data on the server, so the client only gets a session ID.
+// Load doesn't need to check if a session expired, the SessionStore does. Backends with their own
+// expiration (e.g., Redis with SET EX) can make Prune a no-op
+type SessionBackend interface {
+	// Get a session, nil if it doesn't exist
+	Load(id string) (*SessionRecord, error)
+
+	// Create or replace a session
+	Save(id string, rec SessionRecord) error
+
+	// Delete a session, doesn't fail if it doesn't exist
+	Delete(id string) error
+
+	// Delete every session for a team, returns how many were deleted
+	DeleteTeam(teamId string) (int, error)
+
+	// Delete expired sessions, returns how many were deleted
+	Prune(now time.Time) (int, error)
+}
+
+// Sessions kept in memory, they're lost when chaldeploy restarts
+type MemorySessionBackend struct {
+	sessions *generic_map.MapOf[string, SessionRecord]
+}
+
+func newMemorySessionBackend() *MemorySessionBackend {
+	return &MemorySessionBackend{sessions: new(generic_map.MapOf[string, SessionRecord])}
+}
+
+func (b *MemorySessionBackend) Load(id string) (*SessionRecord, error) {
+	if rec, ok := b.sessions.Load(id); ok {
+		return &rec, nil
+	}
+
+	return nil, nil
+}
+
+func (b *MemorySessionBackend) Save(id string, rec SessionRecord) error {
+	b.sessions.Store(id, rec)
+	return nil
+}
+
+func (b *MemorySessionBackend) Delete(id string) error {
+	b.sessions.Delete(id)
+	return nil
+}
+
+// Delete every session that matches a filter
+func (b *MemorySessionBackend) deleteWhere(f func(rec SessionRecord) bool) int {
+	n := 0
+	b.sessions.Range(func(id string, rec SessionRecord) bool {
+		if f(rec) {
+			b.sessions.Delete(id)
+			n++
+		}
+		return true
+	})
+
+	return n
+}
+
+func (b *MemorySessionBackend) DeleteTeam(teamId string) (int, error) {
+	return b.deleteWhere(func(rec SessionRecord) bool { return rec.TeamId == teamId }), nil
+}
+
+func (b *MemorySessionBackend) Prune(now time.Time) (int, error) {
+	return b.deleteWhere(func(rec SessionRecord) bool { return !now.Before(rec.ExpTime) }), nil
+}
+
+// Sessions kept as JSON files in a directory, one per session.
+// The directory can be a volume shared between replicas of chaldeploy
+type FileSessionBackend struct {
+	dir string
+
+	// serializes access from this process, writes are atomic so other processes only see whole files
+	mu sync.Mutex
+}
+
+func newFileSessionBackend(dir string) (*FileSessionBackend, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("couldn't create the session directory: %v", err)
+	}
+
+	return &FileSessionBackend{dir: dir}, nil
+}
+
+// session IDs are hex, anything else could escape the directory
+var sessionIdRegex = regexp.MustCompile(`^[0-9a-f]+$`)
+
+func (b *FileSessionBackend) path(id string) (string, error) {
+	if !sessionIdRegex.MatchString(id) {
+		return "", fmt.Errorf("invalid session ID: %q", id)
+	}
+
+	return filepath.Join(b.dir, id+".json"), nil
+}
+
+func (b *FileSessionBackend) readFile(path string) (*SessionRecord, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	rec := SessionRecord{}
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return nil, fmt.Errorf("couldn't parse session file %s: %v", path, err)
+	}
+
+	return &rec, nil
+}
+
+func (b *FileSessionBackend) Load(id string) (*SessionRecord, error) {
+	path, err := b.path(id)
+	if err != nil {
+		return nil, err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.readFile(path)
+}
+
+func (b *FileSessionBackend) Save(id string, rec SessionRecord) error {
+	path, err := b.path(id)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// write to a temp file and rename it, so a session is never half written
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+func (b *FileSessionBackend) Delete(id string) error {
+	path, err := b.path(id)
+	if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	return nil
+}
+
+// Delete every session that matches a filter
+func (b *FileSessionBackend) deleteWhere(f func(rec SessionRecord) bool) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	paths, err := filepath.Glob(filepath.Join(b.dir, "*.json"))
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for _, path := range paths {
+		rec, err := b.readFile(path)
+		if err != nil {
+			log.Printf("skipping session file: %v", err)
+			continue
+		}
+
+		if rec != nil && f(*rec) {
+			if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return n, err
+			}
+			n++
+		}
+	}
+
+	return n, nil
+}
+
+func (b *FileSessionBackend) DeleteTeam(teamId string) (int, error) {
+	return b.deleteWhere(func(rec SessionRecord) bool { return rec.TeamId == teamId })
+}
+
+func (b *FileSessionBackend) Prune(now time.Time) (int, error) {
+	return b.deleteWhere(func(rec SessionRecord) bool { return !now.Before(rec.ExpTime) })
+}
+
+// Make the session backend for $CHALDEPLOY_SESSION_STORE
+func newSessionBackend(c *Config) (SessionBackend, error) {
+	if c.SessionStore == "memory" {
+		return newMemorySessionBackend(), nil
+	}
+
+	if strings.HasPrefix(c.SessionStore, "file:") && len(c.SessionStore) > len("file:") {
+		return newFileSessionBackend(strings.TrimPrefix(c.SessionStore, "file:"))
+	}
+
+	return nil, fmt.Errorf("invalid session store, must be memory or file:<dir>: %s", c.SessionStore)
+}
+
+// SessionStore is a gorilla/sessions Store that keeps session data in a SessionBackend.
+// The cookie only has the session ID, signed with the session key
+type SessionStore struct {
+	Codecs  []securecookie.Codec
+	Options *sessions.Options
+	Backend SessionBackend
+
+	// how long a session lasts after it was created. Saving it again doesn't extend it, logging in creates a new one
+	TTL time.Duration
+}
+
+func newSessionStore(key []byte, backend SessionBackend, ttl time.Duration) *SessionStore {
+	s := &SessionStore{
+		Codecs: securecookie.CodecsFromPairs(key),
+		Options: &sessions.Options{
+			Path:     "/",
+			MaxAge:   int(ttl.Seconds()),
+			HttpOnly: true,
+			SameSite: http.SameSiteStrictMode,
+		},
+		Backend: backend,
+		TTL:     ttl,
+	}
+
+	// the signed cookie shouldn't outlive the session
+	for _, c := range s.Codecs {
+		if sc, ok := c.(*securecookie.SecureCookie); ok {
+			sc.MaxAge(s.Options.MaxAge)
+		}
+	}
+
+	return s
+}
+
+// Generate a random session ID
+func generateSessionId() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+// Get a session, cached for the request
+func (s *SessionStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
+
+// Load the session from the request's cookie. If there isn't a valid one, a new session is returned
+func (s *SessionStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(s, name)
+	opts := *s.Options
+	session.Options = &opts
+	session.IsNew = true
+
+	c, err := r.Cookie(name)
+	if err != nil {
+		return session, nil
+	}
+
+	var id string
+	if err := securecookie.DecodeMulti(name, c.Value, &id, s.Codecs...); err != nil {
+		return session, err
+	}
+
+	rec, err := s.Backend.Load(id)
+	if err != nil || rec == nil || !time.Now().UTC().Before(rec.ExpTime) {
+		// expired sessions get cleaned up by the pruner
+		return session, err
+	}
+
+	if err := gob.NewDecoder(bytes.NewReader(rec.Data)).Decode(&session.Values); err != nil {
+		return session, fmt.Errorf("couldn't decode session data: %v", err)
+	}
+
+	session.ID = id
+	session.IsNew = false
+
+	return session, nil
+}
+
+// Save the session to the backend and set the cookie. A negative MaxAge deletes the session
+func (s *SessionStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	if session.Options.MaxAge < 0 {
+		if session.ID != "" {
+			if err := s.Backend.Delete(session.ID); err != nil {
+				return err
+			}
+		}
+
+		http.SetCookie(w, sessions.NewCookie(session.Name(), "", session.Options))
+		return nil
+	}
+
+	// sessions expire a fixed time after they're created, keep the expiration time when an existing one is saved
+	now := time.Now().UTC()
+	expTime := now.Add(s.TTL)
+	if session.ID == "" {
+		id, err := generateSessionId()
+		if err != nil {
+			return err
+		}
+		session.ID = id
+	} else if old, err := s.Backend.Load(session.ID); err != nil {
+		return err
+	} else if old != nil && now.Before(old.ExpTime) {
+		expTime = old.ExpTime
+	}
+
+	data := bytes.Buffer{}
+	if err := gob.NewEncoder(&data).Encode(session.Values); err != nil {
+		return fmt.Errorf("couldn't encode session data: %v", err)
+	}
+
+	teamId, _ := session.Values["id"].(string)
+	rec := SessionRecord{TeamId: teamId, ExpTime: expTime, Data: data.Bytes()}
+	if err := s.Backend.Save(session.ID, rec); err != nil {
+		return err
+	}
+
+	encoded, err := securecookie.EncodeMulti(session.Name(), session.ID, s.Codecs...)
+	if err != nil {
+		return err
+	}
+
+	// the cookie doesn't need to outlive the session
+	opts := *session.Options
+	if opts.MaxAge > 0 {
+		opts.MaxAge = int(math.Ceil(expTime.Sub(now).Seconds()))
+	}
+
+	http.SetCookie(w, sessions.NewCookie(session.Name(), encoded, &opts))
+	return nil
+}
+
+// Give a session a new ID when it's saved, deleting the old one. Used when a team logs in, so a session ID
+// from before the login (e.g., one planted in the team's browser) can't be used to ride on it
+func (s *SessionStore) RenewID(session *sessions.Session) error {
+	if session.ID != "" {
+		if err := s.Backend.Delete(session.ID); err != nil {
+			return err
+		}
+	}
+
+	session.ID = ""
+	return nil
+}
+
+// Periodically delete expired sessions from the backend, until the context is canceled
+func pruneSessions(ctx context.Context, backend SessionBackend) {
+	for sleepCtx(ctx, SESSION_PRUNE_INTERVAL) {
+		now := time.Now().UTC()
+
+		// sessions that haven't been used in a while are re-validated from scratch
+		pruneSessionValidations(now.Add(-SESSION_PRUNE_INTERVAL))
+
+		if n, err := backend.Prune(now); err != nil {
+			log.Printf("couldn't prune expired sessions: %v", err)
+		} else if n > 0 {
+			log.Printf("pruned %d expired session(s)", n)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/stretchr/testify/assert"
+)
+
+// Log a team in with a new session, returns the session cookie
+func loginSession(t *testing.T, s *SessionStore, teamId string) *http.Cookie {
+	req := httptest.NewRequest("POST", "/api/auth", nil)
+	rec := httptest.NewRecorder()
+
+	session, err := s.Get(req, "session")
+	assert.Nil(t, err)
+	assert.True(t, session.IsNew)
+	session.Values["id"] = teamId
+	session.Values["authToken"] = "secret"
+	assert.Nil(t, session.Save(req, rec))
+
+	cookies := rec.Result().Cookies()
+	assert.Len(t, cookies, 1)
+	return cookies[0]
+}
+
+// Get the team a session cookie is logged in as, empty if it isn't
+func sessionTeam(s *SessionStore, c *http.Cookie) string {
+	req := httptest.NewRequest("GET", "/api/status", nil)
+	req.AddCookie(c)
+
+	session, _ := s.Get(req, "session")
+	teamId, _ := session.Values["id"].(string)
+	return teamId
+}
+
+func testSessionBackend(t *testing.T, backend SessionBackend) {
+	s := newSessionStore([]byte("aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"), backend, time.Hour)
+
+	// the cookie only has the ID, the values stay on the server
+	c1 := loginSession(t, s, "team1")
+	assert.NotContains(t, c1.Value, "secret")
+	assert.True(t, c1.HttpOnly)
+	assert.Equal(t, "team1", sessionTeam(s, c1))
+
+	c2 := loginSession(t, s, "team1")
+	c3 := loginSession(t, s, "team2")
+
+	// a cookie signed with another key isn't accepted
+	other := newSessionStore([]byte("bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"), backend, time.Hour)
+	assert.Equal(t, "", sessionTeam(other, c1))
+
+	// revoking a team's sessions
+	n, err := backend.DeleteTeam("team1")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, "", sessionTeam(s, c1))
+	assert.Equal(t, "", sessionTeam(s, c2))
+	assert.Equal(t, "team2", sessionTeam(s, c3))
+
+	// logging out
+	req := httptest.NewRequest("POST", "/api/logout", nil)
+	req.AddCookie(c3)
+	session, _ := s.Get(req, "session")
+	session.Options.MaxAge = -1
+	assert.Nil(t, session.Save(req, httptest.NewRecorder()))
+	assert.Equal(t, "", sessionTeam(s, c3))
+
+	// logging in renews the session ID, so a session planted before login can't be used afterwards
+	planted := loginSession(t, s, "")
+	req = httptest.NewRequest("POST", "/api/auth", nil)
+	req.AddCookie(planted)
+	rec := httptest.NewRecorder()
+	session, _ = s.Get(req, "session")
+	oldId := session.ID
+	assert.Nil(t, s.RenewID(session))
+	session.Values["id"] = "team4"
+	assert.Nil(t, session.Save(req, rec))
+	assert.NotEqual(t, oldId, session.ID)
+	assert.Equal(t, "", sessionTeam(s, planted))
+	assert.Equal(t, "team4", sessionTeam(s, rec.Result().Cookies()[0]))
+	_, err = backend.DeleteTeam("team4")
+	assert.Nil(t, err)
+
+	// expiration
+	c4 := loginSession(t, s, "team3")
+	assert.Equal(t, "team3", sessionTeam(s, c4))
+	n, err = backend.Prune(time.Now().UTC().Add(2 * time.Hour))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, n)
+	assert.Equal(t, "", sessionTeam(s, c4))
+}
+
+func TestMemorySessionBackend(t *testing.T) {
+	testSessionBackend(t, newMemorySessionBackend())
+}
+
+func TestFileSessionBackend(t *testing.T) {
+	dir := t.TempDir()
+	backend, err := newFileSessionBackend(dir)
+	assert.Nil(t, err)
+	testSessionBackend(t, backend)
+
+	// IDs can't escape the directory
+	_, err = backend.Load("../../etc/passwd")
+	assert.NotNil(t, err)
+
+	// every session was deleted, nothing is left behind
+	files, _ := os.ReadDir(dir)
+	assert.Empty(t, files)
+}
+
+func TestSessionExpiry(t *testing.T) {
+	backend := newMemorySessionBackend()
+	s := newSessionStore([]byte("aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"), backend, time.Hour)
+	c := loginSession(t, s, "team1")
+
+	var id string
+	assert.Nil(t, securecookie.DecodeMulti("session", c.Value, &id, s.Codecs...))
+	rec, _ := backend.Load(id)
+	expTime := rec.ExpTime.Add(-30 * time.Minute)
+	rec.ExpTime = expTime
+	assert.Nil(t, backend.Save(id, *rec))
+
+	// saving the session again doesn't push the expiration time back
+	req := httptest.NewRequest("GET", "/api/csrf", nil)
+	req.AddCookie(c)
+	w := httptest.NewRecorder()
+	session, _ := s.Get(req, "session")
+	session.Values["csrfToken"] = "token"
+	assert.Nil(t, session.Save(req, w))
+	rec, _ = backend.Load(id)
+	assert.Equal(t, expTime, rec.ExpTime)
+	assert.LessOrEqual(t, w.Result().Cookies()[0].MaxAge, 30*60)
+}
@@ -1,9 +1,14 @@
 // global object to track necessary elements
 ELEMS = {
     auth: document.getElementById("btn-authenticate"),
+    logout: document.getElementById("btn-logout"),
     create: document.getElementById("btn-create-instance"),
     extend: document.getElementById("btn-extend-instance"),
+    restart: document.getElementById("btn-restart-instance"),
     destroy: document.getElementById("btn-destroy-instance"),
+    allowIp: document.getElementById("btn-allow-ip"),
+    allowIpField: document.getElementById("input-allow-ip"),
+    allowedIps: document.getElementById("span-allowed-ips"),
     authStatus: document.getElementById("span-auth-status"),
     instanceStatus: document.getElementById("span-instance-status"),
     rctfAuthUrlField: document.getElementById("ta-rctf-auth-url"),
@@ -12,6 +17,28 @@ ELEMS = {
     errorToast: document.getElementById("error-toast"),
 }
 
+// CSRF token for the session, sent with every POST
+let csrfToken = "";
+
+// Get the CSRF token for the session from the server
+function refreshCsrfToken() {
+    return fetch("/api/csrf")
+        .then(r => r.json())
+        .then(data => {
+            csrfToken = data?.token || "";
+        })
+        .catch(err => console.error("couldn't get a CSRF token", err));
+}
+
+// POST to the API with the CSRF token
+function postApi(url, body) {
+    return fetch(url, {
+        method: "POST",
+        headers: { "X-CSRF-Token": csrfToken },
+        body: body
+    });
+}
+
 // Enable a button to be clicked
 function enableButton(btn) {
     if (btn.classList.contains("disabled")) {
@@ -49,11 +76,15 @@ function toggleStateButtons(isActive) {
     if (isActive) {
         disableButton(ELEMS.create);
         enableButton(ELEMS.extend);
+        enableButton(ELEMS.restart);
         enableButton(ELEMS.destroy);
+        enableButton(ELEMS.allowIp);
     } else {
         enableButton(ELEMS.create);
         disableButton(ELEMS.extend);
+        disableButton(ELEMS.restart);
         disableButton(ELEMS.destroy);
+        disableButton(ELEMS.allowIp);
     }
 }
 
@@ -100,10 +131,7 @@ function onAuthFieldChange(e) {
 function onAuthenticate(e) {
     statusInfo(ELEMS.authStatus, "(attempting auth...)");
 
-    fetch("/api/auth", {
-        method: "POST",
-        body: ELEMS.rctfAuthUrlField.value
-    }).then(r => {
+    postApi("/api/auth", ELEMS.rctfAuthUrlField.value).then(r => {
         if (r.status === 403) {
             showErrorToast("Couldn't auth");
             statusError(ELEMS.authStatus, "Couldn't auth to rCTF, bad token/URL?");
@@ -118,6 +146,7 @@ function onAuthenticate(e) {
             showNoticeToast("Authenticated");
             statusSuccess(ELEMS.authStatus, `Authenticated as ${teamName}`);
             disableButton(ELEMS.auth);
+            enableButton(ELEMS.logout);
             ELEMS.rctfAuthUrlField.readOnly = true;
 
             getInstanceStatus();
@@ -125,6 +154,32 @@ function onAuthenticate(e) {
     });
 }
 
+// Handler for the log out button being clicked
+function onLogout(e) {
+    disableButton(ELEMS.logout);
+
+    postApi("/api/logout")
+        .then(r => {
+            if (r.status >= 400) {
+                showErrorToast("Couldn't log out");
+                enableButton(ELEMS.logout);
+                return;
+            }
+
+            showNoticeToast("Logged out");
+            refreshCsrfToken();
+            statusInfo(ELEMS.authStatus, "not authenticated");
+            statusInfo(ELEMS.instanceStatus, "no instance created");
+            ELEMS.rctfAuthUrlField.readOnly = false;
+            ELEMS.rctfAuthUrlField.value = "";
+            ELEMS.allowedIps.innerText = "none";
+
+            // nothing can be done until logging in again
+            toggleStateButtons(false);
+            disableButton(ELEMS.create);
+        });
+}
+
 // Get the current instance status from the server
 // Enables buttons accordingly
 function getInstanceStatus() {
@@ -144,9 +199,23 @@ function getInstanceStatus() {
         })
         .then(data => {
             if (data) {
-                if (data?.state === "active") {
+                ELEMS.allowedIps.innerText = data?.allowedIps?.join(", ") || "none";
+
+                if (data?.state === "active" && data?.health === "crashing") {
+                    statusError(ELEMS.instanceStatus, `Instance at ${data?.host} is crashing, try restarting it. If it keeps happening, contact an @Admin`);
+                    toggleStateButtons(true);
+                } else if (data?.state === "active" && data?.health === "starting") {
+                    statusInfo(ELEMS.instanceStatus, `Instance at ${data?.host} is (re)starting, expires at ${data?.expTime}`);
+                    toggleStateButtons(true);
+                } else if (data?.state === "active" && data?.accessToken) {
+                    statusSuccess(ELEMS.instanceStatus, `Active instance available at ${data?.host}, expires at ${data?.expTime}. Send access token ${data?.accessToken} when connecting`);
+                    toggleStateButtons(true);
+                } else if (data?.state === "active") {
                     statusSuccess(ELEMS.instanceStatus, `Active instance available at ${data?.host}, expires at ${data?.expTime}`);
                     toggleStateButtons(true);
+                } else if (data?.state === "failed") {
+                    statusError(ELEMS.instanceStatus, "Last deployment failed and was cleaned up, try creating it again. If it keeps happening, contact an @Admin");
+                    toggleStateButtons(false);
                 } else if (data?.state === "inactive") {
                     statusInfo(ELEMS.instanceStatus, "No active instance");
                     toggleStateButtons(false);
@@ -163,14 +232,17 @@ function onCreate(e) {
     statusInfo(ELEMS.instanceStatus, "(creating instance, may take a few minutes...)");
     disableButton(ELEMS.create);
     
-    fetch("/api/create", { method: "POST" })
+    postApi("/api/create")
         .then(r => {
             if (r.status === 403) {
                 showErrorToast("Couldn't create instance");
                 statusError(ELEMS.authStatus, "Please refresh the page and re-authenticate");
+            } else if (r.status === 429) {
+                showErrorToast(`Please wait ${r.headers.get("Retry-After") || "a few"} seconds before creating another instance`);
+                getInstanceStatus();
             } else if (r.status >= 400) {
                 showErrorToast("Couldn't create instance");
-                statusError(ELEMS.instanceStatus, "Server error, contact an @Admin");
+                getInstanceStatus();
             } else {
                 showNoticeToast("Instance created");
                 getInstanceStatus();
@@ -182,13 +254,17 @@ function onCreate(e) {
 function onExtend(e) {
     statusInfo(ELEMS.instanceStatus, "(extending instance...)");
     disableButton(ELEMS.extend);
+    disableButton(ELEMS.restart);
     disableButton(ELEMS.destroy);
     
-    fetch("/api/extend", { method: "POST" })
+    postApi("/api/extend")
         .then(r => {
             if (r.status === 403) {
                 showErrorToast("Couldn't extend instance");
                 statusError(ELEMS.authStatus, "Please refresh the page and re-authenticate");
+            } else if (r.status === 404) {
+                showErrorToast("Extending instances isn't available, contact an @Admin");
+                getInstanceStatus();
             } else if (r.status >= 400) {
                 showErrorToast("Couldn't extend instance");
                 statusError(ELEMS.instanceStatus, "Server error, contact an @Admin");
@@ -204,13 +280,72 @@ function onExtend(e) {
         });
 }
 
+// Handler for the Restart Instance button being clicked
+function onRestart(e) {
+    statusInfo(ELEMS.instanceStatus, "(restarting instance...)");
+    disableButton(ELEMS.extend);
+    disableButton(ELEMS.restart);
+    disableButton(ELEMS.destroy);
+
+    postApi("/api/restart")
+        .then(r => {
+            if (r.status === 403) {
+                showErrorToast("Couldn't restart instance");
+                statusError(ELEMS.authStatus, "Please refresh the page and re-authenticate");
+            } else if (r.status === 429) {
+                showErrorToast("Instance was restarted recently, please wait a few minutes");
+                getInstanceStatus();
+            } else if (r.status === 404) {
+                showErrorToast("Restarting instances isn't available, contact an @Admin");
+                getInstanceStatus();
+            } else if (r.status >= 400) {
+                showErrorToast("Couldn't restart instance");
+                statusError(ELEMS.instanceStatus, "Server error, contact an @Admin");
+            } else {
+                showNoticeToast("Instance restarting");
+                getInstanceStatus();
+            }
+        });
+}
+
+// Handler for the Allow IP button being clicked
+function onAllowIp(e) {
+    disableButton(ELEMS.allowIp);
+
+    postApi("/api/allow-ip", ELEMS.allowIpField.value.trim()).then(r => {
+        if (r.status === 403) {
+            showErrorToast("Couldn't allow IP");
+            statusError(ELEMS.authStatus, "Please refresh the page and re-authenticate");
+        } else if (r.status === 400) {
+            showErrorToast("That isn't a valid IP");
+        } else if (r.status === 404) {
+            showErrorToast("Allowing IPs isn't available, contact an @Admin");
+        } else if (r.status === 409) {
+            showErrorToast("Your team has already allowed the max number of IPs");
+        } else if (r.status >= 400) {
+            showErrorToast("Couldn't allow IP");
+            statusError(ELEMS.instanceStatus, "Server error, contact an @Admin");
+        } else {
+            return r.json();
+        }
+    }).then(data => {
+        if (data) {
+            showNoticeToast("IP allowed");
+            ELEMS.allowIpField.value = "";
+            ELEMS.allowedIps.innerText = data?.allowedIps?.join(", ") || "none";
+        }
+        enableButton(ELEMS.allowIp);
+    });
+}
+
 // Handler for the Destroy Instance button being clicked
 function onDestroy(e) {
     statusInfo(ELEMS.instanceStatus, "(destroying instance, make take a few minutes...)");
     disableButton(ELEMS.extend);
+    disableButton(ELEMS.restart);
     disableButton(ELEMS.destroy);
     
-    fetch("/api/destroy", { method: "POST" })
+    postApi("/api/destroy")
         .then(r => {
             if (r.status === 403) {
                 showErrorToast("Couldn't destroy instance");
@@ -229,9 +364,12 @@ function onDestroy(e) {
 function registerHandlers() {
     ELEMS.rctfAuthUrlField.oninput = onAuthFieldChange;
     ELEMS.auth.onclick = onAuthenticate;
+    ELEMS.logout.onclick = onLogout;
     ELEMS.create.onclick = onCreate;
     ELEMS.extend.onclick = onExtend;
+    ELEMS.restart.onclick = onRestart;
     ELEMS.destroy.onclick = onDestroy;
+    ELEMS.allowIp.onclick = onAllowIp;
 }
 
 // Make sure that each element was successfully identified in ELEMS
@@ -244,6 +382,7 @@ function validateElems() {
 
 if (validateElems()) {
     registerHandlers();
+    refreshCsrfToken();
 
     // on soft refresh, the old auth token may still be in the textarea
     // make it a little easier for the user to re-auth
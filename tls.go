@@ -0,0 +1,235 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// how often the TLS cert and key files are checked for changes
+const CERT_RELOAD_INTERVAL = time.Duration(10) * time.Second
+
+// how long a self-signed cert is valid for
+const SELF_SIGNED_CERT_LIFETIME = time.Duration(365*24) * time.Hour
+
+// CertReloader serves a TLS cert from files, picking up a new one when the files change
+// (e.g., cert-manager renewing it) without restarting chaldeploy
+type CertReloader struct {
+	certPath string
+	keyPath  string
+
+	cert *tls.Certificate
+
+	// newest mod time of the files when the cert was loaded
+	modTime time.Time
+
+	lastCheck time.Time
+	mu        sync.Mutex
+}
+
+// Load a TLS cert and key, failing if they can't be loaded the first time
+func newCertReloader(certPath, keyPath string, now time.Time) (*CertReloader, error) {
+	cr := &CertReloader{certPath: certPath, keyPath: keyPath, lastCheck: now}
+	if err := cr.reload(); err != nil {
+		return nil, err
+	}
+
+	return cr, nil
+}
+
+// Get the newest mod time of the cert and key files
+func (cr *CertReloader) filesModTime() (time.Time, error) {
+	newest := time.Time{}
+	for _, path := range []string{cr.certPath, cr.keyPath} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, err
+		}
+
+		if info.ModTime().After(newest) {
+			newest = info.ModTime()
+		}
+	}
+
+	return newest, nil
+}
+
+// Load the cert and key from the files
+func (cr *CertReloader) reload() error {
+	modTime, err := cr.filesModTime()
+	if err != nil {
+		return fmt.Errorf("couldn't read the TLS cert: %v", err)
+	}
+
+	cert, err := tls.LoadX509KeyPair(cr.certPath, cr.keyPath)
+	if err != nil {
+		return fmt.Errorf("couldn't load the TLS cert: %v", err)
+	}
+
+	cr.cert = &cert
+	cr.modTime = modTime
+	return nil
+}
+
+// Reload the cert if the files changed, at most once per CERT_RELOAD_INTERVAL.
+// If the new files can't be loaded, the old cert keeps getting served
+func (cr *CertReloader) maybeReload(now time.Time) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+
+	if now.Sub(cr.lastCheck) < CERT_RELOAD_INTERVAL {
+		return
+	}
+	cr.lastCheck = now
+
+	modTime, err := cr.filesModTime()
+	if err != nil {
+		log.Printf("couldn't check the TLS cert for changes: %v", err)
+		return
+	}
+	if !modTime.After(cr.modTime) {
+		return
+	}
+
+	// the cert and key might not be updated at the same time, this gets retried on the next check
+	if err := cr.reload(); err != nil {
+		log.Printf("keeping the old TLS cert: %v", err)
+		return
+	}
+	log.Println("reloaded the TLS cert")
+}
+
+// GetCertificate for tls.Config
+func (cr *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.maybeReload(time.Now())
+
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+
+	return cr.cert, nil
+}
+
+// Generate a self-signed cert for a set of hostnames and IPs, returned as PEM
+func generateSelfSignedCert(hosts []string, now time.Time) ([]byte, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"chaldeploy"}, CommonName: hosts[0]},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(SELF_SIGNED_CERT_LIFETIME),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, h)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	return certPEM, keyPEM, nil
+}
+
+// Get the TLS config for the servers, nil if TLS is turned off
+func newTLSConfig(c *Config) (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if c.TLSCert != "" {
+		cr, err := newCertReloader(c.TLSCert, c.TLSKey, time.Now())
+		if err != nil {
+			return nil, err
+		}
+
+		tlsConfig.GetCertificate = cr.GetCertificate
+		return tlsConfig, nil
+	}
+
+	if c.TLSSelfSigned {
+		certPEM, keyPEM, err := generateSelfSignedCert([]string{"localhost", "127.0.0.1", "::1"}, time.Now())
+		if err != nil {
+			return nil, fmt.Errorf("couldn't generate a self-signed TLS cert: %v", err)
+		}
+
+		cert, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't load the self-signed TLS cert: %v", err)
+		}
+
+		fingerprint := sha256.Sum256(cert.Certificate[0])
+		log.Printf("using a self-signed TLS cert for localhost, SHA-256 fingerprint %s", hex.EncodeToString(fingerprint[:]))
+
+		tlsConfig.Certificates = []tls.Certificate{cert}
+		return tlsConfig, nil
+	}
+
+	return nil, nil
+}
+
+// Get the port from a listen address (e.g., ":5050")
+func listenPort(addr string) (int, error) {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return 0, fmt.Errorf("invalid listen address %s: %v", addr, err)
+	}
+
+	p, err := strconv.Atoi(port)
+	if err != nil || p < 1 || p > 65535 {
+		return 0, fmt.Errorf("invalid listen address %s, the port must be 1-65535", addr)
+	}
+
+	return p, nil
+}
+
+// Serve HTTPS if the server has a TLS config, otherwise plain HTTP
+func listenAndServe(srv *http.Server) error {
+	scheme := "http"
+	if srv.TLSConfig != nil {
+		scheme = "https"
+	}
+	log.Printf("starting server on %s (%s)", srv.Addr, scheme)
+
+	if srv.TLSConfig != nil {
+		// the cert comes from the TLS config
+		return srv.ListenAndServeTLS("", "")
+	}
+
+	return srv.ListenAndServe()
+}
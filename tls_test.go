@@ -0,0 +1,80 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Write a self-signed cert for a host to disk, with a mod time
+func writeTestCert(t *testing.T, dir, host string, modTime time.Time) (string, string) {
+	certPEM, keyPEM, err := generateSelfSignedCert([]string{host}, time.Now())
+	assert.Nil(t, err)
+
+	certPath, keyPath := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	assert.Nil(t, os.WriteFile(certPath, certPEM, 0600))
+	assert.Nil(t, os.WriteFile(keyPath, keyPEM, 0600))
+	assert.Nil(t, os.Chtimes(certPath, modTime, modTime))
+	assert.Nil(t, os.Chtimes(keyPath, modTime, modTime))
+
+	return certPath, keyPath
+}
+
+// Get the hostname a served cert is for
+func certHost(t *testing.T, cr *CertReloader) string {
+	cert, err := cr.GetCertificate(&tls.ClientHelloInfo{})
+	assert.Nil(t, err)
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	assert.Nil(t, err)
+	return leaf.DNSNames[0]
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	start := time.Now().Add(-time.Hour)
+	certPath, keyPath := writeTestCert(t, dir, "old.example.com", start)
+
+	cr, err := newCertReloader(certPath, keyPath, start)
+	assert.Nil(t, err)
+	assert.Equal(t, "old.example.com", certHost(t, cr))
+
+	// a renewed cert gets picked up on the next check
+	writeTestCert(t, dir, "new.example.com", start.Add(time.Minute))
+	cr.lastCheck = time.Time{}
+	assert.Equal(t, "new.example.com", certHost(t, cr))
+
+	// a broken cert keeps the old one around
+	assert.Nil(t, os.WriteFile(keyPath, []byte("nope"), 0600))
+	cr.lastCheck = time.Time{}
+	assert.Equal(t, "new.example.com", certHost(t, cr))
+
+	// the files aren't checked again until the interval is up
+	writeTestCert(t, dir, "newer.example.com", time.Now().Add(time.Minute))
+	assert.Equal(t, "new.example.com", certHost(t, cr))
+
+	// a cert that can't be loaded on startup is an error
+	_, err = newCertReloader(filepath.Join(dir, "missing.crt"), keyPath, start)
+	assert.NotNil(t, err)
+}
+
+func TestSelfSignedTLSConfig(t *testing.T) {
+	tlsConfig, err := newTLSConfig(&Config{})
+	assert.Nil(t, err)
+	assert.Nil(t, tlsConfig)
+
+	tlsConfig, err = newTLSConfig(&Config{TLSSelfSigned: true})
+	assert.Nil(t, err)
+	assert.Len(t, tlsConfig.Certificates, 1)
+
+	leaf, err := x509.ParseCertificate(tlsConfig.Certificates[0].Certificate[0])
+	assert.Nil(t, err)
+	assert.Nil(t, leaf.VerifyHostname("localhost"))
+	assert.Nil(t, leaf.VerifyHostname("127.0.0.1"))
+	assert.NotNil(t, leaf.VerifyHostname("example.com"))
+}
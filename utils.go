@@ -1,8 +1,13 @@
 package main
 
 import (
+	"context"
 	"crypto/sha256"
 	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
 
 	"github.com/captainGeech42/chaldeploy/internal/generic_map"
 )
@@ -39,3 +44,68 @@ func HashString(message string) string {
 
 	return d
 }
+
+// Check if an IP is in any of a list of networks
+func ipInNets(ip net.IP, nets []*net.IPNet) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Get the IP of the client that sent a request.
+// X-Forwarded-For is only used if the request came from a trusted proxy, and is walked from the right
+// so a client can't spoof their IP by sending the header themselves
+func getClientIP(r *http.Request, trustedProxies []*net.IPNet) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil || !ipInNets(ip, trustedProxies) {
+		return host
+	}
+
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(forwarded[i]))
+		if hop == nil {
+			// garbage in the header, don't trust anything before it
+			break
+		}
+
+		ip = hop
+		if !ipInNets(hop, trustedProxies) {
+			break
+		}
+	}
+
+	return ip.String()
+}
+
+// Convert an IP into a CIDR that only matches that IP
+func ipToCIDR(ip net.IP) string {
+	if ip.To4() != nil {
+		return ip.String() + "/32"
+	}
+
+	return ip.String() + "/128"
+}
+
+// Sleep for a duration, or until the context is canceled
+// Returns true if the full duration elapsed, otherwise false
+func sleepCtx(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -1,7 +1,11 @@
 package main
 
 import (
+	"context"
+	"net"
+	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -16,3 +20,32 @@ func TestContains(t *testing.T) {
 	assert.True(t, Contains([]int{1, 2, 3}, 3))
 	assert.False(t, Contains([]int{1, 2, 3}, 5))
 }
+
+func TestClientIP(t *testing.T) {
+	_, proxyNet, _ := net.ParseCIDR("10.0.0.0/8")
+	proxies := []*net.IPNet{proxyNet}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "1.2.3.4:5555"
+	r.Header.Set("X-Forwarded-For", "6.6.6.6")
+	assert.Equal(t, "1.2.3.4", getClientIP(r, proxies))
+
+	// from a trusted proxy, the client can still prepend a spoofed IP
+	r.RemoteAddr = "10.1.1.1:5555"
+	r.Header.Set("X-Forwarded-For", "6.6.6.6, 1.2.3.4, 10.2.2.2")
+	assert.Equal(t, "1.2.3.4", getClientIP(r, proxies))
+
+	r.Header.Del("X-Forwarded-For")
+	assert.Equal(t, "10.1.1.1", getClientIP(r, proxies))
+
+	assert.Equal(t, "1.2.3.4/32", ipToCIDR(net.ParseIP("1.2.3.4")))
+	assert.Equal(t, "2001:db8::1/128", ipToCIDR(net.ParseIP("2001:db8::1")))
+}
+
+func TestSleepCtx(t *testing.T) {
+	assert.True(t, sleepCtx(context.Background(), time.Millisecond))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.False(t, sleepCtx(ctx, time.Hour))
+}